@@ -0,0 +1,138 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thresholds for adapting the overall limit to the rest of the system.
+const (
+	// Memory PSI (share of time some task stalled on memory over the last
+	// 10s, in percent) above which the limit is shrunk, and below which it
+	// may grow.
+	psiHigh = 10
+	psiLow  = 1
+	// Share of memory available below which other workloads are taken to
+	// need it, and above which the machine is otherwise idle.
+	availLow  = 0.10
+	availHigh = 0.30
+	// Minimum time between adjustments, so each one can take effect first.
+	adaptEvery = 5 * time.Second
+)
+
+// adaptive bounds the overall limit when it adapts to system conditions.
+type adaptive struct {
+	min, max uint64
+	// When the limit was last adjusted.
+	last time.Time
+}
+
+// adapt shrinks the overall limit while the system is under memory pressure
+// or short of available memory, and grows it back while the system is
+// otherwise idle, within the bounds of m.adaptive.
+func (m *monitor) adapt() {
+	a := m.adaptive
+	if a == nil || m.now.Sub(a.last) < adaptEvery {
+		return
+	}
+	avail, total, err := memAvailable()
+	if err != nil {
+		return
+	}
+	// Without PSI, go by available memory alone.
+	psi, err := memoryPressure()
+	if err != nil {
+		psi = 0
+	}
+
+	limit := m.global.limit
+	share := float64(avail) / float64(total)
+	var reason string
+	switch {
+	case psi > psiHigh:
+		limit -= limit / 10
+		reason = fmt.Sprintf("memory pressure %.1f%%", psi)
+	case share < availLow:
+		limit -= limit / 10
+		reason = fmt.Sprintf("only %s of %s available", formatSize(avail), formatSize(total))
+	case psi < psiLow && share > availHigh:
+		limit += limit / 20
+		reason = fmt.Sprintf("system idle, %s of %s available", formatSize(avail), formatSize(total))
+	default:
+		return
+	}
+	if limit < a.min {
+		limit = a.min
+	}
+	if limit > a.max {
+		limit = a.max
+	}
+	if limit == m.global.limit {
+		return
+	}
+
+	a.last = m.now
+	m.emit(event{Time: m.now, Type: "adapt", Vsz: m.global.vsz, Reason: fmt.Sprintf("%s, changing overall limit from %s to %s", reason, formatSize(m.global.limit), formatSize(limit))})
+	m.global.limit = limit
+}
+
+// memAvailable returns MemAvailable and MemTotal from /proc/meminfo, in
+// bytes.
+func memAvailable() (avail, total uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "MemAvailable:":
+			dst = &avail
+		case "MemTotal:":
+			dst = &total
+		default:
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		*dst = kb * 1024
+	}
+	if avail == 0 || total == 0 {
+		return 0, 0, fmt.Errorf("MemAvailable or MemTotal missing from /proc/meminfo")
+	}
+	return avail, total, s.Err()
+}
+
+// memoryPressure returns the "some" avg10 of /proc/pressure/memory: the
+// percentage of the last 10 seconds some task spent stalled on memory.
+func memoryPressure() (float64, error) {
+	data, err := os.ReadFile("/proc/pressure/memory")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		if _, avg10, ok := strings.Cut(fields[1], "avg10="); ok {
+			return strconv.ParseFloat(avg10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no some avg10 in /proc/pressure/memory")
+}
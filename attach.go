@@ -0,0 +1,161 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// attachRule makes new processes of the given name, and optionally owner,
+// top-level processes of trees of their own, with the given VSZ limit.
+type attachRule struct {
+	spec  string
+	comm  string
+	uid   int // -1 for any user
+	limit uint64
+}
+
+type attachFlag []attachRule
+
+func (f *attachFlag) String() string {
+	return fmt.Sprint(len(*f), " rules")
+}
+
+func (f *attachFlag) Set(value string) error {
+	spec, limitStr, hasLimit := strings.Cut(value, ":")
+	comm, owner, hasOwner := strings.Cut(spec, "@")
+	if comm == "" {
+		return fmt.Errorf("missing process name in %q", value)
+	}
+	r := attachRule{spec: spec, comm: comm, uid: -1, limit: unlimited}
+	if hasOwner {
+		uid, err := lookupUID(owner)
+		if err != nil {
+			return err
+		}
+		r.uid = uid
+	}
+	if hasLimit {
+		var err error
+		if r.limit, err = parseSize(limitStr); err != nil {
+			return err
+		}
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// lookupUID returns the UID of the user with the given name or UID.
+func lookupUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func (r attachRule) matches(stat procfs.ProcStat) bool {
+	return stat.Comm == r.comm && (r.uid < 0 || procUID(stat.PID) == r.uid)
+}
+
+// attach starts tracking processes matching the attach rules that are not
+// in a tracked tree yet, as top-level processes of trees of their own.
+// Processes already managed by another instance, as told by their tree
+// lock, are left to it.
+func (m *monitor) attach(stats map[int]procfs.ProcStat) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.declined.prune(stats)
+	var candidates []procfs.ProcStat
+	for _, stat := range stats {
+		if ignored(stat) || m.declined.has(stat) {
+			continue
+		}
+		for _, r := range m.attachRules {
+			if r.matches(stat) {
+				candidates = append(candidates, stat)
+				break
+			}
+		}
+	}
+	// Parents first, so that a matching process started by another one is
+	// part of its tree rather than a tree of its own.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Starttime != candidates[j].Starttime {
+			return candidates[i].Starttime < candidates[j].Starttime
+		}
+		return candidates[i].PID < candidates[j].PID
+	})
+
+	for _, stat := range candidates {
+		if m.inTrees(stats, stat) {
+			continue
+		}
+		for _, r := range m.attachRules {
+			if !r.matches(stat) {
+				continue
+			}
+			if err := m.attachTree(stat, r.limit, r.spec); err == errLocked {
+				log.Printf("Not attaching to %d %s, already managed by another memlimit instance", stat.PID, stat.Comm)
+				m.declined.save(stat, struct{}{})
+			}
+			break
+		}
+	}
+}
+
+// attachTree starts tracking the tree of stat with the given VSZ limit,
+// attached by how. It fails with errLocked if another instance manages it.
+func (m *monitor) attachTree(stat procfs.ProcStat, limit uint64, how string) error {
+	t := newTree(stat.PID, limit)
+	t.rule, t.comm = how, stat.Comm
+	t.attached = m.clock.Now()
+	if m.lockDir != "" {
+		f, err := lockFile(treeLockPath(m.lockDir, stat.PID))
+		if err == errLocked {
+			return err
+		} else if err != nil {
+			log.Printf("Error locking tree of %d %s, attaching without it: %v", stat.PID, stat.Comm, err)
+		}
+		t.lock = f
+	}
+	m.trees = append(m.trees, t)
+	if m.topExited != nil {
+		watchExit(stat.PID, m.topExited)
+	}
+
+	desc := "no limit of its own"
+	if limit != unlimited {
+		desc = "limit " + formatSize(limit)
+	}
+	m.emit(m.newEvent("attach", stat, 0, fmt.Sprintf("by %s, %s", how, desc)))
+	return nil
+}
+
+// detach stops tracking t once its top-level process has exited, with a
+// summary of the attachment.
+func (m *monitor) detach(t *tree) {
+	if t.lock != nil {
+		// Unlike the locks of trees given on the command line, these
+		// would pile up over time. The process is gone, so nobody else
+		// can be about to lock it but for a reused PID.
+		os.Remove(t.lock.Name())
+		t.lock.Close()
+	}
+	e := m.newEvent("detach", procfs.ProcStat{PID: t.pid, Comm: t.comm}, 0, fmt.Sprintf("exited after %v, peak VSZ %s RSS %s, up to %d processes throttled at once", m.clock.Now().Sub(t.attached).Round(time.Second), formatSize(t.peakVsz), formatSize(t.peakRss), t.peakStopped))
+	e.Vsz = t.budget.vsz + t.unfilterableVsz
+	m.emit(e)
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// auditRecord is a line of the -audit-log: a signal sent to a process.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	PID       int       `json:"pid"`
+	Starttime uint64    `json:"starttime"`
+	Comm      string    `json:"comm"`
+	Signal    string    `json:"signal"`
+	// Why, as given by the last event about the process.
+	Reason string `json:"reason"`
+	// State of the process read right after signalling it, which it may not
+	// have reached yet; empty if it is gone.
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// auditSignal records a signal sent to stat in m.audit.
+func (m *monitor) auditSignal(stat procfs.ProcStat, sig syscall.Signal, err error) {
+	reason, _ := m.lastReason.get(stat)
+	r := auditRecord{
+		Time:      m.clock.Now(),
+		PID:       stat.PID,
+		Starttime: stat.Starttime,
+		Comm:      stat.Comm,
+		Signal:    signalName(sig),
+		Reason:    reason,
+	}
+	if proc, perr := procfs.NewProc(stat.PID); perr == nil {
+		if now, perr := proc.Stat(); perr == nil && now.Starttime == stat.Starttime {
+			r.State = now.State
+		}
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if err := m.audit.Encode(r); err != nil {
+		log.Println("Error writing audit log, disabling it:", err)
+		m.audit = nil
+		m.pidfds.sent = nil
+	}
+}
+
+// signalName returns the name of sig, e.g. SIGSTOP.
+func signalName(sig syscall.Signal) string {
+	switch sig {
+	case syscall.SIGSTOP:
+		return "SIGSTOP"
+	case syscall.SIGCONT:
+		return "SIGCONT"
+	}
+	for name, s := range escalationSignals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
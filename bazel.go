@@ -0,0 +1,101 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Bazel runs actions in a server that the bazel client daemonizes, outside
+// of any tree memlimit could track, so they can't be throttled. Instead,
+// with -bazel, the bazel command line is run in place of memlimit, with
+// Bazel's own scheduler given the memory there is to spend as
+// --local_ram_resources, to keep the actions it runs at once within it by
+// its estimates of their memory.
+
+// Bazel startup options that take a value, which may be given as the next
+// argument rather than after an =.
+var bazelStartupValues = map[string]bool{
+	"--bazelrc":                         true,
+	"--command_port":                    true,
+	"--connect_timeout_secs":            true,
+	"--digest_function":                 true,
+	"--experimental_cgroup_parent":      true,
+	"--failure_detail_out":              true,
+	"--host_jvm_args":                   true,
+	"--host_jvm_profile":                true,
+	"--install_base":                    true,
+	"--install_md5":                     true,
+	"--io_nice_level":                   true,
+	"--local_startup_timeout_secs":      true,
+	"--macos_qos_class":                 true,
+	"--max_idle_secs":                   true,
+	"--output_base":                     true,
+	"--output_user_root":                true,
+	"--server_javabase":                 true,
+	"--server_jvm_out":                  true,
+	"--unix_digest_hash_attribute_name": true,
+}
+
+// Bazel commands that run actions, and so take --local_ram_resources.
+var bazelBuildCommands = map[string]bool{
+	"build":    true,
+	"coverage": true,
+	"run":      true,
+	"test":     true,
+}
+
+// execBazel replaces memlimit with the bazel command line args, giving it
+// limit, or the memory available now if that is less. Bazel only reads it as
+// the command starts, so it is not adjusted as memory frees up or runs out.
+func execBazel(args []string, limit uint64) error {
+	ram, _, err := memAvailable()
+	if err != nil {
+		return err
+	}
+	if ram > limit {
+		ram = limit
+	}
+	cmd, err := bazelCommand(args)
+	if err != nil {
+		return err
+	}
+	if bazelBuildCommands[args[cmd]] {
+		args = bazelArgs(args, cmd, ram)
+		log.Printf("Running bazel with --local_ram_resources of %dM", ram>>20)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// bazelCommand returns the index of the command in args, a bazel command
+// line. Startup options are those before it.
+func bazelCommand(args []string) (int, error) {
+	i := 1
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		if bazelStartupValues[args[i]] {
+			i++
+		}
+		i++
+	}
+	if i >= len(args) {
+		return 0, fmt.Errorf("no bazel command in %q", strings.Join(args, " "))
+	}
+	return i, nil
+}
+
+// bazelArgs returns args, a bazel command line with its command at cmd, with
+// --local_ram_resources set to ram right after the command, so that it comes
+// before, and is overridden by, any the user gives.
+func bazelArgs(args []string, cmd int, ram uint64) []string {
+	opt := fmt.Sprintf("--local_ram_resources=%d", ram>>20)
+	return append(append(append([]string(nil), args[:cmd+1]...), opt), args[cmd+1:]...)
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBazelArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args, want string
+	}{
+		{"bazel build //...", "bazel build --local_ram_resources=4096 //..."},
+		{"bazel --batch test //a:b", "bazel --batch test --local_ram_resources=4096 //a:b"},
+		{"bazel --output_base=/x build //...", "bazel --output_base=/x build --local_ram_resources=4096 //..."},
+		{"bazel --output_base /x build //...", "bazel --output_base /x build --local_ram_resources=4096 //..."},
+		{"bazel --host_jvm_args -Xmx2g --bazelrc /rc build", "bazel --host_jvm_args -Xmx2g --bazelrc /rc build --local_ram_resources=4096"},
+		{"bazel", ""},
+		{"bazel --batch", ""},
+		{"bazel --output_base", ""},
+	} {
+		args := strings.Fields(tt.args)
+		cmd, err := bazelCommand(args)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("bazelCommand(%q) = %d, want an error", tt.args, cmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bazelCommand(%q): %v", tt.args, err)
+		} else if got, want := bazelArgs(args, cmd, 4<<30), strings.Fields(tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("bazelArgs(%q) = %q, want %q", tt.args, got, want)
+		}
+	}
+}
+
+func TestBazelBuildCommands(t *testing.T) {
+	for _, tt := range []struct {
+		args string
+		want bool
+	}{
+		{"bazel build //...", true},
+		{"bazel --batch coverage //a:b", true},
+		{"bazel run //a:b -- --flag", true},
+		{"bazel --output_base /x query //...", false},
+		{"bazel info", false},
+		{"bazel shutdown", false},
+	} {
+		args := strings.Fields(tt.args)
+		cmd, err := bazelCommand(args)
+		if err != nil {
+			t.Errorf("bazelCommand(%q): %v", tt.args, err)
+		} else if got := bazelBuildCommands[args[cmd]]; got != tt.want {
+			t.Errorf("%q takes --local_ram_resources: %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Mount point of the cgroup v2 hierarchy.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupDir returns the directory of the cgroup v2 named by name, either a
+// path under cgroupRoot or one relative to it.
+func cgroupDir(name string) (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("no cgroup v2 hierarchy mounted at %s", cgroupRoot)
+	}
+	dir := filepath.Join(cgroupRoot, strings.TrimPrefix(filepath.Clean(name), cgroupRoot))
+	if dir == cgroupRoot {
+		return "", fmt.Errorf("refusing to use the root cgroup")
+	}
+	return dir, nil
+}
+
+// makeCgroup creates the cgroup at dir if needed, and sets its
+// memory.swap.max to swapMax unless that is empty. It reports whether it
+// created dir, for it to be removed once done with.
+func makeCgroup(dir string, swapMax string) (created bool, err error) {
+	if err := os.Mkdir(dir, 0755); err == nil {
+		created = true
+	} else if !os.IsExist(err) {
+		return false, err
+	}
+
+	if swapMax != "" {
+		err = writeCgroupFile(filepath.Join(dir, "memory.swap.max"), swapMax)
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%v; is the memory controller enabled in cgroup.subtree_control of %s?", err, filepath.Dir(dir))
+		}
+	}
+	if err != nil {
+		if created {
+			os.Remove(dir)
+		}
+		return false, err
+	}
+	return created, nil
+}
+
+// wrapInCgroup runs args like wrap does, started right in the cgroup at
+// dir. Kernels before 5.7 can't do that, in which case the command is moved
+// there once started, leaving behind anything it spawned in the meantime.
+func wrapInCgroup(args []string, interactive bool, dir string, js *jobserver) (*exec.Cmd, <-chan int, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	cmd, exited, err := wrap(args, interactive, f, js)
+	if !errors.Is(err, syscall.ENOSYS) && !errors.Is(err, syscall.EINVAL) {
+		return cmd, exited, err
+	}
+	log.Println("Starting command in -cgroup not supported, moving it there once started:", err)
+	if cmd, exited, err = wrap(args, interactive, nil, js); err != nil {
+		return nil, nil, err
+	}
+	if err := writeCgroupFile(filepath.Join(dir, "cgroup.procs"), strconv.Itoa(cmd.Process.Pid)); err != nil {
+		cmd.Process.Kill()
+		return nil, nil, fmt.Errorf("moving command into -cgroup: %v", err)
+	}
+	return cmd, exited, nil
+}
+
+// writeCgroupFile writes value to an existing cgroup interface file.
+func writeCgroupFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseSwapMax turns a -cgroup-swap-max-mb value into what memory.swap.max
+// takes: bytes, or "max" for no limit.
+func parseSwapMax(s string) (string, error) {
+	if s == "" || s == "max" {
+		return s, nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(n, 10), nil
+}
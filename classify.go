@@ -0,0 +1,292 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// List of process names that are allowed to be stopped. Set from -profile.
+var whitelistedProcesses map[string]bool
+
+// List of process names that are never stopped, even when they share a name
+// with a whitelisted process. This covers distributed compilation and caching
+// wrappers, which are lightweight locally and may masquerade as the compiler.
+// A stopped sccache server would also deadlock every compile waiting on it.
+// The real compilers they spawn remain subject to the whitelist.
+var protectedProcesses = map[string]bool{
+	"ccache":  true,
+	"sccache": true,
+	"distcc":  true,
+	"distccd": true,
+	"icecc":   true,
+	"iceccd":  true,
+	"icerun":  true,
+}
+
+// Go toolchain process names, which are too generic to trust on their own.
+// These only match when the executable lives in a pkg/tool directory, either
+// under $GOROOT or a downloaded toolchain in the module cache.
+var goTools = map[string]bool{
+	"compile": true,
+	"link":    true,
+	"asm":     true,
+	"cgo":     true,
+}
+
+// Globs matched against the resolved executable path of processes that are
+// allowed to be stopped regardless of their name. Set from -match-exe.
+var whitelistedExes []string
+
+// parseMatchExe parses a -match-exe list of globs.
+func parseMatchExe(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(s, ",")
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+func matchesExe(exe string) bool {
+	for _, pattern := range whitelistedExes {
+		if ok, _ := filepath.Match(pattern, exe); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Process names, or globs of them, that are allowed to be stopped on top of
+// those of the profile. Set from -match-name.
+var whitelistedNames []string
+
+// parseMatchName parses a -match-name list of names, where * matches any
+// run of characters, as in *-cc1plus or cc1*.
+func parseMatchName(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	patterns := strings.Split(s, ",")
+	for _, pattern := range patterns {
+		if pattern == "" || strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// isWhitelisted reports whether the profile or -match-name allows processes
+// called name to be stopped.
+func isWhitelisted(name string) bool {
+	if whitelistedProcesses[name] {
+		return true
+	}
+	for _, pattern := range whitelistedNames {
+		if matchName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether name matches pattern, in which * matches any
+// run of characters. Unlike filepath.Match there are no character classes
+// or escapes, so target triples need no quoting.
+func matchName(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// Length of a comm the kernel truncated (TASK_COMM_LEN minus the NUL).
+const truncatedCommLen = 15
+
+// procNames returns the names a process may be known by. Normally that is
+// just its comm, but comm is truncated to 15 characters and can be rewritten
+// by the process itself, so when it disagrees with the executable the
+// basenames of the executable and argv[0] are tried as well.
+func procNames(stat procfs.ProcStat, exe string) []string {
+	names := []string{stat.Comm}
+	base := filepath.Base(exe)
+	if base == stat.Comm {
+		return names
+	}
+	names = append(names, base)
+	if len(stat.Comm) == truncatedCommLen {
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", stat.PID))
+		if err == nil {
+			argv0, _, _ := strings.Cut(string(cmdline), "\x00")
+			if argv0 = filepath.Base(argv0); argv0 != base && strings.HasPrefix(argv0, stat.Comm) {
+				names = append(names, argv0)
+			}
+		}
+	}
+	return names
+}
+
+func isFiltered(stat procfs.ProcStat) bool {
+	if protectedProcesses[stat.Comm] {
+		return false
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", stat.PID))
+	if err != nil {
+		// Without the executable path, fall back to trusting the name.
+		return isWhitelisted(stat.Comm) && !goTools[stat.Comm]
+	}
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
+	names := procNames(stat, exe)
+	for _, name := range names {
+		if protectedProcesses[name] {
+			return false
+		}
+	}
+	if matchesExe(exe) {
+		return true
+	}
+	for _, name := range names {
+		if !isWhitelisted(name) {
+			continue
+		}
+		if goTools[name] && !strings.Contains(exe, "/pkg/tool/") {
+			continue
+		}
+		return true
+	}
+	return (isWhitelisted("clang") || isWhitelisted("clang++")) && isClangFrontend(stat, exe)
+}
+
+// isClangFrontend reports whether stat is clang running a compile or
+// assembly job itself, as clang -cc1 or -cc1as. Whatever it was invoked as,
+// e.g. cc, c++ or clang-17, its executable is clang-something, and the
+// driver passes -cc1 as the first argument.
+func isClangFrontend(stat procfs.ProcStat, exe string) bool {
+	if !strings.HasPrefix(filepath.Base(exe), "clang") {
+		return false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", stat.PID))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) > 1 && (args[1] == "-cc1" || args[1] == "-cc1as")
+}
+
+// Main classes of JVM build daemons, which outlive the build that started
+// them and serve the builds after it.
+var jvmDaemons = map[string]string{
+	"org.gradle.launcher.daemon.bootstrap.GradleDaemon": "Gradle daemon",
+	"org.jetbrains.kotlin.daemon.KotlinCompileDaemon":   "Kotlin daemon",
+	"org.mvndaemon.mvnd.daemon.DaemonMain":              "mvnd daemon",
+}
+
+// jvmDaemon returns what JVM build daemon stat is, if any.
+func jvmDaemon(stat procfs.ProcStat) (string, bool) {
+	if stat.Comm != "java" {
+		return "", false
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", stat.PID))
+	if err != nil {
+		return "", false
+	}
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		if name, ok := jvmDaemons[arg]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Linker process names that may be running an LTO link.
+var linkers = map[string]bool{
+	"ld":       true,
+	"ld.bfd":   true,
+	"ld.gold":  true,
+	"ld.lld":   true,
+	"lld":      true,
+	"mold":     true,
+	"collect2": true,
+}
+
+// isLinker reports whether the filtered process stat is a linker. Filtered
+// processes named link are the Go linker.
+func isLinker(stat procfs.ProcStat) bool {
+	return linkers[stat.Comm] || stat.Comm == "link"
+}
+
+// LTO backend process names: GCC's, run by lto-wrapper for its WPA and
+// LTRANS stages, and LLVM's.
+var ltoBackends = map[string]bool{
+	"lto1":        true,
+	"lto-wrapper": true,
+	"llvm-lto":    true,
+}
+
+// isLTO reports whether stat is part of a link-time optimization step: an
+// LTO backend, or a linker doing LTO as told by its own arguments or those
+// of the compiler driver that ran it, through collect2 for GCC. GCC hands
+// its plugin to every link, LTO or not, so the plugin alone says nothing.
+func isLTO(stat procfs.ProcStat) bool {
+	switch {
+	case ltoBackends[stat.Comm]:
+		return true
+	case !linkers[stat.Comm]:
+		return false
+	}
+	for i := 0; i < 3; i++ {
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", stat.PID))
+		if err != nil {
+			return false
+		}
+		if ltoArgs(strings.Split(string(cmdline), "\x00")) {
+			return true
+		}
+		if i > 0 && !linkers[stat.Comm] {
+			// The driver.
+			return false
+		}
+		proc, err := procfs.NewProc(stat.PPID)
+		if err != nil {
+			return false
+		}
+		if stat, err = proc.Stat(); err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// ltoArgs reports whether the command line args of a linker or compiler
+// driver ask for LTO.
+func ltoArgs(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "LLVMgold") || strings.HasPrefix(arg, "-flto") || strings.HasPrefix(arg, "--lto") {
+			return true
+		}
+	}
+	return false
+}
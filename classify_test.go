@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLTOArgs(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline string
+		want    bool
+	}{
+		// What g++ runs for any link: the LTO plugin is always handed over.
+		{"/usr/lib/gcc/x86_64-linux-gnu/12/collect2 -plugin /usr/lib/gcc/x86_64-linux-gnu/12/liblto_plugin.so -plugin-opt=/usr/lib/gcc/x86_64-linux-gnu/12/lto-wrapper -plugin-opt=-fresolution=/tmp/ccX1b2c3.res -plugin-opt=-pass-through=-lgcc_s -plugin-opt=-pass-through=-lgcc -plugin-opt=-pass-through=-lc --build-id --eh-frame-hdr -m elf_x86_64 --hash-style=gnu --as-needed -dynamic-linker /lib64/ld-linux-x86-64.so.2 -pie -o hello /usr/lib/gcc/x86_64-linux-gnu/12/../../../x86_64-linux-gnu/Scrt1.o -L/usr/lib/gcc/x86_64-linux-gnu/12 hello.o -lstdc++ -lm -lgcc_s -lgcc -lc", false},
+		{"g++ -O2 -o hello hello.o", false},
+		{"g++ -O2 -fno-lto -o hello hello.o", false},
+		{"g++ -O2 -flto=auto -o hello hello.o", true},
+		{"/usr/bin/ld.gold -plugin /usr/lib/llvm-16/lib/LLVMgold.so -plugin-opt=mcpu=x86-64 -o hello hello.o", true},
+		{"ld.lld --lto-O3 -o hello hello.o", true},
+	} {
+		if got := ltoArgs(strings.Fields(tc.cmdline)); got != tc.want {
+			t.Errorf("ltoArgs(%q) = %v, want %v", tc.cmdline, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Flags a -config file can change while running. The others take effect on
+// restart.
+var reloadable = map[string]bool{
+	"vsz-limit-mb":     true,
+	"lto-vsz-limit-mb": true,
+	"profile":          true,
+	"match-exe":        true,
+	"match-name":       true,
+	"sort-by":          true,
+	"policy-script":    true,
+}
+
+// config is the flags set by a -config file, by name.
+type config map[string]string
+
+// readConfig reads a -config file: one flag per line, as name value or
+// name=value, or just name for boolean flags. Blank lines and lines starting
+// with # are skipped. A flag set more than once takes the last value, so
+// repeatable flags like -tree can only be given once. Reloadable flags set
+// after a [compile] or [link] line only apply during that phase of the
+// build, and are returned by phase.
+func readConfig(path string) (c config, phases map[string]config, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c = make(config)
+	section, inPhase := c, false
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			phase := line[1 : len(line)-1]
+			if !buildPhases[phase] {
+				return nil, nil, fmt.Errorf("line %d: unknown phase %q, want compile or link", i+1, phase)
+			}
+			if phases == nil {
+				phases = make(map[string]config)
+			}
+			if phases[phase] == nil {
+				phases[phase] = make(config)
+			}
+			section, inPhase = phases[phase], true
+			continue
+		}
+		name, value := line, "true"
+		if j := strings.IndexAny(line, "= \t"); j >= 0 {
+			name, value = line[:j], strings.TrimSpace(line[j+1:])
+		}
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, nil, fmt.Errorf("line %d: unknown flag %q", i+1, name)
+		}
+		if inPhase && !reloadable[name] {
+			return nil, nil, fmt.Errorf("line %d: %s can't be set per phase", i+1, name)
+		}
+		section[name] = value
+	}
+	return c, phases, nil
+}
+
+// value returns what c sets the flag name to, or its default.
+func (c config) value(name string) string {
+	if v, ok := c[name]; ok {
+		return v
+	}
+	return flag.Lookup(name).DefValue
+}
+
+// setFlagsFromConfig sets the flags in c that weren't set on the command
+// line or from the environment, and returns the ones that were.
+func setFlagsFromConfig(c config) (fixed map[string]bool, err error) {
+	fixed = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { fixed[f.Name] = true })
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fixed[name] {
+			continue
+		}
+		if err := flag.Set(name, c[name]); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return fixed, nil
+}
+
+// liveConfig is a -config file applied as it changes.
+type liveConfig struct {
+	path string
+	// Flags set on the command line or from the environment, which the
+	// file doesn't override.
+	fixed map[string]bool
+	// The file as last applied, and its phase sections.
+	applied config
+	phases  map[string]config
+}
+
+// base returns the value of the flag name outside of phase sections.
+func (c *liveConfig) base(name string) string {
+	if c.fixed[name] {
+		return flag.Lookup(name).Value.String()
+	}
+	return c.applied.value(name)
+}
+
+// reloadConfig rereads m.config and applies the changes to reloadable
+// flags and phase sections, as long as all of them are valid. Other changes
+// are only logged.
+func (m *monitor) reloadConfig() {
+	c := m.config
+	next, phases, err := readConfig(c.path)
+	if err != nil {
+		log.Printf("Not reloading %s: %v", c.path, err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkPhases(phases); err != nil {
+		log.Printf("Not reloading %s: %v", c.path, err)
+		return
+	}
+
+	var applied, skipped []string
+	var apply []func()
+	reclassify := false
+	for _, name := range changedFlags(c.applied, next, false) {
+		diff := fmt.Sprintf("%s %q -> %q", name, c.applied.value(name), next.value(name))
+		switch {
+		case c.fixed[name]:
+			skipped = append(skipped, diff+" (set on the command line or in the environment)")
+		case !reloadable[name]:
+			skipped = append(skipped, diff+" (needs a restart)")
+		default:
+			f, err := m.reloader(name, next.value(name))
+			if err != nil {
+				log.Printf("Not reloading %s: %s: %v", c.path, name, err)
+				return
+			}
+			apply = append(apply, f)
+			applied = append(applied, diff)
+			reclassify = reclassify || name == "profile" || name == "match-exe" || name == "match-name"
+		}
+	}
+	for _, phase := range []string{"compile", "link"} {
+		for _, name := range changedFlags(c.phases[phase], phases[phase], true) {
+			applied = append(applied, fmt.Sprintf("[%s] %s %q -> %q", phase, name, c.phases[phase][name], phases[phase][name]))
+			reclassify = reclassify || name == "profile" || name == "match-exe" || name == "match-name"
+		}
+	}
+	c.applied = next
+
+	if len(skipped) > 0 {
+		log.Printf("Ignoring changes in %s: %s", c.path, strings.Join(skipped, ", "))
+	}
+	if len(applied) == 0 {
+		c.phases = phases
+		return
+	}
+	for _, f := range apply {
+		f()
+	}
+	// The phase the build is in overrides the new base values in turn.
+	m.applyPhase(c.phases[m.phase], phases[m.phase])
+	c.phases = phases
+	log.Printf("Reloaded %s: %s", c.path, strings.Join(applied, ", "))
+
+	if reclassify {
+		m.releaseUnfiltered("no longer filtered after reloading " + c.path)
+	}
+}
+
+// releaseUnfiltered releases the throttled processes the whitelist no longer
+// covers, which nothing else would.
+func (m *monitor) releaseUnfiltered(reason string) {
+	m.hooks.startScan()
+	var releases []pendingRelease
+	for _, p := range m.procs {
+		if filtered, _ := m.classify(p.stat); !filtered && (m.thr.throttled(p.stat) || m.since.has(p.stat)) {
+			releases = append(releases, pendingRelease{p.stat, 0, reason})
+		}
+	}
+	m.releaseChildrenFirst(releases)
+}
+
+// changedFlags returns the flags that old and new set differently, in
+// order. Flags set to their defaults count as unset, except in phase
+// sections, where unset flags keep their base values instead.
+func changedFlags(old, new config, phase bool) []string {
+	names := make(map[string]bool)
+	for name := range old {
+		names[name] = true
+	}
+	for name := range new {
+		names[name] = true
+	}
+	var changed []string
+	for name := range names {
+		o, inOld := old[name]
+		n, inNew := new[name]
+		if phase && (inOld != inNew || o != n) || !phase && old.value(name) != new.value(name) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reloader validates value for the reloadable flag name, returning what
+// applies it.
+func (m *monitor) reloader(name, value string) (func(), error) {
+	switch name {
+	case "vsz-limit-mb", "lto-vsz-limit-mb":
+		limit, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		b := &m.lto
+		if name == "vsz-limit-mb" {
+			b = &m.global
+			if a := m.adaptive; a != nil && (limit < a.min || limit > a.max) {
+				return nil, fmt.Errorf("%s is outside -min-vsz-limit-mb %s and -max-vsz-limit-mb %s", formatSize(limit), formatSize(a.min), formatSize(a.max))
+			}
+		}
+		return func() { b.limit = limit }, nil
+	case "profile":
+		procs, ok := profiles[value]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", value)
+		}
+		return func() { whitelistedProcesses, processCharges = procs, profileCharges[value] }, nil
+	case "match-exe":
+		exes, err := parseMatchExe(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() { whitelistedExes = exes }, nil
+	case "match-name":
+		names, err := parseMatchName(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() { whitelistedNames = names }, nil
+	case "policy-script":
+		if value == "" {
+			return func() { m.policy = nil }, nil
+		}
+		p, err := readPolicy(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() { m.policy = p }, nil
+	case "sort-by":
+		key, ok := m.sortKeyFunc(value)
+		if !ok {
+			return nil, fmt.Errorf("unknown sort key %q", value)
+		}
+		return func() { m.sortKey, m.sortBy = key, value }, nil
+	}
+	return nil, fmt.Errorf("can't be reloaded")
+}
+
+// watchConfig calls reload on SIGHUP, and whenever the file at path is
+// written or replaced. Without inotify, only SIGHUP works.
+func watchConfig(path string, reload func()) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	changed := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Printf("Got SIGHUP, reloading %s", path)
+			case <-changed:
+			}
+			reload()
+		}
+	}()
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	// Editors and configuration management tend to replace the file rather
+	// than write it in place, so watch the directory for it.
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				log.Printf("Error watching %s, only reloading it on SIGHUP: %v", path, err)
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				off += syscall.SizeofInotifyEvent
+				evName := bytes.TrimRight(buf[off:off+int(ev.Len)], "\x00")
+				off += int(ev.Len)
+				if string(evName) == name {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,487 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START).
+const listenFdsStart = 3
+
+// activationListener returns the socket passed in by systemd socket
+// activation, or nil if we were not socket-activated. Only the first socket
+// is used, for the control API. It is to be called before starting the
+// command to run, so that none of the sockets leak into it.
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	// Passed without close-on-exec, which would have the command we run
+	// inherit them.
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+	}
+
+	f := os.NewFile(listenFdsStart, "systemd-socket")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %v", err)
+	}
+	return l, nil
+}
+
+// listen opens the control API listener. Addresses containing a slash are
+// unix socket paths, which only our user may connect to; anything else is a
+// TCP host:port, on loopback if the host is left out.
+func listen(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		// Rather than set the umask, which is shared by every thread and
+		// would apply to files others create meanwhile.
+		if err := os.Chmod(addr, 0600); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Cookie that carries the token of a TCP listener for the dashboard, set
+// when it is opened as /?token=<token>.
+const tokenCookie = "memlimit-token"
+
+// readToken reads the token of -api-token-file.
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// authenticate returns h as it is to be served on l: as is on a unix socket,
+// where h checks the credentials of the client as it needs to, and only to
+// requests carrying token on TCP, where anyone who can reach the port could
+// connect.
+func authenticate(l net.Listener, token string, h http.Handler) (http.Handler, error) {
+	if l.Addr().Network() == "unix" {
+		return h, nil
+	}
+	if token == "" {
+		return nil, fmt.Errorf("serving on TCP %s requires -api-token-file", l.Addr())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, fromQuery := "", false
+		if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			got = v
+		} else if v := r.URL.Query().Get("token"); v != "" {
+			got, fromQuery = v, true
+		} else if c, err := r.Cookie(tokenCookie); err == nil {
+			got = c.Value
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+		if fromQuery {
+			http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+// peerCredKey is the context key of the credentials of the process at the
+// other end of a unix socket connection, as read by serveControl.
+type peerCredKey struct{}
+
+// serveControl serves h on l, passing handlers the credentials of the
+// processes connecting over a unix socket, or nil if they couldn't be read.
+func serveControl(l net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h, ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+		uc, ok := c.(*net.UnixConn)
+		if !ok {
+			return ctx
+		}
+		var cred *syscall.Ucred
+		if raw, err := uc.SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				cred, _ = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+			})
+		}
+		return context.WithValue(ctx, peerCredKey{}, cred)
+	}}
+	return srv.Serve(l)
+}
+
+// mayControl returns why the client of r may not change limits or
+// overrides, or "" if it may. A unix socket may be open to other users, as
+// activated ones are, so over one only our user and root may; over TCP, the
+// token vouches for the client.
+func mayControl(r *http.Request) string {
+	v := r.Context().Value(peerCredKey{})
+	if v == nil {
+		return ""
+	}
+	cred := v.(*syscall.Ucred)
+	switch {
+	case cred == nil:
+		return "unknown client credentials"
+	case cred.Uid != 0 && int(cred.Uid) != os.Geteuid():
+		return fmt.Sprintf("uid %d may not control memlimit running as uid %d", cred.Uid, os.Geteuid())
+	}
+	return ""
+}
+
+// mayAttach returns why the client of r may not have the tree of pid
+// tracked, or memory reserved for it, or "" if it may. Over a unix socket,
+// only root may act on the processes of other users; over TCP, the token
+// vouches for the client.
+func mayAttach(r *http.Request, pid int) string {
+	v := r.Context().Value(peerCredKey{})
+	if v == nil {
+		return ""
+	}
+	cred := v.(*syscall.Ucred)
+	switch {
+	case cred == nil:
+		return "unknown client credentials"
+	case cred.Uid != 0 && procUID(pid) != int(cred.Uid):
+		return fmt.Sprintf("process %d is not owned by uid %d", pid, cred.Uid)
+	}
+	return ""
+}
+
+// controlHandler returns the HTTP/JSON control API, to be served through
+// authenticate:
+//
+//	GET  /          web dashboard of the endpoints below
+//	GET  /status    current totals and limits
+//	GET  /events    recent throttling decisions and their reasons
+//	GET  /events/stream
+//	                events as they happen, as server-sent events
+//	GET  /history   memory and process counts of recent scans
+//	GET  /explain   why pid=<pid> is stopped or running
+//	GET  /tree      the tracked process trees as of the last scan
+//	POST /limit     set vsz-limit-mb (a size, e.g. 2G), for tree=<pid>, lto=1 or overall
+//	POST /override  set action=run (never throttle), stop or clear for pid=<pid>
+//	POST /attach    track the tree of pid=<pid>, with vsz-limit-mb if given
+//	POST /reserve   wait for size=<size> to be free under the overall limit and
+//	                reserve it for the job of pid=<pid>, returning its token
+//	POST /unreserve give back the reservation token=<token>
+//	GET  /healthz   200 while scans keep completing within the check interval
+//	GET  /readyz    200 once healthy and a scan has found the tracked trees
+//
+// Over a unix socket, only our user and root may set limits and overrides,
+// and the processes to attach and reserve for have to be the client's own
+// unless it is root.
+//
+// This is also the API for programs such as build farm controllers: status,
+// limits, stop and run overrides and the event stream are all here. It is
+// not offered over gRPC, which would take the grpc and protobuf modules and
+// generated code, or an HTTP/2 server without TLS, which net/http only has
+// from Go 1.24.
+func (m *monitor) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", m.handleDashboard)
+	mux.HandleFunc("/status", m.handleStatus)
+	mux.HandleFunc("/events", m.handleEvents)
+	mux.HandleFunc("/events/stream", m.handleEventStream)
+	mux.HandleFunc("/history", m.handleHistory)
+	mux.HandleFunc("/tree", m.handleTree)
+	mux.HandleFunc("/explain", m.handleExplain)
+	mux.HandleFunc("/limit", m.handleLimit)
+	mux.HandleFunc("/override", m.handleOverride)
+	mux.HandleFunc("/attach", m.handleAttach)
+	mux.HandleFunc("/reserve", m.handleReserve)
+	mux.HandleFunc("/unreserve", m.handleUnreserve)
+	mux.HandleFunc("/healthz", m.handleHealthz)
+	mux.HandleFunc("/readyz", m.handleReadyz)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing response", err)
+	}
+}
+
+func (m *monitor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	st := m.status
+	m.mu.Unlock()
+
+	writeJSON(w, st)
+}
+
+// Number of check intervals without a completed scan after which we are
+// considered stuck.
+const unhealthyIntervals = 3
+
+// unhealthy returns why scans are not keeping up, or "" if they are.
+func (m *monitor) unhealthy(now time.Time) string {
+	last := m.lastScan
+	if last.IsZero() {
+		last = m.started
+	}
+	if age := now.Sub(last); age > unhealthyIntervals*m.interval {
+		return fmt.Sprintf("no scan completed for %v", age.Round(time.Millisecond))
+	}
+	if m.scanDuration > m.interval {
+		return fmt.Sprintf("last scan took %v, longer than the %v check interval", m.scanDuration.Round(time.Millisecond), m.interval)
+	}
+	return ""
+}
+
+func (m *monitor) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	reason := m.unhealthy(m.clock.Now())
+	m.mu.Unlock()
+
+	if reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (m *monitor) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	reason := m.unhealthy(m.clock.Now())
+	switch {
+	case reason != "":
+	case m.lastScan.IsZero():
+		reason = "no scan completed yet"
+	case len(m.trees) == 0:
+		reason = "no process trees tracked"
+	}
+	m.mu.Unlock()
+
+	if reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (m *monitor) handleEvents(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	events := append([]event(nil), m.events...)
+	m.mu.Unlock()
+
+	writeJSON(w, events)
+}
+
+// Events a client of /events/stream may fall behind by before it is dropped,
+// and how often it is sent a comment while there are none, so proxies don't
+// time out the connection.
+const (
+	streamBuffer    = 256
+	streamKeepalive = 15 * time.Second
+)
+
+// handleEventStream sends events as they are emitted, as server-sent events
+// named after their type with the event as JSON data, until the client goes
+// away.
+func (m *monitor) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan event, streamBuffer)
+	m.mu.Lock()
+	if m.subscribers == nil {
+		m.subscribers = make(map[chan event]bool)
+	}
+	m.subscribers[ch] = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.subscribers, ch)
+		m.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func (m *monitor) handleLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if reason := mayControl(r); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+	limit, err := parseSize(r.FormValue("vsz-limit-mb"))
+	if err != nil {
+		http.Error(w, "invalid vsz-limit-mb: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b *budget
+	switch {
+	case r.FormValue("tree") != "":
+		pid, err := strconv.Atoi(r.FormValue("tree"))
+		if err != nil {
+			http.Error(w, "invalid tree: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, t := range m.trees {
+			if t.pid == pid {
+				b = &t.budget
+			}
+		}
+		if b == nil {
+			http.Error(w, "tree not tracked", http.StatusNotFound)
+			return
+		}
+	case r.FormValue("lto") != "":
+		b = &m.lto
+	default:
+		b = &m.global
+	}
+
+	log.Printf("Changing %s VSZ limit from %s to %s", b.name, formatSize(b.limit), formatSize(limit))
+	b.limit = limit
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *monitor) handleOverride(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if reason := mayControl(r); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		http.Error(w, "invalid pid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var action string
+	switch r.FormValue("action") {
+	case overrideRun, overrideStop:
+		action = r.FormValue("action")
+	case "clear":
+	default:
+		http.Error(w, "action must be run, stop or clear", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.setOverride(pid, action); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *monitor) handleAttach(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		http.Error(w, "invalid pid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := uint64(unlimited)
+	if v := r.FormValue("vsz-limit-mb"); v != "" {
+		if limit, err = parseSize(v); err != nil {
+			http.Error(w, "invalid vsz-limit-mb: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	stats, err := getProcStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stat, ok := stats[pid]
+	if !ok || ignored(stat) {
+		http.Error(w, "process not found", http.StatusNotFound)
+		return
+	}
+	if reason := mayAttach(r, pid); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inTrees(stats, stat) {
+		http.Error(w, "already tracked", http.StatusConflict)
+		return
+	}
+	if err := m.attachTree(stat, limit, "control API"); err == errLocked {
+		http.Error(w, "managed by another memlimit instance", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
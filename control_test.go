@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSocketMode(t *testing.T) {
+	// Even with a umask letting everyone in.
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	path := filepath.Join(t.TempDir(), "memlimit.sock")
+	l, err := listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Errorf("socket mode %v, want -rw-------", got)
+	}
+}
+
+// TestLimitPeerCred checks that over a unix socket, only our user and root
+// may change limits.
+func TestLimitPeerCred(t *testing.T) {
+	m, _ := newTestMonitor(1<<30, isCompiler)
+	other := uint32(os.Geteuid() + 1)
+	for _, tc := range []struct {
+		cred *syscall.Ucred
+		want int
+	}{
+		{nil, http.StatusForbidden},
+		{&syscall.Ucred{Uid: other}, http.StatusForbidden},
+		{&syscall.Ucred{Uid: uint32(os.Geteuid())}, http.StatusNoContent},
+		{&syscall.Ucred{Uid: 0}, http.StatusNoContent},
+	} {
+		m.global.limit = 1 << 30
+		r := httptest.NewRequest(http.MethodPost, "/limit", strings.NewReader("vsz-limit-mb=2G"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), peerCredKey{}, tc.cred))
+		w := httptest.NewRecorder()
+		m.handleLimit(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%+v: got %d, want %d", tc.cred, w.Code, tc.want)
+		}
+		if changed := m.global.limit != 1<<30; changed != (tc.want == http.StatusNoContent) {
+			t.Errorf("%+v: limit %s after %d", tc.cred, formatSize(m.global.limit), w.Code)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Number of scans kept for the memory graphs of the dashboard.
+const historyLen = 900
+
+// sample is the memory and process counts of one scan.
+type sample struct {
+	Time     time.Time `json:"time"`
+	Vsz      uint64    `json:"vsz"`
+	Rss      uint64    `json:"rss"`
+	Swap     uint64    `json:"swap"`
+	LTOVsz   uint64    `json:"lto_vsz"`
+	VszLimit uint64    `json:"vsz_limit"`
+	Running  int       `json:"running"`
+	Stopped  int       `json:"stopped"`
+}
+
+// recordHistory adds the status of the scan that just finished to the
+// history.
+func (m *monitor) recordHistory(st status) {
+	if len(m.history) == historyLen {
+		m.history = append(m.history[:0], m.history[1:]...)
+	}
+	m.history = append(m.history, sample{Time: m.now, Vsz: st.Vsz, Rss: st.Rss, Swap: st.Swap, LTOVsz: st.LTOVsz, VszLimit: st.VszLimit, Running: st.Running, Stopped: st.Stopped})
+}
+
+// treeNode is a process of a tracked tree as of the last scan.
+type treeNode struct {
+	PID   int    `json:"pid"`
+	Comm  string `json:"comm"`
+	State string `json:"state"`
+	Vsz   uint64 `json:"vsz"`
+	Rss   uint64 `json:"rss"`
+	// Whether the process is filtered, an LTO link, held throttled by us,
+	// or left unmanaged.
+	Filtered  bool       `json:"filtered,omitempty"`
+	LTO       bool       `json:"lto,omitempty"`
+	Throttled bool       `json:"throttled,omitempty"`
+	Unmanaged bool       `json:"unmanaged,omitempty"`
+	Job       string     `json:"job,omitempty"`
+	Children  []treeNode `json:"children,omitempty"`
+}
+
+// processTree returns the tracked trees as of the last scan.
+func (m *monitor) processTree() []treeNode {
+	tracked := make(map[int]tracked, len(m.procs))
+	for _, p := range m.procs {
+		tracked[p.stat.PID] = p
+	}
+	var node func(pid int) (treeNode, bool)
+	node = func(pid int) (treeNode, bool) {
+		stat, ok := m.lastStats[pid]
+		if !ok {
+			return treeNode{}, false
+		}
+		n := treeNode{PID: pid, Comm: stat.Comm, State: stat.State, Vsz: stat.VirtualMemory(), Rss: stat.ResidentMemory()}
+		if p, ok := tracked[pid]; ok {
+			job, _ := m.jobs.get(stat)
+			n.Filtered, n.LTO, n.Job = true, p.isLTO, job.String()
+			n.Throttled = m.thr.throttled(stat)
+			n.Unmanaged = m.unmanaged.has(stat)
+		}
+		for _, child := range m.lastPmap[pid] {
+			if c, ok := node(child); ok {
+				n.Children = append(n.Children, c)
+			}
+		}
+		return n, true
+	}
+	var roots []treeNode
+	for _, t := range m.trees {
+		if n, ok := node(t.pid); ok {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+func (m *monitor) handleHistory(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	history := append([]sample(nil), m.history...)
+	m.mu.Unlock()
+
+	writeJSON(w, history)
+}
+
+func (m *monitor) handleTree(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	roots := m.processTree()
+	m.mu.Unlock()
+
+	writeJSON(w, roots)
+}
+
+// handleDashboard serves the web dashboard, a single page that polls the
+// control API.
+func (m *monitor) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboardHTML)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>memlimit</title>
+<style>
+body { font: 13px monospace; margin: 1em; color: #222; }
+h2 { font-size: 14px; margin: 1.2em 0 0.4em; }
+canvas { border: 1px solid #ccc; width: 100%; height: 220px; }
+#summary span { margin-right: 1.5em; }
+ul { list-style: none; padding-left: 1.5em; margin: 0; }
+#tree > ul { padding-left: 0; }
+.unfiltered { color: #888; }
+.throttled { color: #c00; font-weight: bold; }
+.unmanaged { color: #a60; }
+table { border-collapse: collapse; }
+td { padding: 1px 8px 1px 0; vertical-align: top; }
+.legend span { margin-right: 1.5em; }
+</style>
+</head>
+<body>
+<div id="summary">loading...</div>
+<h2>Memory</h2>
+<div class="legend"><span style="color:#c00">limit</span><span style="color:#06c">VSZ</span><span style="color:#393">RSS</span><span style="color:#c80">stopped</span></div>
+<canvas id="graph" width="1200" height="220"></canvas>
+<h2>Processes</h2>
+<div id="tree"></div>
+<h2>Events</h2>
+<table id="events"></table>
+<script>
+"use strict";
+function size(b) {
+	var units = ["B", "K", "M", "G", "T"], i = 0;
+	while (b >= 1024 && i < units.length - 1) { b /= 1024; i++; }
+	return (i ? b.toFixed(1) : b) + units[i];
+}
+function el(tag, cls, text) {
+	var e = document.createElement(tag);
+	if (cls) e.className = cls;
+	if (text !== undefined) e.textContent = text;
+	return e;
+}
+function get(path) {
+	return fetch(path).then(function (r) { return r.json(); });
+}
+function drawGraph(history) {
+	var c = document.getElementById("graph"), g = c.getContext("2d");
+	g.clearRect(0, 0, c.width, c.height);
+	if (history.length < 2) return;
+	var max = 1, maxStopped = 1;
+	history.forEach(function (s) {
+		max = Math.max(max, s.vsz, s.rss, s.vsz_limit < 1e18 ? s.vsz_limit : 0);
+		maxStopped = Math.max(maxStopped, s.stopped);
+	});
+	var x = function (i) { return i * c.width / (history.length - 1); };
+	var y = function (v) { return c.height - 4 - v * (c.height - 8) / max; };
+	g.fillStyle = "rgba(204,136,0,0.25)";
+	history.forEach(function (s, i) {
+		var h = s.stopped * (c.height / 3) / maxStopped;
+		g.fillRect(x(i), c.height - h, Math.max(1, c.width / history.length), h);
+	});
+	[["vsz_limit", "#c00"], ["vsz", "#06c"], ["rss", "#393"]].forEach(function (line) {
+		g.strokeStyle = line[1];
+		g.beginPath();
+		history.forEach(function (s, i) {
+			var v = s[line[0]];
+			if (v > 1e18) v = max;
+			if (i) g.lineTo(x(i), y(v)); else g.moveTo(x(i), y(v));
+		});
+		g.stroke();
+	});
+	g.fillStyle = "#222";
+	g.fillText(size(max), 4, 12);
+}
+function drawTree(roots) {
+	var render = function (nodes) {
+		var ul = el("ul");
+		nodes.forEach(function (n) {
+			var cls = n.throttled ? "throttled" : n.unmanaged ? "unmanaged" : n.filtered ? "" : "unfiltered";
+			var text = n.pid + " " + n.state + (n.throttled ? "*" : "") + " " + size(n.vsz) + " " + size(n.rss) + " " + n.comm;
+			if (n.lto) text += " (LTO)";
+			if (n.job) text += " " + n.job;
+			var li = el("li", cls, text);
+			if (n.children) li.appendChild(render(n.children));
+			ul.appendChild(li);
+		});
+		return ul;
+	};
+	var tree = document.getElementById("tree");
+	tree.replaceChildren(render(roots || []));
+}
+function drawEvents(events) {
+	var table = document.getElementById("events");
+	table.replaceChildren();
+	events.slice(-200).reverse().forEach(function (e) {
+		var tr = el("tr");
+		tr.appendChild(el("td", "", new Date(e.time).toLocaleTimeString()));
+		tr.appendChild(el("td", "", e.type));
+		tr.appendChild(el("td", "", e.pid ? e.pid + " " + e.comm : ""));
+		tr.appendChild(el("td", "", e.reason));
+		table.appendChild(tr);
+	});
+}
+function drawSummary(st) {
+	var s = document.getElementById("summary");
+	s.replaceChildren();
+	var limit = st.vsz_limit > 1e18 ? "unlimited" : size(st.vsz_limit);
+	["VSZ " + size(st.vsz) + " of " + limit, "RSS " + size(st.rss), "swap " + size(st.swap),
+	 "running " + st.running, "stopped " + st.stopped, "unfiltered " + st.unfiltered, "killed " + st.killed
+	].forEach(function (t) { s.appendChild(el("span", "", t)); });
+	if (st.phase) s.appendChild(el("span", "", "phase " + st.phase));
+}
+function refresh() {
+	Promise.all([get("status"), get("history"), get("tree"), get("events")]).then(function (r) {
+		drawSummary(r[0]);
+		drawGraph(r[1] || []);
+		drawTree(r[2]);
+		drawEvents(r[3] || []);
+	}).catch(function (err) {
+		document.getElementById("summary").textContent = "Error: " + err;
+	}).finally(function () {
+		setTimeout(refresh, 2000);
+	});
+}
+refresh();
+</script>
+</body>
+</html>
+`
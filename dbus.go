@@ -0,0 +1,493 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough of the D-Bus protocol for -notify and -dbus: unix sockets,
+// EXTERNAL authentication, and the few types the calls they make and serve
+// take.
+
+// D-Bus message types and header fields.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusPath         = 1
+	dbusInterface    = 2
+	dbusMember       = 3
+	dbusErrorName    = 4
+	dbusReplySerial  = 5
+	dbusDestination  = 6
+	dbusSender       = 7
+	dbusSignatureFld = 8
+)
+
+// Set on messages that aren't replied to.
+const dbusNoReplyExpected = 1
+
+// sessionBus returns the address of the unix socket of the session D-Bus.
+// Abstract socket names start with @.
+func sessionBus() (string, error) {
+	addrs := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if addrs == "" {
+		path := fmt.Sprintf("/run/user/%d/bus", os.Getuid())
+		if _, err := os.Stat(path); err != nil {
+			return "", errors.New("no DBUS_SESSION_BUS_ADDRESS")
+		}
+		return path, nil
+	}
+	return unixBusAddress("DBUS_SESSION_BUS_ADDRESS", addrs)
+}
+
+// systemBus returns the address of the unix socket of the system D-Bus.
+func systemBus() (string, error) {
+	if addrs := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); addrs != "" {
+		return unixBusAddress("DBUS_SYSTEM_BUS_ADDRESS", addrs)
+	}
+	return "/run/dbus/system_bus_socket", nil
+}
+
+// unixBusAddress returns the first unix socket of the D-Bus addresses addrs,
+// read from the environment variable name.
+func unixBusAddress(name, addrs string) (string, error) {
+	for _, addr := range strings.Split(addrs, ";") {
+		transport, params, _ := strings.Cut(addr, ":")
+		if transport != "unix" {
+			continue
+		}
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			switch key {
+			case "path":
+				return value, nil
+			case "abstract":
+				return "@" + value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no unix socket in %s %q", name, addrs)
+}
+
+// dbusConn is a connection to a bus.
+type dbusConn struct {
+	net.Conn
+	r *bufio.Reader
+	// The unique name the bus gave us, and the serial of the last message
+	// sent.
+	name   string
+	serial uint32
+}
+
+// dialDBus connects to the bus at addr, authenticating and saying Hello
+// within timeout.
+func dialDBus(addr string, timeout time.Duration) (*dbusConn, error) {
+	conn, err := net.DialTimeout("unix", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{Conn: conn, r: bufio.NewReader(conn)}
+	if err := c.hello(timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *dbusConn) hello(timeout time.Duration) error {
+	c.SetDeadline(time.Now().Add(timeout))
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("authentication rejected: %s", strings.TrimSpace(line))
+	}
+	if _, err := fmt.Fprint(c, "BEGIN\r\n"); err != nil {
+		return err
+	}
+
+	// Every connection has to say Hello before anything else.
+	reply, err := c.call(&dbusMessage{}, "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "org.freedesktop.DBus", "")
+	if err != nil {
+		return err
+	}
+	c.name, err = reply.decoder().str()
+	return err
+}
+
+// call calls a method with the body of msg, and waits for its reply,
+// skipping other messages meanwhile.
+func (c *dbusConn) call(msg *dbusMessage, path, iface, member, dest, signature string) (*dbusReceived, error) {
+	c.serial++
+	serial := c.serial
+	msg.header(serial, path, iface, member, dest, signature)
+	if _, err := c.Write(msg.bytes()); err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := readDBusMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if reply.replyTo != serial {
+			continue
+		}
+		if reply.typ == dbusError {
+			return nil, reply.err()
+		}
+		return reply, nil
+	}
+}
+
+// reply sends msg as the reply to call, unless call asked for none.
+func (c *dbusConn) reply(call *dbusReceived, msg *dbusMessage, signature string) error {
+	if call.flags&dbusNoReplyExpected != 0 {
+		return nil
+	}
+	c.serial++
+	msg.reply(c.serial, call, signature)
+	_, err := c.Write(msg.bytes())
+	return err
+}
+
+// replyError sends the error name, with message, as the reply to call,
+// unless call asked for none.
+func (c *dbusConn) replyError(call *dbusReceived, name, message string) error {
+	if call.flags&dbusNoReplyExpected != 0 {
+		return nil
+	}
+	var msg dbusMessage
+	msg.body.str(message)
+	c.serial++
+	msg.error(c.serial, call, name)
+	_, err := c.Write(msg.bytes())
+	return err
+}
+
+// dbusBuffer marshals D-Bus values, little-endian. Offsets are aligned from
+// the start of the buffer, which is where the header and body both start.
+type dbusBuffer struct {
+	b []byte
+}
+
+func (d *dbusBuffer) align(n int) {
+	for len(d.b)%n != 0 {
+		d.b = append(d.b, 0)
+	}
+}
+
+func (d *dbusBuffer) uint32(v uint32) {
+	d.align(4)
+	d.b = binary.LittleEndian.AppendUint32(d.b, v)
+}
+
+func (d *dbusBuffer) int32(v int32) {
+	d.uint32(uint32(v))
+}
+
+func (d *dbusBuffer) uint64(v uint64) {
+	d.align(8)
+	d.b = binary.LittleEndian.AppendUint64(d.b, v)
+}
+
+func (d *dbusBuffer) boolean(v bool) {
+	if v {
+		d.uint32(1)
+	} else {
+		d.uint32(0)
+	}
+}
+
+func (d *dbusBuffer) str(s string) {
+	d.uint32(uint32(len(s)))
+	d.b = append(append(d.b, s...), 0)
+}
+
+func (d *dbusBuffer) sig(s string) {
+	d.b = append(append(append(d.b, byte(len(s))), s...), 0)
+}
+
+// variant marshals v, a uint64, uint32, bool or string, as a variant.
+func (d *dbusBuffer) variant(v interface{}) {
+	switch v := v.(type) {
+	case uint64:
+		d.sig("t")
+		d.uint64(v)
+	case uint32:
+		d.sig("u")
+		d.uint32(v)
+	case bool:
+		d.sig("b")
+		d.boolean(v)
+	case string:
+		d.sig("s")
+		d.str(v)
+	default:
+		panic(fmt.Sprintf("no D-Bus type for %T", v))
+	}
+}
+
+// array marshals an array of elements aligned to align, each marshalled by
+// elem.
+func (d *dbusBuffer) array(align, n int, elem func(i int)) {
+	d.align(4)
+	lenAt := len(d.b)
+	d.uint32(0)
+	d.align(align)
+	start := len(d.b)
+	for i := 0; i < n; i++ {
+		elem(i)
+	}
+	binary.LittleEndian.PutUint32(d.b[lenAt:], uint32(len(d.b)-start))
+}
+
+// dbusMessage is a message being marshalled.
+type dbusMessage struct {
+	head, body dbusBuffer
+}
+
+// dbusField is a header field, with a string or uint32 value.
+type dbusField struct {
+	code byte
+	typ  string
+	str  string
+	u    uint32
+}
+
+// marshalHeader marshals the header of a message, once the body is done.
+func (msg *dbusMessage) marshalHeader(typ, flags byte, serial uint32, fields []dbusField) {
+	h := &msg.head
+	h.b = append(h.b[:0], 'l', typ, flags, 1)
+	h.uint32(uint32(len(msg.body.b)))
+	h.uint32(serial)
+	fieldsLen := len(h.b)
+	h.uint32(0)
+	for _, f := range fields {
+		h.align(8)
+		h.b = append(h.b, f.code)
+		h.sig(f.typ)
+		switch f.typ {
+		case "g":
+			h.sig(f.str)
+		case "u":
+			h.uint32(f.u)
+		default:
+			h.str(f.str)
+		}
+	}
+	binary.LittleEndian.PutUint32(h.b[fieldsLen:], uint32(len(h.b)-fieldsLen-4))
+	h.align(8)
+}
+
+// header marshals the header of a method call, once the body is done.
+func (msg *dbusMessage) header(serial uint32, path, iface, member, dest, signature string) {
+	fields := []dbusField{
+		{code: dbusPath, typ: "o", str: path},
+		{code: dbusInterface, typ: "s", str: iface},
+		{code: dbusMember, typ: "s", str: member},
+		{code: dbusDestination, typ: "s", str: dest},
+	}
+	if signature != "" {
+		fields = append(fields, dbusField{code: dbusSignatureFld, typ: "g", str: signature})
+	}
+	msg.marshalHeader(dbusMethodCall, 0, serial, fields)
+}
+
+// reply marshals the header of the method return to call. Fields are in the
+// order libdbus puts them in.
+func (msg *dbusMessage) reply(serial uint32, call *dbusReceived, signature string) {
+	fields := []dbusField{
+		{code: dbusDestination, typ: "s", str: call.sender},
+		{code: dbusReplySerial, typ: "u", u: call.serial},
+	}
+	if signature != "" {
+		fields = append(fields, dbusField{code: dbusSignatureFld, typ: "g", str: signature})
+	}
+	msg.marshalHeader(dbusMethodReturn, dbusNoReplyExpected, serial, fields)
+}
+
+// error marshals the header of the error name in reply to call, with a
+// message as its body.
+func (msg *dbusMessage) error(serial uint32, call *dbusReceived, name string) {
+	msg.marshalHeader(dbusError, dbusNoReplyExpected, serial, []dbusField{
+		{code: dbusDestination, typ: "s", str: call.sender},
+		{code: dbusErrorName, typ: "s", str: name},
+		{code: dbusReplySerial, typ: "u", u: call.serial},
+		{code: dbusSignatureFld, typ: "g", str: "s"},
+	})
+}
+
+func (msg *dbusMessage) bytes() []byte {
+	return append(append([]byte(nil), msg.head.b...), msg.body.b...)
+}
+
+// dbusReceived is a message read from the bus.
+type dbusReceived struct {
+	order  binary.ByteOrder
+	typ    byte
+	flags  byte
+	serial uint32
+	// Header fields, empty if not given.
+	replyTo                                         uint32
+	path, iface, member, errName, sender, signature string
+	body                                            []byte
+}
+
+// err returns the error of an error message.
+func (msg *dbusReceived) err() error {
+	text := "unknown error"
+	if msg.signature != "" && msg.signature[0] == 's' {
+		if s, err := msg.decoder().str(); err == nil {
+			text = s
+		}
+	}
+	return fmt.Errorf("%s: %s", msg.errName, text)
+}
+
+// decoder returns a decoder of the body of msg.
+func (msg *dbusReceived) decoder() *dbusDecoder {
+	return &dbusDecoder{b: msg.body, order: msg.order}
+}
+
+// dbusDecoder unmarshals the values of a body in turn. The body starts
+// 8-aligned in the message, so offsets in it are aligned as they are.
+type dbusDecoder struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+}
+
+func (d *dbusDecoder) uint32() (uint32, error) {
+	d.off += (4 - d.off%4) % 4
+	if d.off+4 > len(d.b) {
+		return 0, errors.New("D-Bus message body too short")
+	}
+	v := d.order.Uint32(d.b[d.off:])
+	d.off += 4
+	return v, nil
+}
+
+func (d *dbusDecoder) str() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if d.off+int(n)+1 > len(d.b) {
+		return "", errors.New("D-Bus message body too short")
+	}
+	s := string(d.b[d.off : d.off+int(n)])
+	d.off += int(n) + 1
+	return s, nil
+}
+
+// readDBusMessage reads a message.
+func readDBusMessage(r *bufio.Reader) (*dbusReceived, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	msg := &dbusReceived{order: binary.LittleEndian, typ: fixed[1], flags: fixed[2]}
+	if fixed[0] == 'B' {
+		msg.order = binary.BigEndian
+	}
+	bodyLen := msg.order.Uint32(fixed[4:])
+	msg.serial = msg.order.Uint32(fixed[8:])
+	fieldsLen := msg.order.Uint32(fixed[12:])
+	if bodyLen > 1<<20 || fieldsLen > 1<<16 {
+		return nil, errors.New("D-Bus message too large")
+	}
+	// The fields are padded to 8 bytes from the start of the message.
+	rest := make([]byte, (fieldsLen+7)&^7+bodyLen)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	fields := rest[:fieldsLen]
+	msg.body = rest[len(rest)-int(bodyLen):]
+
+	// Offsets in fields are from the start of the message, 16 bytes
+	// before it.
+	for off := 0; off < len(fields); {
+		off += (8 - (16+off)%8) % 8
+		if off+3 > len(fields) {
+			break
+		}
+		code, sigLen := fields[off], int(fields[off+1])
+		off += 2
+		if off+sigLen+1 > len(fields) {
+			break
+		}
+		sig := string(fields[off : off+sigLen])
+		off += sigLen + 1
+		var value string
+		switch sig {
+		case "u":
+			off += (4 - (16+off)%4) % 4
+			if off+4 > len(fields) {
+				return msg, nil
+			}
+			if code == dbusReplySerial {
+				msg.replyTo = msg.order.Uint32(fields[off:])
+			}
+			off += 4
+			continue
+		case "s", "o":
+			off += (4 - (16+off)%4) % 4
+			if off+4 > len(fields) {
+				return msg, nil
+			}
+			n := int(msg.order.Uint32(fields[off:]))
+			off += 4
+			if off+n+1 > len(fields) {
+				return msg, nil
+			}
+			value = string(fields[off : off+n])
+			off += n + 1
+		case "g":
+			if off >= len(fields) {
+				return msg, nil
+			}
+			n := int(fields[off])
+			if off+n+2 > len(fields) {
+				return msg, nil
+			}
+			value = string(fields[off+1 : off+1+n])
+			off += n + 2
+		default:
+			// Not a field we need, and we can't tell its length.
+			return msg, nil
+		}
+		switch code {
+		case dbusPath:
+			msg.path = value
+		case dbusInterface:
+			msg.iface = value
+		case dbusMember:
+			msg.member = value
+		case dbusErrorName:
+			msg.errName = value
+		case dbusSender:
+			msg.sender = value
+		case dbusSignatureFld:
+			msg.signature = value
+		}
+	}
+	return msg, nil
+}
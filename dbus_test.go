@@ -0,0 +1,173 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Messages captured from libdbus (dbus-send) and dbus-daemon.
+const (
+	// dbus-send --dest=org.freedesktop.DBus /org/freedesktop/DBus
+	// org.freedesktop.DBus.Hello
+	libdbusHello = "6c01000100000000020000006d00000001016f00150000002f6f72672f667265656465736b746f702f4442757300000002017300140000006f72672e667265656465736b746f702e4442757300000000030173000500000048656c6c6f00000006017300140000006f72672e667265656465736b746f702e4442757300000000"
+	// dbus-send --dest=org.freedesktop.Notifications
+	// /org/freedesktop/Notifications org.freedesktop.Notifications.Notify
+	// string:memlimit uint32:0 string: string:sum string:body array:string:
+	// dict:string:byte:urgency,1 int32:-1
+	libdbusNotify = "6c0100014c000000020000009b00000001016f001e0000002f6f72672f667265656465736b746f702f4e6f74696669636174696f6e730000020173001d0000006f72672e667265656465736b746f702e4e6f74696669636174696f6e7300000003017300060000004e6f746966790000060173001d0000006f72672e667265656465736b746f702e4e6f74696669636174696f6e73000000080167000d73757373736173617b73797d69000000000000080000006d656d6c696d6974000000000000000000000000000000000300000073756d0004000000626f647900000000000000000d00000007000000757267656e63790001000000ffffffff"
+	// The reply of dbus-daemon to Hello, serial 1.
+	daemonHelloReply = "6c02010109000000010000003d00000006017300040000003a312e30000000000501750001000000080167000173000007017300140000006f72672e667265656465736b746f702e4442757300000000040000003a312e3000"
+	// Properties.Get("org.memlimit.Monitor", "Vsz") from dbus-send, as
+	// dbus-daemon forwards it to :1.0.
+	daemonGetCall = "6c01000124000000020000007d00000001016f00150000002f6f72672f6d656d6c696d69742f4d6f6e69746f72000000020173001f0000006f72672e667265656465736b746f702e444275732e50726f70657274696573000301730003000000476574000000000006017300040000003a312e3000000000080167000273730007017300040000003a312e3100000000140000006f72672e6d656d6c696d69742e4d6f6e69746f72000000000300000056737a00"
+	// The empty reply of dbus-test-tool echo to serial 5 from :1.7.
+	libdbusReturn = "6c02010100000000020000001800000006017300040000003a312e37000000000501750005000000"
+	// The error dbus-daemon replies with to an unknown method, serial 2.
+	daemonUnknownMethod = "6c0301013b000000030000007500000006017300040000003a312e300000000004017300280000006f72672e667265656465736b746f702e444275732e4572726f722e556e6b6e6f776e4d6574686f6400000000000000000501750002000000080167000173000007017300140000006f72672e667265656465736b746f702e4442757300000000360000006f72672e667265656465736b746f702e4442757320646f6573206e6f7420756e6465727374616e64206d6573736167652048756c6c6f00"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDBusMethodCall(t *testing.T) {
+	var hello dbusMessage
+	hello.header(2, "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "org.freedesktop.DBus", "")
+	if got, want := hello.bytes(), unhex(t, libdbusHello); !bytes.Equal(got, want) {
+		t.Errorf("Hello:\n got %x\nwant %x", got, want)
+	}
+
+	var call dbusMessage
+	call.body.str("memlimit")
+	call.body.uint32(0)
+	call.body.str("")
+	call.body.str("sum")
+	call.body.str("body")
+	call.body.uint32(0)
+	// {"urgency": byte 1}
+	call.body.array(8, 1, func(int) {
+		call.body.str("urgency")
+		call.body.b = append(call.body.b, 1)
+	})
+	call.body.int32(-1)
+	call.header(2, "/org/freedesktop/Notifications", "org.freedesktop.Notifications", "Notify", "org.freedesktop.Notifications", "susssasa{sy}i")
+	if got, want := call.bytes(), unhex(t, libdbusNotify); !bytes.Equal(got, want) {
+		t.Errorf("Notify:\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestDBusReply(t *testing.T) {
+	call := &dbusReceived{serial: 5, sender: ":1.7"}
+	var reply dbusMessage
+	reply.reply(2, call, "")
+	if got, want := reply.bytes(), unhex(t, libdbusReturn); !bytes.Equal(got, want) {
+		t.Errorf("method return:\n got %x\nwant %x", got, want)
+	}
+
+	// Laid out by hand, in the order libdbus puts the fields in.
+	var e dbusMessage
+	e.body.str("No method Bogus")
+	e.error(2, call, "org.freedesktop.DBus.Error.UnknownMethod")
+	want := unhex(t, "6c03010114000000020000005700000006017300040000003a312e370000000004017300280000006f72672e667265656465736b746f702e444275732e4572726f722e556e6b6e6f776e4d6574686f640000000000000000050175000500000008016700017300000f0000004e6f206d6574686f6420426f67757300")
+	if got := e.bytes(); !bytes.Equal(got, want) {
+		t.Errorf("error:\n got %x\nwant %x", got, want)
+	}
+}
+
+func TestDBusValues(t *testing.T) {
+	for _, test := range []struct {
+		v    interface{}
+		want string
+	}{
+		// Each after a byte, to show the alignment.
+		{uint64(1 << 40), "00017400000000000000000000010000"},
+		{uint32(7), "0001750007000000"},
+		{true, "0001620001000000"},
+		{"hi", "0001730002000000686900"},
+	} {
+		d := dbusBuffer{b: []byte{0}}
+		d.variant(test.v)
+		if got := hex.EncodeToString(d.b); got != test.want {
+			t.Errorf("variant %T %v: got %s, want %s", test.v, test.v, got, test.want)
+		}
+	}
+}
+
+func TestReadDBusMessage(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		msg  string
+		want dbusReceived
+	}{
+		{"method call", daemonGetCall, dbusReceived{typ: dbusMethodCall, serial: 2, path: "/org/memlimit/Monitor", iface: "org.freedesktop.DBus.Properties", member: "Get", sender: ":1.1", signature: "ss"}},
+		{"method return", daemonHelloReply, dbusReceived{typ: dbusMethodReturn, flags: dbusNoReplyExpected, serial: 1, replyTo: 1, sender: "org.freedesktop.DBus", signature: "s"}},
+		{"error", daemonUnknownMethod, dbusReceived{typ: dbusError, flags: dbusNoReplyExpected, serial: 3, replyTo: 2, errName: "org.freedesktop.DBus.Error.UnknownMethod", sender: "org.freedesktop.DBus", signature: "s"}},
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(unhex(t, test.msg), unhex(t, libdbusHello)...)))
+		msg, err := readDBusMessage(r)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := *msg
+		got.order, got.body = nil, nil
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+		// The message is consumed exactly, leaving the next one.
+		if next, err := readDBusMessage(r); err != nil || next.member != "Hello" {
+			t.Errorf("%s: next message: %+v, %v", test.name, next, err)
+		}
+	}
+}
+
+func TestDBusDecoder(t *testing.T) {
+	msg, err := readDBusMessage(bufio.NewReader(bytes.NewReader(unhex(t, daemonGetCall))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := msg.decoder()
+	iface, err1 := d.str()
+	name, err2 := d.str()
+	if iface != "org.memlimit.Monitor" || name != "Vsz" || err1 != nil || err2 != nil {
+		t.Errorf("got %q, %q, %v, %v", iface, name, err1, err2)
+	}
+	if _, err := d.str(); err == nil {
+		t.Error("read past the end of the body")
+	}
+
+	msg, err = readDBusMessage(bufio.NewReader(bytes.NewReader(unhex(t, daemonUnknownMethod))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := msg.err().Error(), "org.freedesktop.DBus.Error.UnknownMethod: org.freedesktop.DBus does not understand message Hullo"; got != want {
+		t.Errorf("got error %q, want %q", got, want)
+	}
+}
+
+func TestReadDBusMessageTruncated(t *testing.T) {
+	msg := unhex(t, daemonHelloReply)
+	for _, n := range []int{0, 10, 16, len(msg) - 1} {
+		if _, err := readDBusMessage(bufio.NewReader(bytes.NewReader(msg[:n]))); err == nil {
+			t.Errorf("%d of %d bytes: no error", n, len(msg))
+		}
+	}
+}
+
+func TestReadDBusMessageFieldsEndInSignature(t *testing.T) {
+	// A signature field whose value is cut off by the end of the fields.
+	msg := unhex(t, "6c010001000000000100000004000000"+"0801670000000000")
+	if _, err := readDBusMessage(bufio.NewReader(bytes.NewReader(msg))); err != nil {
+		t.Fatal(err)
+	}
+}
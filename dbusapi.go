@@ -0,0 +1,229 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Name, object path and interface of the -dbus API.
+const (
+	dbusAPIName = "org.memlimit.Monitor"
+	dbusAPIPath = "/org/memlimit/Monitor"
+)
+
+// How long connecting to the bus may take, and how long to wait before
+// connecting again once the connection is lost.
+const (
+	dbusTimeout = 5 * time.Second
+	dbusRetry   = 10 * time.Second
+)
+
+// Properties of org.memlimit.Monitor, from the last scan, in order:
+//
+//	Vsz, Rss, Swap   (t) memory of the filtered processes, in bytes
+//	VszLimit         (t) the overall limit, 2^64-1 if none
+//	Running, Stopped (u) filtered processes let run and held throttled
+//	Paused           (b) whether enforcement is paused
+var dbusProperties = []string{"Vsz", "Rss", "Swap", "VszLimit", "Running", "Stopped", "Paused"}
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+ <interface name="org.memlimit.Monitor">
+  <method name="Pause"/>
+  <method name="Resume"/>
+  <property name="Vsz" type="t" access="read"/>
+  <property name="Rss" type="t" access="read"/>
+  <property name="Swap" type="t" access="read"/>
+  <property name="VszLimit" type="t" access="read"/>
+  <property name="Running" type="u" access="read"/>
+  <property name="Stopped" type="u" access="read"/>
+  <property name="Paused" type="b" access="read"/>
+  <annotation name="org.freedesktop.DBus.Property.EmitsChangedSignal" value="false"/>
+ </interface>
+ <interface name="org.freedesktop.DBus.Properties">
+  <method name="Get">
+   <arg name="interface" direction="in" type="s"/>
+   <arg name="property" direction="in" type="s"/>
+   <arg name="value" direction="out" type="v"/>
+  </method>
+  <method name="GetAll">
+   <arg name="interface" direction="in" type="s"/>
+   <arg name="properties" direction="out" type="a{sv}"/>
+  </method>
+ </interface>
+ <interface name="org.freedesktop.DBus.Introspectable">
+  <method name="Introspect">
+   <arg name="data" direction="out" type="s"/>
+  </method>
+ </interface>
+ <interface name="org.freedesktop.DBus.Peer">
+  <method name="Ping"/>
+ </interface>
+</node>
+`
+
+// serveDBus exports org.memlimit.Monitor on bus, session or system,
+// connecting again whenever the connection is lost.
+func (m *monitor) serveDBus(bus string) {
+	// Only log changes, not every attempt while the bus is down.
+	failing := false
+	for {
+		addr, err := sessionBus()
+		if bus == "system" {
+			addr, err = systemBus()
+		}
+		if err == nil {
+			err = m.exportDBus(addr, func() {
+				if failing {
+					log.Printf("Exporting %s on the %s bus again", dbusAPIName, bus)
+				}
+				failing = false
+			})
+		}
+		if !failing {
+			log.Printf("Error exporting %s on the %s bus: %v", dbusAPIName, bus, err)
+		}
+		failing = true
+		time.Sleep(dbusRetry)
+	}
+}
+
+// exportDBus owns dbusAPIName on the bus at addr and serves calls to it
+// until the connection fails, calling exported once it owns the name.
+func (m *monitor) exportDBus(addr string, exported func()) error {
+	c, err := dialDBus(addr, dbusTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Fail rather than queue if another instance owns the name.
+	var req dbusMessage
+	req.body.str(dbusAPIName)
+	req.body.uint32(4) // DBUS_NAME_FLAG_DO_NOT_QUEUE
+	c.SetDeadline(time.Now().Add(dbusTimeout))
+	reply, err := c.call(&req, "/org/freedesktop/DBus", "org.freedesktop.DBus", "RequestName", "org.freedesktop.DBus", "su")
+	if err != nil {
+		return err
+	}
+	if code, err := reply.decoder().uint32(); err != nil {
+		return err
+	} else if code != 1 && code != 4 {
+		// Neither the primary owner now nor already.
+		return fmt.Errorf("%s is owned by another connection", dbusAPIName)
+	}
+	c.SetDeadline(time.Time{})
+	exported()
+
+	for {
+		call, err := readDBusMessage(c.r)
+		if err != nil {
+			return err
+		}
+		if call.typ != dbusMethodCall {
+			continue
+		}
+		if err := m.handleDBusCall(c, call); err != nil {
+			return err
+		}
+	}
+}
+
+// handleDBusCall replies to a method call.
+func (m *monitor) handleDBusCall(c *dbusConn, call *dbusReceived) error {
+	if call.path != dbusAPIPath {
+		return c.replyError(call, "org.freedesktop.DBus.Error.UnknownObject", fmt.Sprintf("No object at %s", call.path))
+	}
+	var reply dbusMessage
+	switch call.iface + "." + call.member {
+	case "org.freedesktop.DBus.Peer.Ping", ".Ping":
+		return c.reply(call, &reply, "")
+	case "org.freedesktop.DBus.Introspectable.Introspect", ".Introspect":
+		reply.body.str(dbusIntrospection)
+		return c.reply(call, &reply, "s")
+	case dbusAPIName + ".Pause", ".Pause":
+		m.pauseEnforcement(true, call.sender)
+		return c.reply(call, &reply, "")
+	case dbusAPIName + ".Resume", ".Resume":
+		m.pauseEnforcement(false, call.sender)
+		return c.reply(call, &reply, "")
+	case "org.freedesktop.DBus.Properties.Get":
+		d := call.decoder()
+		iface, err := d.str()
+		if err != nil || call.signature != "ss" {
+			return c.replyError(call, "org.freedesktop.DBus.Error.InvalidArgs", "Get takes an interface and a property name")
+		}
+		name, _ := d.str()
+		if iface != dbusAPIName && iface != "" {
+			return c.replyError(call, "org.freedesktop.DBus.Error.UnknownInterface", fmt.Sprintf("No interface %s", iface))
+		}
+		values := m.dbusValues()
+		v, ok := values[name]
+		if !ok {
+			return c.replyError(call, "org.freedesktop.DBus.Error.UnknownProperty", fmt.Sprintf("No property %s", name))
+		}
+		reply.body.variant(v)
+		return c.reply(call, &reply, "v")
+	case "org.freedesktop.DBus.Properties.GetAll":
+		iface, err := call.decoder().str()
+		if err != nil || call.signature != "s" {
+			return c.replyError(call, "org.freedesktop.DBus.Error.InvalidArgs", "GetAll takes an interface name")
+		}
+		values := m.dbusValues()
+		if iface != dbusAPIName && iface != "" {
+			// No properties, rather than an error, as other
+			// implementations do.
+			values = nil
+		}
+		n := len(dbusProperties)
+		if values == nil {
+			n = 0
+		}
+		reply.body.array(8, n, func(i int) {
+			reply.body.align(8)
+			reply.body.str(dbusProperties[i])
+			reply.body.variant(values[dbusProperties[i]])
+		})
+		return c.reply(call, &reply, "a{sv}")
+	case "org.freedesktop.DBus.Properties.Set":
+		return c.replyError(call, "org.freedesktop.DBus.Error.PropertyReadOnly", "The properties of "+dbusAPIName+" are read-only")
+	}
+	return c.replyError(call, "org.freedesktop.DBus.Error.UnknownMethod", fmt.Sprintf("No method %s.%s", call.iface, call.member))
+}
+
+// dbusValues returns the values of dbusProperties by name.
+func (m *monitor) dbusValues() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.status
+	return map[string]interface{}{
+		"Vsz":      st.Vsz,
+		"Rss":      st.Rss,
+		"Swap":     st.Swap,
+		"VszLimit": st.VszLimit,
+		"Running":  uint32(st.Running),
+		"Stopped":  uint32(st.Stopped),
+		"Paused":   m.enforcementPaused,
+	}
+}
+
+// pauseEnforcement pauses or resumes enforcement, on behalf of sender. While
+// paused, the next scans release every process held throttled, and throttle
+// none.
+func (m *monitor) pauseEnforcement(pause bool, sender string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.enforcementPaused == pause {
+		return
+	}
+	m.enforcementPaused = pause
+	if pause {
+		m.emit(event{Time: m.clock.Now(), Type: "pause-enforcement", Reason: "enforcement paused over D-Bus by " + sender})
+	} else {
+		m.emit(event{Time: m.clock.Now(), Type: "resume-enforcement", Reason: "enforcement resumed over D-Bus by " + sender})
+	}
+}
@@ -0,0 +1,173 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Number of filtered processes that doctor tries to signal.
+const doctorSample = 10
+
+// diagnosis prints the outcome of doctor's checks, remembering whether any
+// of them failed.
+type diagnosis struct {
+	w      io.Writer
+	failed bool
+}
+
+func (d *diagnosis) report(result, check, format string, args ...interface{}) {
+	fmt.Fprintf(d.w, "%-4s %-11s %s\n", result, check+":", fmt.Sprintf(format, args...))
+}
+
+func (d *diagnosis) ok(check, format string, args ...interface{}) {
+	d.report("ok", check, format, args...)
+}
+
+func (d *diagnosis) warn(check, format string, args ...interface{}) {
+	d.report("WARN", check, format, args...)
+}
+
+func (d *diagnosis) fail(check, format string, args ...interface{}) {
+	d.failed = true
+	d.report("FAIL", check, format, args...)
+}
+
+// doctor checks that memlimit can do its job as configured, printing a
+// report to w. It returns false if anything would keep it from working.
+func doctor(w io.Writer, trees []*tree, mode string, interval time.Duration, protectUnfiltered, pageOut bool) bool {
+	d := &diagnosis{w: w}
+
+	start := time.Now()
+	stats, err := getProcStats()
+	scan := time.Since(start)
+	if err != nil {
+		d.fail("procfs", "cannot list processes: %v", err)
+		return false
+	}
+	if _, ok := stats[os.Getpid()]; !ok {
+		d.fail("procfs", "cannot read our own /proc/%d/stat; is /proc mounted?", os.Getpid())
+		return false
+	}
+	d.ok("procfs", "read %d processes in %v", len(stats), scan.Round(time.Microsecond))
+	if hidepid := procHidepid(); hidepid != "" && hidepid != "0" && hidepid != "off" {
+		d.warn("procfs", "/proc is mounted with hidepid=%s, so processes of other users may be invisible", hidepid)
+	}
+
+	// Check the top-level processes given, and a sample of the filtered
+	// processes under them (or anywhere, if none were given).
+	var roots []int
+	for _, t := range trees {
+		if t.pid == 0 {
+			continue
+		}
+		roots = append(roots, t.pid)
+		if err := syscall.Kill(t.pid, 0); err != nil {
+			d.fail("signal", "cannot signal top-level process %d: %v", t.pid, err)
+		} else {
+			d.ok("signal", "can signal top-level process %d", t.pid)
+		}
+	}
+	candidates := make([]int, 0, len(stats))
+	if len(roots) > 0 {
+		children := getPidMap(stats)
+		for queue := roots; len(queue) > 0; queue = queue[1:] {
+			candidates = append(candidates, queue[0])
+			queue = append(queue, children[queue[0]]...)
+		}
+	} else {
+		for pid := range stats {
+			candidates = append(candidates, pid)
+		}
+	}
+	sort.Ints(candidates)
+	var sampled int
+	var denied []string
+	for _, pid := range candidates {
+		stat, ok := stats[pid]
+		if !ok || ignored(stat) || !isFiltered(stat) {
+			continue
+		}
+		if sampled++; sampled > doctorSample {
+			break
+		}
+		if err := syscall.Kill(pid, 0); err != nil {
+			denied = append(denied, fmt.Sprintf("%d %s (uid %d): %v", pid, stat.Comm, procUID(pid), err))
+		}
+	}
+	switch {
+	case sampled == 0:
+		d.warn("signal", "no processes matching -profile found to try signalling; is the build running?")
+	case len(denied) > 0:
+		d.fail("signal", "cannot signal %d of %d filtered processes tried: %s", len(denied), sampled, strings.Join(denied, "; "))
+	default:
+		d.ok("signal", "can signal all %d filtered processes tried", sampled)
+	}
+
+	if err := preflight(nil, mode, protectUnfiltered, pageOut); err != nil {
+		d.fail("privileges", "%v", err)
+	} else {
+		d.ok("privileges", "sufficient for -mode %s", mode)
+	}
+
+	if controllers, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+		if strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " memory ") {
+			d.ok("cgroup", "cgroup v2 with the memory controller")
+		} else {
+			d.warn("cgroup", "cgroup v2 without the memory controller enabled")
+		}
+	} else if _, err := os.Stat("/sys/fs/cgroup/memory"); err == nil {
+		d.ok("cgroup", "cgroup v1 memory controller")
+	} else {
+		d.warn("cgroup", "no cgroup memory controller found")
+	}
+
+	switch {
+	case interval <= 0:
+		d.fail("interval", "-check-interval %v is not positive", interval)
+	case scan > interval/2:
+		d.warn("interval", "a scan takes %v, too much of the %v -check-interval for processes not to grow unchecked between scans", scan.Round(time.Microsecond), interval)
+	default:
+		d.ok("interval", "a scan takes %v of the %v -check-interval", scan.Round(time.Microsecond), interval)
+	}
+	var res syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETRES, clockMonotonic, uintptr(unsafe.Pointer(&res)), 0); errno != 0 {
+		d.warn("clock", "cannot get the monotonic clock resolution: %v", errno)
+	} else if r := time.Duration(res.Nano()); r > interval/10 {
+		d.warn("clock", "monotonic clock resolution %v is coarse for the %v -check-interval", r, interval)
+	} else {
+		d.ok("clock", "monotonic clock resolution %v", r)
+	}
+
+	return !d.failed
+}
+
+// CLOCK_MONOTONIC from linux/time.h.
+const clockMonotonic = 1
+
+// procHidepid returns the hidepid mount option of /proc, or "" if it is not
+// set.
+func procHidepid() string {
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 4 && fields[1] == "/proc" {
+			for _, opt := range strings.Split(fields[3], ",") {
+				if name, v, _ := strings.Cut(opt, "="); name == "hidepid" {
+					return v
+				}
+			}
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/procfs"
+)
+
+// Compiler drivers, which run the compiler proper (cc1, clang -cc1, ...),
+// the assembler and the linker as children and wait for them.
+var compilerDrivers = map[string]bool{
+	"gcc":     true,
+	"g++":     true,
+	"cc":      true,
+	"c++":     true,
+	"clang":   true,
+	"clang++": true,
+}
+
+// isDriver reports whether stat is a compiler driver, going by its
+// executable, with any target prefix (x86_64-linux-gnu-gcc) and version
+// suffix (gcc-12, clang++-15) stripped.
+func isDriver(stat procfs.ProcStat) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", stat.PID))
+	if err != nil {
+		return compilerDrivers[stat.Comm]
+	}
+	name := filepath.Base(strings.TrimSuffix(exe, " (deleted)"))
+	if i := strings.LastIndexByte(name, '-'); i >= 0 && strings.Trim(name[i+1:], "0123456789.") == "" {
+		name = name[:i]
+	}
+	if i := strings.LastIndexByte(name, '-'); i >= 0 {
+		name = name[i+1:]
+	}
+	return compilerDrivers[name]
+}
+
+// holdDrivers stops the compiler drivers of throttled processes along with
+// them, and resumes them once none of their children are throttled anymore.
+// A running driver waiting on a stopped compiler only holds on to a job
+// slot, and the two are better seen as one stopped job. The other way
+// around, the children of a driver throttled in its own right are throttled
+// by enforce, which decides for them anyway.
+func (m *monitor) holdDrivers(stats map[int]procfs.ProcStat, throttled []procStatus) {
+	want := make(map[int]procfs.ProcStat)
+	for _, p := range throttled {
+		stat, ok := stats[p.PID]
+		if !ok {
+			continue
+		}
+		driver, ok := stats[stat.PPID]
+		if !ok || ignored(driver) || m.since.has(driver) || m.unmanaged.has(driver) || !isDriver(driver) {
+			continue
+		}
+		want[driver.PID] = driver
+	}
+
+	for pid, e := range m.drivers {
+		if driver, ok := want[pid]; ok && driver.Starttime == e.starttime {
+			delete(want, pid)
+			continue
+		}
+		delete(m.drivers, pid)
+		m.releaseDriver(e.value, "none of its children are throttled")
+	}
+
+	pids := make([]int, 0, len(want))
+	for pid := range want {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		driver := want[pid]
+		m.emit(m.newEvent("throttle", driver, 0, "driver of a throttled process"))
+		if err := m.thr.throttle(driver); err != nil {
+			log.Printf("Error throttling %d %s: %v", driver.PID, driver.Comm, err)
+			continue
+		}
+		m.drivers.save(driver, driver)
+	}
+}
+
+// releaseDriver resumes a driver stopped by holdDrivers.
+func (m *monitor) releaseDriver(driver procfs.ProcStat, reason string) {
+	m.emit(m.newEvent("release", driver, 0, reason))
+	if err := m.thr.release(driver); err != nil {
+		log.Printf("Error releasing %d %s: %v", driver.PID, driver.Comm, err)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// escalationStep is a signal to send once a throttled process has been over
+// limit for a while.
+type escalationStep struct {
+	after time.Duration
+	sig   syscall.Signal
+	name  string
+}
+
+// Signals that can be escalated to.
+var escalationSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// parseEscalation parses a comma-separated list of delay:signal steps, e.g.
+// "60s:TERM,30s:KILL".
+func parseEscalation(s string) ([]escalationStep, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var steps []escalationStep
+	for _, step := range strings.Split(s, ",") {
+		after, name, ok := strings.Cut(step, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid step %q, want delay:signal", step)
+		}
+		d, err := time.ParseDuration(after)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step %q: %v", step, err)
+		}
+		name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+		sig, ok := escalationSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid step %q: unknown signal %s", step, name)
+		}
+		steps = append(steps, escalationStep{after: d, sig: sig, name: "SIG" + name})
+	}
+	return steps, nil
+}
+
+// escalation is how far along the escalation steps a process is.
+type escalation struct {
+	// Number of steps taken, and when the last one was.
+	steps int
+	at    time.Time
+}
+
+// escalate takes the escalation steps for processes that are held throttled
+// while over limit. Each limit still exceeded escalates one process at a
+// time: the last one held in victim order, i.e. the newest with the default
+// order. Once its steps have started, they are seen through even if a newer
+// process is throttled. Each process escalated has its own steps, kept until
+// it is let run or no longer the victim of any limit.
+func (m *monitor) escalate(procs []tracked, throttled []procStatus) {
+	if len(m.escalation) == 0 {
+		return
+	}
+
+	held := make(map[procStatus]bool, len(throttled))
+	for _, p := range throttled {
+		held[p] = true
+	}
+	stepping := func(p *tracked) bool {
+		e, ok := m.escalations.get(p.stat)
+		return ok && e.steps > 0
+	}
+	victims := make(map[*budget]*tracked)
+	for i := range procs {
+		p := &procs[i]
+		if !held[newProcStatus(p.stat)] {
+			continue
+		}
+		if action, _ := m.overrides.get(p.stat); action == overrideStop {
+			continue
+		}
+		for _, b := range p.budgets {
+			if b.vsz <= b.limit {
+				continue
+			}
+			if v := victims[b]; v == nil || !stepping(v) {
+				victims[b] = p
+			}
+		}
+	}
+	escalated := make(map[int]bool, len(victims))
+	for _, p := range victims {
+		escalated[p.stat.PID] = true
+	}
+	for pid := range m.escalations {
+		if !escalated[pid] {
+			delete(m.escalations, pid)
+		}
+	}
+	for i := range procs {
+		if stat := procs[i].stat; escalated[stat.PID] {
+			m.escalateProc(stat)
+		}
+	}
+}
+
+// escalateProc takes the next escalation step for stat if it is due.
+func (m *monitor) escalateProc(stat procfs.ProcStat) {
+	e, ok := m.escalations.get(stat)
+	if !ok {
+		e.at = m.now
+		if since, ok := m.since.get(stat); ok {
+			e.at = since
+		}
+	}
+	if e.steps == len(m.escalation) {
+		m.escalations.save(stat, e)
+		return
+	}
+	step := m.escalation[e.steps]
+	if m.now.Sub(e.at) < step.after {
+		m.escalations.save(stat, e)
+		return
+	}
+
+	from := "being throttled"
+	if e.steps > 0 {
+		from = "the last step"
+	}
+	reason := fmt.Sprintf("still over limit %v after %s, sending %v (step %d of %d)", m.now.Sub(e.at).Round(time.Second), from, step.name, e.steps+1, len(m.escalation))
+	m.emit(m.newEvent("escalate", stat, 0, reason))
+	if err := m.kill(stat, step.sig); err != nil {
+		log.Printf("Error escalating %d %s: %v", stat.PID, stat.Comm, err)
+	} else if step.sig != syscall.SIGKILL {
+		// A stopped process only acts on the signal once continued. If
+		// it survives the signal, it is throttled again, rather than
+		// taken for continued by someone else.
+		m.kill(stat, syscall.SIGCONT)
+		m.pending.save(stat, pendingSignal{throttle: true})
+	}
+	m.escalations.save(stat, escalation{steps: e.steps + 1, at: m.now})
+	m.summary.escalations++
+}
@@ -0,0 +1,153 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// Number of recent events kept for the control API.
+const maxEvents = 1000
+
+// event records a throttling decision and why it was made.
+type event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	PID       int       `json:"pid"`
+	Starttime uint64    `json:"starttime"`
+	Comm      string    `json:"comm"`
+	Vsz       uint64    `json:"vsz"`
+	// Position of the process in the victim ordering, starting at 1.
+	Rank int `json:"rank,omitempty"`
+	// Bytes the process has read from and written to storage so far, as of
+	// the last scan.
+	ReadBytes  uint64 `json:"read_bytes,omitempty"`
+	WriteBytes uint64 `json:"write_bytes,omitempty"`
+	// Source file the process is compiling, and the ninja target it is
+	// built for, if known.
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	Reason string `json:"reason"`
+}
+
+func (m *monitor) newEvent(typ string, stat procfs.ProcStat, rank int, reason string) event {
+	pio, _ := m.io.get(stat)
+	job, _ := m.jobs.get(stat)
+	return event{
+		Time:       m.now,
+		Type:       typ,
+		PID:        stat.PID,
+		Starttime:  stat.Starttime,
+		Comm:       stat.Comm,
+		Vsz:        stat.VirtualMemory(),
+		Rank:       rank,
+		ReadBytes:  pio.read,
+		WriteBytes: pio.write,
+		Source:     job.source,
+		Target:     job.target,
+		Reason:     reason,
+	}
+}
+
+// Events logged even without -verbose.
+var alwaysLogged = map[string]bool{
+	"warn":   true,
+	"unwarn": true,
+	// A limit that throttling cannot bring usage under.
+	"unattainable": true,
+	"attainable":   true,
+	"adapt":        true,
+	// Crossing -max-load.
+	"load": true,
+	// Build phases detected with -config.
+	"phase": true,
+	// Trees coming and going with -attach.
+	"attach":   true,
+	"detach":   true,
+	"escalate": true,
+	"kill":     true,
+	"stuck":    true,
+	// Processes stopped or continued by something other than memlimit.
+	"stopped":   true,
+	"continued": true,
+	// Often a sign of swap thrashing.
+	"uninterruptible": true,
+	// Enforcement paused and resumed with -dbus.
+	"pause-enforcement":  true,
+	"resume-enforcement": true,
+}
+
+// emit records e, logging it in verbose mode or if it is always logged.
+func (m *monitor) emit(e event) {
+	switch {
+	case !m.verbose && !alwaysLogged[e.Type]:
+	case e.PID == 0:
+		// Not about any one process.
+		log.Printf("Event %s (VSZ %s): %s", e.Type, formatSize(e.Vsz), e.Reason)
+	default:
+		detail := "VSZ " + formatSize(e.Vsz)
+		if job := (compileJob{source: e.Source, target: e.Target}).String(); job != "" {
+			detail = job + ", " + detail
+		}
+		if e.Rank > 0 {
+			detail += fmt.Sprintf(", rank %d", e.Rank)
+		}
+		if e.ReadBytes != 0 || e.WriteBytes != 0 {
+			detail += fmt.Sprintf(", read %s, written %s", formatSize(e.ReadBytes), formatSize(e.WriteBytes))
+		}
+		log.Printf("Event %s %d %s (%s): %s", e.Type, e.PID, e.Comm, detail, e.Reason)
+	}
+	if m.audit != nil && e.PID != 0 {
+		m.lastReason.save(procfs.ProcStat{PID: e.PID, Starttime: e.Starttime}, e.Reason)
+	}
+	if m.notify != nil && (e.Type == "kill" || e.Type == "escalate") {
+		m.notify.send(fmt.Sprintf("memlimit signalled %s", e.Comm), fmt.Sprintf("%d %s: %s", e.PID, e.Comm, e.Reason), true)
+	}
+	for ch := range m.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// Too slow to keep up. Dropping it lets it reconnect,
+			// rather than miss events without knowing.
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+	if m.historyDB != nil {
+		m.historyDB.event(e)
+	}
+	if len(m.events) == maxEvents {
+		m.events = append(m.events[:0], m.events[1:]...)
+	}
+	m.events = append(m.events, e)
+}
+
+// exceededReason explains why the budgets in exceeded force a throttle.
+func exceededReason(exceeded []*budget) string {
+	var reasons []string
+	for _, b := range exceeded {
+		if b.vsz > b.limit {
+			reasons = append(reasons, fmt.Sprintf("%s %s %s exceeds %s limit by %s", b.name, b.what(), formatSize(b.vsz), formatSize(b.limit), formatSize(b.vsz-b.limit)))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("an older process in %s is held throttled", b.name))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// withinReason explains why budgets allow a process to be released.
+func withinReason(budgets []*budget) string {
+	var reasons []string
+	for _, b := range budgets {
+		if b.limit == unlimited {
+			continue
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %s %s within %s limit", b.name, b.what(), formatSize(b.vsz), formatSize(b.limit)))
+	}
+	return strings.Join(reasons, "; ")
+}
@@ -0,0 +1,217 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// explanation is why a process is stopped or running, as of the last scan.
+type explanation struct {
+	PID   int    `json:"pid"`
+	Comm  string `json:"comm"`
+	State string `json:"state"`
+	Vsz   uint64 `json:"vsz"`
+	Rss   uint64 `json:"rss"`
+	Swap  uint64 `json:"swap,omitempty"`
+	Job   string `json:"job,omitempty"`
+	// Whether the process may be throttled at all, and if so whether it
+	// is, its position in the victim order of the filtered processes, and
+	// the budgets it is charged to.
+	Filtered  bool           `json:"filtered"`
+	LTO       bool           `json:"lto,omitempty"`
+	Throttled bool           `json:"throttled"`
+	Rank      int            `json:"rank,omitempty"`
+	Of        int            `json:"of,omitempty"`
+	Budgets   []budgetStatus `json:"budgets,omitempty"`
+	Unmanaged bool           `json:"unmanaged,omitempty"`
+	Override  string         `json:"override,omitempty"`
+	// Since when the process has been throttled or running, if known, and
+	// the reason of the last event about it.
+	Since  time.Time `json:"since,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// The -sort-by order in force, and whether it is descending.
+	SortBy   string `json:"sort_by"`
+	SortDesc bool   `json:"sort_desc,omitempty"`
+}
+
+// budgetStatus is the usage and limit of a budget.
+type budgetStatus struct {
+	Name   string `json:"name"`
+	Metric string `json:"metric"`
+	Usage  uint64 `json:"usage"`
+	Limit  uint64 `json:"limit"`
+}
+
+// explain returns why pid is stopped or running, as of the last scan.
+func (m *monitor) explain(pid int) (explanation, bool) {
+	stat, ok := m.lastStats[pid]
+	if !ok {
+		return explanation{}, false
+	}
+	inTree := false
+	for _, t := range m.trees {
+		for _, p := range t.pids {
+			inTree = inTree || p == pid
+		}
+	}
+	if !inTree {
+		return explanation{}, false
+	}
+
+	e := explanation{PID: pid, Comm: stat.Comm, State: stat.State, Vsz: stat.VirtualMemory(), Rss: stat.ResidentMemory(), SortBy: m.sortBy, SortDesc: m.sortDesc}
+	if seen, ok := m.firstSeen.get(stat); ok {
+		e.Since = seen
+	}
+	for i, p := range m.procs {
+		if p.stat.PID != pid {
+			continue
+		}
+		job, _ := m.jobs.get(stat)
+		e.Filtered, e.LTO, e.Swap, e.Job = true, p.isLTO, p.swap, job.String()
+		e.Throttled = m.thr.throttled(stat)
+		e.Rank, e.Of = i+1, len(m.procs)
+		for _, b := range p.budgets {
+			e.Budgets = append(e.Budgets, budgetStatus{Name: b.name, Metric: b.what(), Usage: b.vsz, Limit: b.limit})
+		}
+		e.Unmanaged = m.unmanaged.has(stat)
+		e.Override, _ = m.overrides.get(stat)
+		if since, ok := m.since.get(stat); ok && e.Throttled {
+			e.Since = since
+		} else if at, ok := m.resumedAt.get(stat); ok && !e.Throttled {
+			e.Since = at
+		}
+	}
+	for i := len(m.events) - 1; i >= 0; i-- {
+		if ev := m.events[i]; ev.PID == pid && ev.Starttime == stat.Starttime {
+			e.Reason = ev.Type + ": " + ev.Reason
+			break
+		}
+	}
+	return e, true
+}
+
+func (m *monitor) handleExplain(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		http.Error(w, "invalid pid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	e, ok := m.explain(pid)
+	m.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "process not in a tracked tree", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, e)
+}
+
+// explainCommand implements memlimit explain: it prints why pid is stopped
+// or running, as explained by the instance serving listen, or without it,
+// going by the state files in stateDir.
+func explainCommand(w io.Writer, pid int, listen, token, stateDir string) error {
+	if listen == "" {
+		return explainFromState(w, pid, stateDir)
+	}
+	client, base := controlClient(listen, token)
+	var e explanation
+	if err := getJSON(client, base+"/explain?"+url.Values{"pid": {strconv.Itoa(pid)}}.Encode(), &e); err != nil {
+		return err
+	}
+	printExplanation(w, e, time.Now())
+	return nil
+}
+
+func printExplanation(w io.Writer, e explanation, now time.Time) {
+	fmt.Fprintf(w, "%d %s, state %s, VSZ %s, RSS %s", e.PID, e.Comm, e.State, formatSize(e.Vsz), formatSize(e.Rss))
+	if e.Swap != 0 {
+		fmt.Fprintf(w, ", swap %s", formatSize(e.Swap))
+	}
+	fmt.Fprintln(w)
+	if e.Job != "" {
+		fmt.Fprintf(w, "Compiling %s\n", e.Job)
+	}
+	if !e.Filtered {
+		fmt.Fprintln(w, "Not filtered: never throttled, its memory counts as unfilterable")
+		return
+	}
+
+	state := "Running"
+	if e.Throttled {
+		state = "Stopped"
+	}
+	if !e.Since.IsZero() {
+		state += fmt.Sprintf(" for %v", now.Sub(e.Since).Round(time.Second))
+	}
+	kind := ""
+	if e.LTO {
+		kind = " (LTO link)"
+	}
+	order := e.SortBy
+	if e.SortDesc {
+		order += ", descending"
+	}
+	fmt.Fprintf(w, "%s, rank %d of %d filtered processes%s by -sort-by %s\n", state, e.Rank, e.Of, kind, order)
+	for _, b := range e.Budgets {
+		if b.Limit == unlimited {
+			fmt.Fprintf(w, "  %s %s %s, no limit\n", b.Name, b.Metric, formatSize(b.Usage))
+			continue
+		}
+		over := "within"
+		if b.Usage > b.Limit {
+			over = "over"
+		}
+		fmt.Fprintf(w, "  %s %s %s, %s its %s limit\n", b.Name, b.Metric, formatSize(b.Usage), over, formatSize(b.Limit))
+	}
+	switch {
+	case e.Unmanaged:
+		fmt.Fprintln(w, "Unmanaged: never signalled")
+	case e.Override != "":
+		fmt.Fprintf(w, "Manual override: %s\n", e.Override)
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(w, "Last decision: %s\n", e.Reason)
+	}
+}
+
+// explainFromState explains pid from the state files in dir, which only
+// tell which instance, if any, holds it throttled.
+func explainFromState(w io.Writer, pid int, dir string) error {
+	if dir == "" {
+		return errors.New("requires -listen or -state-dir")
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var st persistedState
+		if err := json.Unmarshal(data, &st); err != nil {
+			continue
+		}
+		for _, p := range st.Throttled {
+			if p.PID == pid {
+				fmt.Fprintf(w, "%d %s is held throttled by memlimit %d (mode %s) as of %s, with overall VSZ %s of the %s limit\n", pid, p.Comm, st.PID, st.Mode, st.Updated.Format(time.RFC3339), formatSize(st.Vsz), formatSize(st.VszLimit))
+				fmt.Fprintln(w, "Run with the -listen of that instance for details")
+				return nil
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d is not held throttled by any memlimit instance writing state to %s\n", pid, dir)
+	return nil
+}
@@ -0,0 +1,264 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// How often agents report to the -report-to aggregator.
+	reportEvery = 10 * time.Second
+	// How long the aggregator keeps instances that stopped reporting,
+	// and after how long top-fleet shows them as silent.
+	fleetExpiry = 5 * time.Minute
+	fleetSilent = 3 * reportEvery
+	// How often top-fleet refreshes.
+	fleetRefresh = 2 * time.Second
+)
+
+// fleetReport is what an agent reports about its instance.
+type fleetReport struct {
+	Host string `json:"host"`
+	persistedState
+}
+
+// memoryBound reports whether the instance has had to hold anything back.
+func (r fleetReport) memoryBound() bool {
+	return r.Stopped > 0 || r.Warning || len(r.Unattainable) > 0
+}
+
+// reportTo posts the status of m to the aggregator at addr every
+// reportEvery, until ctx is done.
+func (m *monitor) reportTo(ctx context.Context, addr, token string) {
+	client, base := controlClient(addr, token)
+	host, err := os.Hostname()
+	if err != nil {
+		log.Println("Error getting hostname for -report-to:", err)
+	}
+	failing := false
+	for {
+		m.mu.Lock()
+		scanned := !m.lastScan.IsZero()
+		r := fleetReport{Host: host, persistedState: persistedState{PID: os.Getpid(), Mode: m.mode, Updated: m.clock.Now(), status: m.status}}
+		m.mu.Unlock()
+
+		// Nothing to report before the first scan.
+		wait := m.interval
+		if scanned {
+			err := postReport(client, base+"/report", r)
+			// Only log changes, not every failed attempt while the
+			// aggregator is down.
+			if err != nil && !failing {
+				log.Printf("Error reporting to %s, retrying every %v: %v", addr, reportEvery, err)
+			} else if err == nil && failing {
+				log.Printf("Reporting to %s again", addr)
+			}
+			failing = err != nil
+			wait = reportEvery
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func postReport(client *http.Client, addr string, r fleetReport) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(addr, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return httpError(resp)
+	}
+	return nil
+}
+
+// aggregator collects the reports of agents, by host and memlimit PID.
+type aggregator struct {
+	mu      sync.Mutex
+	reports map[string]fleetReport
+}
+
+// aggregate serves the aggregator on addr, to agents sending token over TCP:
+//
+//	POST /report  an agent's fleetReport, as JSON
+//	GET  /fleet   the latest report of each instance, most memory-bound first
+func aggregate(addr, token string) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	a := &aggregator{reports: make(map[string]fleetReport)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", a.handleReport)
+	mux.HandleFunc("/fleet", a.handleFleet)
+	h, err := authenticate(l, token, mux)
+	if err != nil {
+		return err
+	}
+	log.Printf("Aggregating reports on %s", addr)
+	return http.Serve(l, h)
+}
+
+func (a *aggregator) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var rep fleetReport
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Agents' clocks can't be trusted to agree with ours.
+	rep.Updated = time.Now()
+
+	a.mu.Lock()
+	a.reports[fmt.Sprintf("%s/%d", rep.Host, rep.PID)] = rep
+	a.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *aggregator) handleFleet(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	a.mu.Lock()
+	reports := make([]fleetReport, 0, len(a.reports))
+	for key, rep := range a.reports {
+		if now.Sub(rep.Updated) > fleetExpiry {
+			delete(a.reports, key)
+			continue
+		}
+		reports = append(reports, rep)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool {
+		ri, rj := reports[i], reports[j]
+		if ri.Stopped != rj.Stopped {
+			return ri.Stopped > rj.Stopped
+		}
+		if ui, uj := usage(ri.status), usage(rj.status); ui != uj {
+			return ui > uj
+		}
+		if ri.Host != rj.Host {
+			return ri.Host < rj.Host
+		}
+		return ri.PID < rj.PID
+	})
+	writeJSON(w, reports)
+}
+
+// usage returns the share of the overall limit st uses, in percent.
+func usage(st status) float64 {
+	if st.VszLimit == 0 {
+		return 0
+	}
+	return 100 * float64(st.Vsz) / float64(st.VszLimit)
+}
+
+// topFleet implements memlimit top-fleet: it shows the instances reporting
+// to the aggregator at addr, refreshed until q is pressed or it is
+// interrupted.
+func topFleet(addr, token string) error {
+	t, err := newTUI(os.Stdin, os.Stdout, "")
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	if t.in != nil {
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				n, err := t.in.Read(buf)
+				if err != nil || string(buf[:n]) == "q" {
+					quit <- syscall.SIGINT
+					return
+				}
+			}
+		}()
+	}
+
+	client, base := controlClient(addr, token)
+	for {
+		var reports []fleetReport
+		err := getJSON(client, base+"/fleet", &reports)
+		drawFleet(t.out, addr, reports, err)
+
+		select {
+		case <-quit:
+			return nil
+		case <-time.After(fleetRefresh):
+		}
+	}
+}
+
+func getJSON(client *http.Client, addr string, v interface{}) error {
+	resp, err := client.Get(addr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return httpError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// drawFleet redraws the screen of top-fleet.
+func drawFleet(out *os.File, addr string, reports []fleetReport, err error) {
+	rows, cols, werr := winsize(out)
+	if werr != nil {
+		return
+	}
+	now := time.Now()
+	bound := 0
+	for _, r := range reports {
+		if r.memoryBound() {
+			bound++
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("memlimit fleet at %s  instances: %d  memory-bound: %d  %s", addr, len(reports), bound, now.Format("15:04:05")),
+		"q: quit",
+	}
+	if err != nil {
+		lines[1] = "Error: " + err.Error()
+	}
+	lines = append(lines, "",
+		fmt.Sprintf("%-24s %7s %-8s %8s %8s %5s %7s %7s %8s %6s  %s", "HOST", "PID", "MODE", "VSZ", "LIMIT", "USE%", "RUNNING", "STOPPED", "SWAP", "KILLED", "LAST REPORT"))
+	for _, r := range reports {
+		note := ""
+		if r.memoryBound() {
+			note = "  memory-bound"
+		}
+		age := now.Sub(r.Updated).Truncate(time.Second)
+		if age > fleetSilent {
+			note += "  silent"
+		}
+		lines = append(lines, fmt.Sprintf("%-24s %7d %-8s %8s %8s %5.0f %7d %7d %8s %6d  %s ago%s", r.Host, r.PID, r.Mode, formatSize(r.Vsz), formatSize(r.VszLimit), usage(r.status), r.Running, r.Stopped, formatSize(r.Swap), r.Killed, age, note))
+	}
+	writeScreen(out, lines, rows, cols, -1)
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// Window over which the VSZ growth rate of processes is averaged.
+const growthWindow = 10 * time.Second
+
+// growth is the VSZ growth rate of a process in bytes per second, as of its
+// VSZ sampled at at.
+type growth struct {
+	vsz  uint64
+	rate float64
+	at   time.Time
+}
+
+// trackGrowth updates the growth rate of stat: the exponentially weighted
+// moving average over growthWindow of its VSZ growth between scans, of its
+// actual VSZ rather than the smoothed or predicted one.
+func (m *monitor) trackGrowth(stat procfs.ProcStat) {
+	g, ok := m.growth.get(stat)
+	if dt := m.now.Sub(g.at); ok && dt > 0 {
+		rate := (float64(stat.VSize) - float64(g.vsz)) / dt.Seconds()
+		alpha := 1 - math.Exp(-float64(dt)/float64(growthWindow))
+		g.rate += alpha * (rate - g.rate)
+	}
+	g.vsz, g.at = stat.VSize, m.now
+	m.growth.save(stat, g)
+}
+
+// growthRate returns the growth rate of stat, 0 if not known yet.
+func (m *monitor) growthRate(stat procfs.ProcStat) float64 {
+	g, _ := m.growth.get(stat)
+	return g.rate
+}
+
+// growthKey is the -sort-by growth key: the growth rate in MiB/s, so that
+// the fastest-growing processes are throttled first, which frees the most
+// headroom for each one stopped. Processes growing by less, or shrinking,
+// tie and are ordered by starttime.
+func (m *monitor) growthKey(stat procfs.ProcStat) uint64 {
+	if rate := m.growthRate(stat); rate > 1<<20 {
+		return uint64(rate / (1 << 20))
+	}
+	return 0
+}
+
+// sortKeyFunc returns the key of -sort-by name, if there is one.
+func (m *monitor) sortKeyFunc(name string) (func(stat procfs.ProcStat) uint64, bool) {
+	if name == "growth" {
+		return m.growthKey, true
+	}
+	key, ok := sortKeys[name]
+	return key, ok
+}
@@ -0,0 +1,321 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Number of jobs listed by memlimit report.
+const reportTop = 20
+
+// historySchema is created in a -history-db that doesn't have it yet. Times
+// are in Unix milliseconds, and a run's id is its start in Unix nanoseconds,
+// so that instances sharing a database don't have to read back ids. A
+// vsz_limit is NULL while unlimited. Writes wait for those of other
+// instances, or for readers checkpointing, rather than fail.
+const historySchema = `PRAGMA busy_timeout = 5000;
+PRAGMA journal_mode = WAL;
+PRAGMA synchronous = NORMAL;
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	start INTEGER NOT NULL,
+	end INTEGER,
+	command TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS samples (
+	run INTEGER NOT NULL,
+	time INTEGER NOT NULL,
+	vsz INTEGER NOT NULL,
+	rss INTEGER NOT NULL,
+	swap INTEGER NOT NULL,
+	lto_vsz INTEGER NOT NULL,
+	vsz_limit INTEGER,
+	running INTEGER NOT NULL,
+	stopped INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_run ON samples (run, time);
+CREATE TABLE IF NOT EXISTS events (
+	run INTEGER NOT NULL,
+	time INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	pid INTEGER NOT NULL,
+	comm TEXT NOT NULL,
+	vsz INTEGER NOT NULL,
+	source TEXT NOT NULL,
+	target TEXT NOT NULL,
+	reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_run ON events (run, time);
+CREATE INDEX IF NOT EXISTS events_time ON events (type, time);
+`
+
+// Transactions queued for sqlite3 before recording is given up on, about
+// as many scans.
+const historyBacklog = 64
+
+// historyDB records the memory of every scan and every event of the run in
+// a SQLite database, through the sqlite3 command, for memlimit report or
+// any other SQLite client to query across builds.
+type historyDB struct {
+	cmd *exec.Cmd
+	run int64
+	// Statements since the last scan, committed along with its sample.
+	pending bytes.Buffer
+	// Transactions for write to hand to sqlite3, so that scans don't wait
+	// on it, and what it returns once they are all written.
+	writes chan string
+	done   chan error
+	// Set once writing to sqlite3 failed.
+	failed atomic.Bool
+}
+
+// openHistoryDB starts sqlite3 on the database at path, creating it and its
+// tables as needed, and records the start of a run of command.
+func openHistoryDB(path string, start time.Time, command string) (*historyDB, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, fmt.Errorf("the sqlite3 command is needed: %v", err)
+	}
+	cmd := exec.Command("sqlite3", "-bail", "-batch", path)
+	// Output of the pragmas is of no interest, errors are.
+	cmd.Stdout, cmd.Stderr = io.Discard, os.Stderr
+	// Keep Ctrl-C on the terminal from killing it before the last scans
+	// are written. It exits once we close its input.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	h := &historyDB{cmd: cmd, run: start.UnixNano(), writes: make(chan string, historyBacklog), done: make(chan error, 1)}
+	go h.write(in)
+	// The journal mode can't be changed within a transaction.
+	h.writes <- historySchema
+	fmt.Fprintf(&h.pending, "INSERT INTO runs (id, start, command) VALUES (%d, %d, %s);\n", h.run, start.UnixMilli(), sqlQuote(command))
+	if err := h.commit(); err != nil {
+		h.close(start)
+		return nil, err
+	}
+	return h, nil
+}
+
+// write writes the transactions queued to in, sqlite3's input, until they
+// are no more, and waits for it to exit.
+func (h *historyDB) write(in io.WriteCloser) {
+	var err error
+	for stmts := range h.writes {
+		if err != nil {
+			continue
+		}
+		if _, err = io.WriteString(in, stmts); err != nil {
+			h.failed.Store(true)
+		}
+	}
+	in.Close()
+	if waitErr := h.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	h.done <- err
+}
+
+// sample records the memory of the scan at now, committing it along with the
+// events since the last one.
+func (h *historyDB) sample(now time.Time, st status) error {
+	limit := "NULL"
+	if st.VszLimit != unlimited {
+		limit = strconv.FormatUint(st.VszLimit, 10)
+	}
+	fmt.Fprintf(&h.pending, "INSERT INTO samples VALUES (%d, %d, %d, %d, %d, %d, %s, %d, %d);\n", h.run, now.UnixMilli(), st.Vsz, st.Rss, st.Swap, st.LTOVsz, limit, st.Running, st.Stopped)
+	return h.commit()
+}
+
+// event records e, to be committed with the next scan.
+func (h *historyDB) event(e event) {
+	fmt.Fprintf(&h.pending, "INSERT INTO events VALUES (%d, %d, %s, %d, %s, %d, %s, %s, %s);\n", h.run, e.Time.UnixMilli(), sqlQuote(e.Type), e.PID, sqlQuote(e.Comm), e.Vsz, sqlQuote(e.Source), sqlQuote(e.Target), sqlQuote(e.Reason))
+}
+
+// commit queues the pending statements for sqlite3 as one transaction. It
+// fails if sqlite3 failed, or has fallen too far behind.
+func (h *historyDB) commit() error {
+	if h.failed.Load() {
+		return errors.New("sqlite3 stopped reading")
+	}
+	stmts := "BEGIN;\n" + h.pending.String() + "COMMIT;\n"
+	h.pending.Reset()
+	select {
+	case h.writes <- stmts:
+		return nil
+	default:
+		return fmt.Errorf("sqlite3 is %d transactions behind", historyBacklog)
+	}
+}
+
+// close records the end of the run at end, and waits for sqlite3 to write
+// out what it was given.
+func (h *historyDB) close(end time.Time) error {
+	fmt.Fprintf(&h.pending, "UPDATE runs SET end = %d WHERE id = %d;\n", end.UnixMilli(), h.run)
+	err := h.commit()
+	close(h.writes)
+	if waitErr := <-h.done; err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// recordHistoryDB records the scan that just finished in the -history-db,
+// disabling it if that fails.
+func (m *monitor) recordHistoryDB(st status) {
+	if m.historyDB == nil {
+		return
+	}
+	if err := m.historyDB.sample(m.now, st); err != nil {
+		log.Println("Error recording -history-db, disabling it:", err)
+		// sqlite3 may be stuck, which scans are not to wait on.
+		go m.historyDB.close(m.now)
+		m.historyDB = nil
+	}
+}
+
+// closeHistoryDB records the end of the run in the -history-db, waiting for
+// sqlite3 to write it out without holding up the control API.
+func (m *monitor) closeHistoryDB() {
+	m.mu.Lock()
+	h, end := m.historyDB, m.clock.Now()
+	m.historyDB = nil
+	m.mu.Unlock()
+
+	if h == nil {
+		return
+	}
+	if err := h.close(end); err != nil {
+		log.Println("Error closing -history-db:", err)
+	}
+}
+
+// sqlQuote quotes s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// queryHistoryDB runs query on the database at path, read-only, returning
+// the fields of each row. Text columns must not hold tabs or newlines.
+func queryHistoryDB(path, query string) ([][]string, error) {
+	if _, err := os.Stat(path); err != nil {
+		// sqlite3 would create it.
+		return nil, err
+	}
+	cmd := exec.Command("sqlite3", "-readonly", "-batch", "-noheader", "-separator", "\t", "-cmd", ".timeout 5000", path)
+	cmd.Stdin = strings.NewReader(query)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	var rows [][]string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		rows = append(rows, strings.Split(s.Text(), "\t"))
+	}
+	return rows, s.Err()
+}
+
+// The runs since a time, and the jobs they throttled most often, for
+// memlimit report.
+const (
+	reportRunsQuery = `SELECT start,
+	coalesce(end, (SELECT max(time) FROM samples WHERE run = runs.id), start),
+	(SELECT coalesce(max(vsz), 0) FROM samples WHERE run = runs.id),
+	(SELECT coalesce(max(rss), 0) FROM samples WHERE run = runs.id),
+	(SELECT count(*) FROM samples WHERE run = runs.id AND stopped > 0),
+	(SELECT count(*) FROM samples WHERE run = runs.id),
+	(SELECT count(*) FROM events WHERE run = runs.id AND type = 'throttle'),
+	(SELECT count(*) FROM events WHERE run = runs.id AND type IN ('kill', 'escalate')),
+	replace(replace(command, char(9), ' '), char(10), ' ')
+FROM runs WHERE start >= %d ORDER BY start;
+`
+	reportJobsQuery = `SELECT count(*), max(vsz),
+	replace(replace(coalesce(nullif(source, ''), comm), char(9), ' '), char(10), ' ') AS job
+FROM events WHERE type = 'throttle' AND time >= %d
+GROUP BY job ORDER BY count(*) DESC, job LIMIT %d;
+`
+)
+
+// printReport implements memlimit report: it lists the runs recorded in the
+// -history-db that query runs queries on over the period given by args, and
+// the jobs they throttled most often.
+func printReport(w io.Writer, query func(query string) ([][]string, error), args []string, now time.Time) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	since := fs.Duration("since", 7*24*time.Hour, "Report on the runs started this long ago or later")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	from := now.Add(-*since).UnixMilli()
+
+	runs, err := query(fmt.Sprintf(reportRunsQuery, from))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-16s %10s %8s %8s %9s %9s %5s %s\n", "STARTED", "DURATION", "PEAK VSZ", "PEAK RSS", "THROTTLED", "THROTTLES", "KILLS", "COMMAND")
+	for _, r := range runs {
+		if len(r) < 9 {
+			return fmt.Errorf("unexpected row %q", r)
+		}
+		n := make([]uint64, 8)
+		for i := range n {
+			if n[i], err = strconv.ParseUint(r[i], 10, 64); err != nil {
+				return fmt.Errorf("unexpected row %q", r)
+			}
+		}
+		start := time.UnixMilli(int64(n[0]))
+		duration := time.Duration(n[1]-n[0]) * time.Millisecond
+		// Scans are evenly spaced, so their share is that of the time.
+		throttled := "-"
+		if n[5] > 0 {
+			throttled = fmt.Sprintf("%d%%", n[4]*100/n[5])
+		}
+		fmt.Fprintf(w, "%-16s %10v %8s %8s %9s %9d %5d %s\n", start.Format("2006-01-02 15:04"), duration.Round(time.Second), formatSize(n[2]), formatSize(n[3]), throttled, n[6], n[7], strings.Join(r[8:], " "))
+	}
+
+	jobs, err := query(fmt.Sprintf(reportJobsQuery, from, reportTop))
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\n%9s %8s %s\n", "THROTTLES", "MAX VSZ", "MOST THROTTLED JOB")
+	for _, j := range jobs {
+		if len(j) < 3 {
+			return fmt.Errorf("unexpected row %q", j)
+		}
+		count, err1 := strconv.ParseUint(j[0], 10, 64)
+		vsz, err2 := strconv.ParseUint(j[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("unexpected row %q", j)
+		}
+		fmt.Fprintf(w, "%9d %8s %s\n", count, formatSize(vsz), strings.Join(j[2:], " "))
+	}
+	return nil
+}
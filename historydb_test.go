@@ -0,0 +1,137 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPrintReport checks the report on the rows the queries return, and that
+// they are over the period asked for.
+func TestPrintReport(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.UTC
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour).UnixMilli()
+	var queries []string
+	query := func(query string) ([][]string, error) {
+		queries = append(queries, query)
+		if strings.Contains(query, "FROM runs") {
+			return [][]string{
+				{itoa(start), itoa(start + 90_000), "3221225472", "1073741824", "5", "20", "7", "1", "make", "-j8"},
+				{itoa(start + 600_000), itoa(start + 600_000), "0", "0", "0", "0", "0", "0", "ninja"},
+			}, nil
+		}
+		return [][]string{{"7", "2147483648", "big.cc for big.o"}}, nil
+	}
+	var out bytes.Buffer
+	if err := printReport(&out, query, []string{"-since", "2h"}, now); err != nil {
+		t.Fatal(err)
+	}
+	want := `STARTED            DURATION PEAK VSZ PEAK RSS THROTTLED THROTTLES KILLS COMMAND
+2026-03-10 11:00      1m30s       3G       1G       25%         7     1 make -j8
+2026-03-10 11:10         0s       0B       0B         -         0     0 ninja
+
+THROTTLES  MAX VSZ MOST THROTTLED JOB
+        7       2G big.cc for big.o
+`
+	if got := out.String(); got != want {
+		t.Errorf("got report\n%s\nwant\n%s", got, want)
+	}
+	from := itoa(now.Add(-2 * time.Hour).UnixMilli())
+	if len(queries) != 2 || !strings.Contains(queries[0], from) || !strings.Contains(queries[1], from) {
+		t.Errorf("queries %q are not over the runs since %s", queries, from)
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// TestPrintReportErrors checks that bad arguments, rows and queries fail the
+// report.
+func TestPrintReportErrors(t *testing.T) {
+	rows := func(rows ...[]string) func(string) ([][]string, error) {
+		return func(string) ([][]string, error) { return rows, nil }
+	}
+	for _, tt := range []struct {
+		name  string
+		args  []string
+		query func(string) ([][]string, error)
+	}{
+		{"bad -since", []string{"-since", "week"}, rows()},
+		{"extra argument", []string{"all"}, rows()},
+		{"short row", nil, rows([]string{"1", "2"})},
+		{"text in numbers", nil, rows([]string{"1", "2", "3", "4", "5", "6", "seven", "8", "make"})},
+		{"failed query", nil, func(string) ([][]string, error) { return nil, errors.New("database is locked") }},
+	} {
+		if err := printReport(io.Discard, tt.query, tt.args, time.Now()); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// fakeSqlite3 puts a sqlite3 in $PATH that copies its input to the file it
+// returns.
+func fakeSqlite3(t *testing.T) string {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "input.sql")
+	script := "#!/bin/sh\ncat > " + out + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "sqlite3"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	return out
+}
+
+// TestHistoryDB checks what is written to sqlite3 over a run: the schema,
+// then a transaction per scan with the events since the last one.
+func TestHistoryDB(t *testing.T) {
+	out := fakeSqlite3(t)
+	start := time.UnixMilli(1_000_000)
+	h, err := openHistoryDB(filepath.Join(t.TempDir(), "history.db"), start, "make -j8 'all'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.event(event{Time: start.Add(time.Second), Type: "throttle", PID: 42, Comm: "cc1plus", Vsz: 1 << 30, Reason: "over limit"})
+	if err := h.sample(start.Add(2*time.Second), status{VszLimit: unlimited, Vsz: 3 << 30, Rss: 1 << 30, Running: 2, Stopped: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.close(start.Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.TrimPrefix(string(data), historySchema)
+	if got == string(data) {
+		t.Fatalf("schema not written first:\n%s", data)
+	}
+	run := itoa(start.UnixNano())
+	want := "BEGIN;\nINSERT INTO runs (id, start, command) VALUES (" + run + ", 1000000, 'make -j8 ''all''');\nCOMMIT;\n" +
+		"BEGIN;\nINSERT INTO events VALUES (" + run + ", 1001000, 'throttle', 42, 'cc1plus', 1073741824, '', '', 'over limit');\n" +
+		"INSERT INTO samples VALUES (" + run + ", 1002000, 3221225472, 1073741824, 0, 0, NULL, 2, 1);\nCOMMIT;\n" +
+		"BEGIN;\nUPDATE runs SET end = 1003000 WHERE id = " + run + ";\nCOMMIT;\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// TestHistoryDBWithoutSqlite3 checks that a missing sqlite3 is reported as
+// such.
+func TestHistoryDBWithoutSqlite3(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, err := openHistoryDB(filepath.Join(t.TempDir(), "history.db"), time.Now(), "make"); err == nil || !strings.Contains(err.Error(), "sqlite3") {
+		t.Errorf("got error %v, want one about sqlite3", err)
+	}
+}
@@ -0,0 +1,146 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Points at which -hook commands can run. Pre hooks run before memlimit
+// acts and hold it up until they finish, within preHookBudget; the others
+// run in the background.
+var hookNames = map[string]bool{
+	"pre-stop":    true,
+	"post-stop":   true,
+	"pre-resume":  true,
+	"target-exit": true,
+}
+
+// How long a hook may run before it is killed, and how long pre hooks may
+// hold up a scan in all, memlimit holding its lock while they run. Pre hooks
+// that don't fit in the budget run in the background, like the others.
+const (
+	hookTimeout   = 5 * time.Second
+	preHookBudget = time.Second
+)
+
+// hookFlag is the commands of -hook, by hook name.
+type hookFlag map[string][]string
+
+func (f *hookFlag) String() string {
+	return fmt.Sprint(len(*f), " hooks")
+}
+
+func (f *hookFlag) Set(value string) error {
+	name, cmd, ok := strings.Cut(value, "=")
+	if !ok || cmd == "" {
+		return fmt.Errorf("want hook=command, got %q", value)
+	}
+	if !hookNames[name] {
+		names := make([]string, 0, len(hookNames))
+		for name := range hookNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown hook %q, want one of %s", name, strings.Join(names, ", "))
+	}
+	if *f == nil {
+		*f = make(hookFlag)
+	}
+	(*f)[name] = append((*f)[name], cmd)
+	return nil
+}
+
+// hooks runs the -hook commands.
+type hooks struct {
+	cmds hookFlag
+	// The monitor's clock, that pre hooks are timed on.
+	clock clock
+	// Hooks running in the background, to wait for before exiting.
+	running sync.WaitGroup
+	// Until when pre hooks may hold up the current scan, and whether one
+	// was already sent to the background because they ran past it.
+	preDeadline time.Time
+	overBudget  bool
+}
+
+// startScan gives the pre hooks of a scan, or of another batch of actions
+// taken under the lock, preHookBudget to run in.
+func (h *hooks) startScan() {
+	if h != nil {
+		h.preDeadline, h.overBudget = h.clock.Now().Add(preHookBudget), false
+	}
+}
+
+// run runs the commands of hook name for e, if any, with sh -c. They get
+// e as JSON on stdin, and its main fields in MEMLIMIT_HOOK_* environment
+// variables, named apart from the MEMLIMIT_<FLAG> ones setting flags.
+func (h *hooks) run(name string, e event) {
+	if h == nil || len(h.cmds[name]) == 0 {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	env := append(os.Environ(),
+		"MEMLIMIT_HOOK_NAME="+name,
+		"MEMLIMIT_HOOK_EVENT="+e.Type,
+		"MEMLIMIT_HOOK_PID="+strconv.Itoa(e.PID),
+		"MEMLIMIT_HOOK_COMM="+e.Comm,
+		"MEMLIMIT_HOOK_VSZ="+strconv.FormatUint(e.Vsz, 10),
+		"MEMLIMIT_HOOK_REASON="+e.Reason,
+	)
+	for _, cmd := range h.cmds[name] {
+		if strings.HasPrefix(name, "pre-") {
+			if left := h.preDeadline.Sub(h.clock.Now()); left > 0 {
+				if left > hookTimeout {
+					left = hookTimeout
+				}
+				runHook(name, cmd, env, data, left)
+				continue
+			}
+			if !h.overBudget {
+				log.Printf("Pre hooks took over %v in this scan, running the rest in the background", preHookBudget)
+				h.overBudget = true
+			}
+		}
+		h.running.Add(1)
+		go func(cmd string) {
+			defer h.running.Done()
+			runHook(name, cmd, env, data, hookTimeout)
+		}(cmd)
+	}
+}
+
+// wait waits for the hooks running in the background.
+func (h *hooks) wait() {
+	if h != nil {
+		h.running.Wait()
+	}
+}
+
+func runHook(name, command string, env []string, stdin []byte, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); ctx.Err() != nil {
+		log.Printf("Hook %s %q killed after %v", name, command, timeout.Round(time.Millisecond))
+	} else if err != nil {
+		log.Printf("Hook %s %q failed: %v", name, command, err)
+	}
+}
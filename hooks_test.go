@@ -0,0 +1,39 @@
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPreHookBudget checks that pre hooks hold up a scan for preHookBudget
+// on the monitor's clock, and run in the background past it.
+func TestPreHookBudget(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := &hooks{cmds: hookFlag{"pre-stop": {"true"}}, clock: clock}
+	defer h.wait()
+
+	h.startScan()
+	if want := clock.Now().Add(preHookBudget); !h.preDeadline.Equal(want) {
+		t.Fatalf("pre hooks may run until %v, want %v", h.preDeadline, want)
+	}
+	h.run("pre-stop", event{Type: "throttle"})
+	if h.overBudget {
+		t.Errorf("pre hook run in the background within the budget")
+	}
+	clock.Sleep(preHookBudget)
+	h.run("pre-stop", event{Type: "throttle"})
+	if !h.overBudget {
+		t.Errorf("pre hook held up the scan past the budget")
+	}
+	h.startScan()
+	if h.overBudget {
+		t.Errorf("budget not renewed by the next scan")
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How recently another instance has to have written its state file to count
+// against the host limit. Instances that stopped writing it are taken to
+// have died.
+const peerStale = 10 * time.Second
+
+// shareHost sets the limit of the host budget to what the other instances
+// writing their state to lockDir leave of hostLimit, going by the memory of
+// the processes they let run as of their last scans. Each instance gets at
+// least an equal share, so that instances over their share all yield rather
+// than taking turns.
+func (m *monitor) shareHost() {
+	paths, err := filepath.Glob(filepath.Join(m.lockDir, "*.json"))
+	if err != nil {
+		return
+	}
+	var used uint64
+	var peers int
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var st persistedState
+		if err := json.Unmarshal(data, &st); err != nil || st.PID == os.Getpid() || m.now.Sub(st.Updated) > peerStale {
+			continue
+		}
+		used += st.RunningVsz
+		peers++
+	}
+
+	limit := m.hostLimit / uint64(peers+1)
+	if used < m.hostLimit && m.hostLimit-used > limit {
+		limit = m.hostLimit - used
+	}
+	if peers != m.peers {
+		log.Printf("Sharing the %s host limit with %d other memlimit instances", formatSize(m.hostLimit), peers)
+	}
+	m.peers, m.host.limit = peers, limit
+}
@@ -0,0 +1,143 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// jobserver is a GNU make jobserver the command to run is given, through
+// which memlimit lowers the parallelism of make as memory fills up rather
+// than stopping the jobs it starts. It withholds tokens in proportion to
+// the share of the overall limit in use, and puts them back as usage falls.
+type jobserver struct {
+	// The -j the command runs with.
+	jobs int
+	// The ends of the pipe passed to the command.
+	r, w *os.File
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// How many tokens to withhold, and those taken out of the pipe so far,
+	// to write back as read.
+	want int
+	held []byte
+	// The effective -j as of the last adjust.
+	reported int
+}
+
+// newJobserver returns a jobserver for -j jobs, with one token fewer than
+// jobs in the pipe as make's own job needs none.
+func newJobserver(jobs int) (*jobserver, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	j := &jobserver{jobs: jobs, r: r, w: w, reported: jobs}
+	j.cond = sync.NewCond(&j.mu)
+	for i := 1; i < jobs; i++ {
+		j.held = append(j.held, '+')
+	}
+	if j.put(); len(j.held) > 0 {
+		r.Close()
+		w.Close()
+		return nil, errors.New("can't write tokens to the pipe")
+	}
+	go j.take()
+	return j, nil
+}
+
+// share passes the jobserver to cmd, as the file descriptors named in
+// MAKEFLAGS.
+func (j *jobserver) share(cmd *exec.Cmd) {
+	fds := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, j.r, j.w)
+	flags := fmt.Sprintf("-j%d --jobserver-auth=%d,%d", j.jobs, fds, fds+1)
+	if v := os.Getenv("MAKEFLAGS"); v != "" {
+		flags = v + " " + flags
+	}
+	cmd.Env = append(os.Environ(), "MAKEFLAGS="+flags)
+}
+
+// take takes tokens out of the pipe while fewer than want are held. Tokens
+// in use only come back as jobs finish, and make takes them again right
+// away, so it waits for them in the pipe along with make rather than
+// trying once a scan.
+func (j *jobserver) take() {
+	// Fd puts the pipe in blocking mode.
+	fd := int(j.r.Fd())
+	buf := make([]byte, 1)
+	for {
+		j.mu.Lock()
+		for len(j.held) >= j.want {
+			j.cond.Wait()
+		}
+		j.mu.Unlock()
+
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || n == 0 {
+			return
+		}
+		j.mu.Lock()
+		j.held = append(j.held, buf[0])
+		// want may have dropped while waiting.
+		j.put()
+		j.mu.Unlock()
+	}
+}
+
+// put writes back the tokens held beyond want. Writes this small to a pipe
+// are all or nothing.
+func (j *jobserver) put() {
+	if len(j.held) <= j.want {
+		return
+	}
+	if _, err := syscall.Write(int(j.w.Fd()), j.held[j.want:]); err == nil {
+		j.held = j.held[:j.want]
+	}
+}
+
+// effective returns the -j the command is left with.
+func (j *jobserver) effective() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jobs - len(j.held)
+}
+
+// adjust sets the tokens to withhold to the share of b's limit in use, of
+// those there are, and returns the effective -j and whether it changed
+// since the last adjust.
+func (j *jobserver) adjust(b *budget) (jobs int, changed bool) {
+	want := 0
+	if b.limit != unlimited && b.limit > 0 {
+		used := float64(b.vsz) / float64(b.limit)
+		if used > 1 {
+			used = 1
+		}
+		want = int(used * float64(j.jobs-1))
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.want = want
+	j.put()
+	j.cond.Signal()
+	jobs = j.jobs - len(j.held)
+	changed, j.reported = jobs != j.reported, jobs
+	return jobs, changed
+}
+
+// adjustJobs withholds jobserver tokens for the memory in use, logging
+// changes of the effective -j.
+func (m *monitor) adjustJobs() {
+	if jobs, changed := m.jobserver.adjust(&m.global); changed {
+		m.emit(event{Time: m.now, Type: "jobs", Vsz: m.global.vsz, Reason: fmt.Sprintf("make left with -j%d of -j%d at %s of the %s overall limit", jobs, m.jobserver.jobs, formatSize(m.global.vsz), formatSize(m.global.limit))})
+	}
+}
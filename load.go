@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkLoad sets how many filtered processes -max-load lets run. Once the
+// 1-minute load average exceeds it, the filtered processes running are cut
+// by the excess, and cut again each time the load rises by another 1 while
+// over, as the average lags what throttling does to it. All of them may
+// run again once it falls back under.
+func (m *monitor) checkLoad(procs []tracked) {
+	load, err := loadAvg()
+	if err != nil {
+		return
+	}
+	m.load = load
+	if load <= m.maxLoad {
+		if m.loadSlots != 0 {
+			m.emit(event{Time: m.now, Type: "load", Reason: fmt.Sprintf("1-minute load average %.2f back under -max-load %.2f", load, m.maxLoad)})
+		}
+		m.loadSlots = 0
+		return
+	}
+	if m.loadSlots != 0 && load < m.loadSlotsAt+1 {
+		return
+	}
+	running := 0
+	for _, p := range procs {
+		if !m.thr.throttled(p.stat) && !m.unmanaged.has(p.stat) {
+			running++
+		}
+	}
+	slots := running - int(math.Ceil(load-m.maxLoad))
+	if slots < 1 {
+		slots = 1
+	}
+	if m.loadSlots != 0 && slots >= m.loadSlots {
+		return
+	}
+	m.emit(event{Time: m.now, Type: "load", Reason: fmt.Sprintf("1-minute load average %.2f exceeds -max-load %.2f, letting %d of %d filtered processes run", load, m.maxLoad, slots, running)})
+	m.loadSlots, m.loadSlotsAt = slots, load
+}
+
+// loadAvg returns the 1-minute load average from /proc/loadavg.
+func loadAvg() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// How long the top-level processes are paused for -max-stopped before the
+// largest process held back by it is killed, for the jobs already running
+// to finish meanwhile.
+const maxStoppedGrace = 5 * time.Second
+
+// overMaxStopped deals with m.heldBack, the processes the policy would have
+// throttled but for -max-stopped: parking more memory in swap doesn't help,
+// so the top-level processes are paused instead, stopping new jobs from
+// being spawned. If processes are still held back after maxStoppedGrace, the
+// largest of them is killed, one at a time.
+func (m *monitor) overMaxStopped(stats map[int]procfs.ProcStat, procs []tracked) {
+	if len(m.heldBack) == 0 {
+		if !m.heldSince.IsZero() {
+			m.heldSince = time.Time{}
+			m.pauseTops(stats, false, "no longer over -max-stopped")
+		}
+		return
+	}
+	reason := fmt.Sprintf("%d more processes over limit with the -max-stopped %d already throttled", len(m.heldBack), m.maxStopped)
+	if m.heldSince.IsZero() {
+		m.heldSince = m.now
+	}
+	m.pauseTops(stats, true, reason)
+	if m.now.Sub(m.heldSince) < maxStoppedGrace {
+		return
+	}
+
+	var victim procfs.ProcStat
+	for _, p := range procs {
+		if m.killed.has(p.stat) && p.stat.State != "Z" {
+			// Wait for it to exit.
+			return
+		}
+	}
+	for _, stat := range m.heldBack {
+		if stat.VirtualMemory() > victim.VirtualMemory() {
+			victim = stat
+		}
+	}
+	m.terminate(victim, syscall.SIGKILL, fmt.Sprintf("%s, and pausing the top-level processes didn't help within %v", reason, m.now.Sub(m.heldSince).Round(time.Second)))
+	m.heldSince = m.now
+}
+
+// pauseTops pauses or unpauses the top-level processes of the trees.
+func (m *monitor) pauseTops(stats map[int]procfs.ProcStat, pause bool, reason string) {
+	for _, t := range m.trees {
+		top, ok := stats[t.pid]
+		if !ok || m.topThr.throttled(top) == pause {
+			continue
+		}
+		if pause {
+			m.emit(m.newEvent("pause", top, 0, reason))
+			if err := m.topThr.throttle(top); err != nil {
+				log.Printf("Error pausing %d %s: %v", top.PID, top.Comm, err)
+			} else {
+				m.summary.pauses++
+			}
+		} else {
+			m.emit(m.newEvent("unpause", top, 0, reason))
+			if err := m.topThr.release(top); err != nil {
+				log.Printf("Error unpausing %d %s: %v", top.PID, top.Comm, err)
+			}
+		}
+	}
+}
@@ -3,11 +3,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
-	"sort"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -32,6 +41,98 @@ func getProcStats() (map[int]procfs.ProcStat, error) {
 	return stats, nil
 }
 
+// getTreeStats returns stats for the trees rooted at roots only, following
+// /proc/<pid>/task/<tid>/children rather than reading every process on the
+// system. Processes that exit mid-walk are skipped.
+func getTreeStats(roots []int) (map[int]procfs.ProcStat, error) {
+	stats := make(map[int]procfs.ProcStat)
+
+	queue := append([]int(nil), roots...)
+	var pid int
+	for len(queue) > 0 {
+		pid, queue = queue[0], queue[1:]
+		if _, ok := stats[pid]; ok {
+			continue
+		}
+
+		proc, err := procfs.NewProc(pid)
+		if err != nil {
+			continue
+		}
+		stat, err := proc.Stat()
+		if err != nil {
+			continue
+		}
+		stats[pid] = stat
+
+		tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err != nil {
+			continue
+		}
+		for _, task := range tasks {
+			children, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, task.Name()))
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("kernel lacks /proc/<pid>/task/<tid>/children (CONFIG_PROC_CHILDREN)")
+			} else if err != nil {
+				continue
+			}
+			for _, f := range strings.Fields(string(children)) {
+				if child, err := strconv.Atoi(f); err == nil {
+					queue = append(queue, child)
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// refreshMemory returns the processes in pids with their stats from prev,
+// except for state, CPU time, VSZ and RSS, which are re-read from
+// /proc/<pid>/stat without parsing the rest of it. /proc/<pid>/statm would
+// be cheaper to read, but has neither the state, which has to be current for
+// processes stopped or continued since the last full scan to be seen as
+// such, nor the CPU time, which -sort-by cputime goes by. Processes that
+// have exited are left out.
+func refreshMemory(prev map[int]procfs.ProcStat, pids []int) map[int]procfs.ProcStat {
+	stats := make(map[int]procfs.ProcStat, len(pids))
+	for _, pid := range pids {
+		stat, ok := prev[pid]
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// Fields from the state on, after the comm, which may contain
+		// spaces and parentheses.
+		i := bytes.LastIndexByte(data, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		utime, err1 := strconv.ParseUint(fields[11], 10, 64)
+		stime, err2 := strconv.ParseUint(fields[12], 10, 64)
+		starttime, err3 := strconv.ParseUint(fields[19], 10, 64)
+		size, err4 := strconv.ParseUint(fields[20], 10, 64)
+		resident, err5 := strconv.ParseUint(fields[21], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || starttime != stat.Starttime {
+			continue
+		}
+		stat.State = fields[0]
+		stat.UTime = uint(utime)
+		stat.STime = uint(stime)
+		stat.VSize = size
+		stat.RSS = resident
+		stats[pid] = stat
+	}
+	return stats
+}
+
 func getPidMap(stats map[int]procfs.ProcStat) map[int][]int {
 	children := make(map[int][]int, len(stats))
 	for _, s := range stats {
@@ -41,149 +142,794 @@ func getPidMap(stats map[int]procfs.ProcStat) map[int][]int {
 	return children
 }
 
-// List of process names that are allowed to be stopped.
-var whitelistedProcesses = map[string]bool{
-	"cc1plus": true,
-	"cc1":     true,
-	"ar":      true,
-	"as":      true,
-	"ld":      true,
+// treeFlag collects -tree values of the form pid[:vsz-limit-mb].
+type treeFlag []*tree
+
+func (f *treeFlag) String() string {
+	return fmt.Sprint(len(*f), " trees")
 }
 
-func toMB(sz uint64) uint64 {
-	return sz / 1024 / 1024
+func (f *treeFlag) Set(value string) error {
+	pidStr, limitStr, hasLimit := strings.Cut(value, ":")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return err
+	}
+	limit := uint64(unlimited)
+	if hasLimit {
+		if limit, err = parseSize(limitStr); err != nil {
+			return err
+		}
+	}
+	*f = append(*f, newTree(pid, limit))
+	return nil
+}
+
+// setFlagsFromEnv sets flags from MEMLIMIT_<FLAG> environment variables,
+// e.g. -vsz-limit-mb from MEMLIMIT_VSZ_LIMIT_MB, for the command line to
+// override.
+func setFlagsFromEnv() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "MEMLIMIT_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := flag.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%s: %v", name, setErr)
+			}
+		}
+	})
+	return err
 }
 
 func main() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
 
 	var flagPid int
-	var flagVszLimitMb uint64
+	var flagVszLimit sizeFlag = 1 << 30
+	var flagLTOVszLimit sizeFlag = 4 << 30
 	var flagCheckInterval time.Duration
 	var flagVerbose bool
 	var flagResumeLimit int
+	var flagSignalLimit int
+	var flagMode string
+	var flagSqueezeCPUs string
+	var flagPauseTop bool
+	var flagProfile string
+	var flagBazel bool
+	var flagMatchExe string
+	var flagMatchName string
+	var flagTrees treeFlag
+	var flagAttach attachFlag
+	var flagListen string
+	var flagAPITokenFile string
+	var flagStateDir string
+	var flagPidFile string
+	var flagSandbox bool
+	var flagRecordTrace string
+	var flagHistoryDB string
+	var flagAuditLog string
+	var flagMemoryDB string
+	var flagReplay string
+	var flagReportOverhead bool
+	var flagWalk string
+	var flagFullScanEvery int
+	var flagLogHeartbeat time.Duration
+	var flagTUI bool
+	var flagSortBy string
+	var flagPolicyScript string
+	var flagSortDesc bool
+	var flagKeepNewest bool
+	var flagWarnVszLimit sizeFlag
+	var flagHardVszLimit sizeFlag
+	var flagEscalate string
+	var flagPerProcVszLimit sizeFlag
+	var flagMinVszLimit sizeFlag
+	var flagNodeLimit sizeFlag
+	var flagNUMAPlace bool
+	var flagCgroup string
+	var flagPageOutStopped time.Duration
+	var flagMinAge time.Duration
+	var flagResumeGrace time.Duration
+	var flagSmooth time.Duration
+	var flagCgroupSwapMax string
+	var flagMaxVszLimit sizeFlag
+	var flagPerProcAction string
+	var flagProtectUnfiltered bool
+	var flagStopJVMDaemons bool
+	var flagNotify bool
+	var flagDBus string
+	var flagHooks hookFlag
+	var flagConfig string
+	var flagMaxLinkers int
+	var flagMaxLoad float64
+	var flagMaxStopped int
+	var flagPauseNinja bool
+	var flagJobserver int
+	var flagHostVszLimit sizeFlag
+	var flagReportTo string
 	flag.IntVar(&flagPid, "pid", 0, "PID of top-level process in process tree to track")
-	flag.Uint64Var(&flagVszLimitMb, "vsz-limit-mb", 1024, "VSZ limit of non-stopped filtered processes")
+	flag.Var(&flagTrees, "tree", "Additional top-level process to track, as pid[:vsz-limit-mb] (repeatable)")
+	flag.Var(&flagAttach, "attach", "Keep running, tracking each new process with this name (and owner) as the top-level process of a tree of its own, as name[@user][:vsz-limit-mb], e.g. ninja@buildbot:24G (repeatable)")
+	flag.Var(&flagVszLimit, "vsz-limit-mb", "VSZ limit of non-stopped filtered processes, across all tracked trees")
+	flag.Var(&flagLTOVszLimit, "lto-vsz-limit-mb", "Separate VSZ limit of non-stopped LTO link processes")
 	flag.DurationVar(&flagCheckInterval, "check-interval", 250*time.Millisecond, "Interval between consecutive procfs scans")
 	flag.BoolVar(&flagVerbose, "verbose", false, "Verbose logging")
 	flag.IntVar(&flagResumeLimit, "resume-limit", math.MaxInt, "Number of processes to resume in one interval")
+	flag.IntVar(&flagSignalLimit, "signal-limit", math.MaxInt, "Number of processes to throttle or resume in one interval, spreading larger changes over several intervals; kills are not limited")
+	flag.StringVar(&flagMode, "mode", "stop", "Action applied to over-limit processes: stop (SIGSTOP), nice (renice to +19), idle (SCHED_IDLE) or affinity (pin to -squeeze-cpus)")
+	flag.StringVar(&flagSqueezeCPUs, "squeeze-cpus", "0", "CPU list over-limit processes are confined to in affinity mode")
+	flag.BoolVar(&flagPauseTop, "pause-top", false, "Stop the top-level process instead of filtered processes when over limit, letting in-flight jobs finish")
+	flag.StringVar(&flagProfile, "profile", "gcc", "Toolchain whose processes may be stopped, and which are charged a share of their VSZ where the toolchain reserves far more than it uses, and at least an estimate of their peak from the start: "+strings.Join(profileNames(), ", "))
+	flag.BoolVar(&flagBazel, "bazel", false, "Instead of tracking anything, run the bazel command line given after the flags with --local_ram_resources set to -vsz-limit-mb if given, capped by the memory available (MemAvailable), as Bazel runs its actions under its server, outside of any tree memlimit could track. Only build, test, run and coverage get it, once as they start: it is not adjusted as memory frees up or runs out")
+	flag.StringVar(&flagMatchExe, "match-exe", "", "Comma-separated globs of executable paths that may be stopped, e.g. /usr/lib/gcc/*/cc1plus")
+	flag.StringVar(&flagMatchName, "match-name", "", "Comma-separated process names that may be stopped on top of those of -profile, where * matches any run of characters, e.g. *-cc1plus,*-linux-gnu-as for cross toolchains")
+	flag.StringVar(&flagListen, "listen", "", "Serve the HTTP/JSON control API, and a web dashboard at /, on this unix socket path (created accessible to our user only) or host:port (loopback if just :port, and requiring -api-token-file), unless socket-activated by systemd")
+	flag.StringVar(&flagAPITokenFile, "api-token-file", "", "File holding the token that clients of the control API or aggregator on TCP must send, as Authorization: Bearer <token> (or, for the dashboard, by opening /?token=<token>); the commands and -report-to talking to one send it too")
+	flag.StringVar(&flagStateDir, "state-dir", "/run/memlimit", "Directory to keep the <pid>.json state file in, empty to disable")
+	flag.StringVar(&flagPidFile, "pidfile", "", "Write our PID to this file, refusing to start if another instance holds it")
+	flag.BoolVar(&flagSandbox, "sandbox", false, "Confine memlimit with seccomp, and with Landlock where the kernel supports it, once started (requires a CGO_ENABLED=0 build)")
+	flag.StringVar(&flagRecordTrace, "record-trace", "", "Record every scan of the tracked trees to this file")
+	flag.StringVar(&flagHistoryDB, "history-db", "", "Record the memory of every scan and every event in this SQLite database (through the sqlite3 command, which has to be in $PATH), across runs, for memlimit -history-db file report or any SQLite client to query")
+	flag.StringVar(&flagAuditLog, "audit-log", "", "Append a JSON line to this file for every signal sent to a tracked process: time, PID, starttime, comm, signal, reason and the state of the process right after")
+	flag.StringVar(&flagMemoryDB, "memory-db", "", "Learn the peak memory of compile jobs by source file, compiler and flags in this file across builds, charging jobs seen before their last peak VSZ from the start; memlimit -memory-db file expensive lists the most expensive")
+	flag.StringVar(&flagReplay, "replay", "", "Run the policy over a trace recorded with -record-trace, without signalling anything, and exit")
+	flag.BoolVar(&flagReportOverhead, "report-overhead", false, "Measure scan latency, CPU usage and allocations, and print them at exit (including on SIGINT/SIGTERM)")
+	flag.StringVar(&flagWalk, "walk", "all", "How to find tracked processes: all (scan every process) or children (follow /proc/<pid>/task/<tid>/children from the top-level processes)")
+	flag.IntVar(&flagFullScanEvery, "full-scan-every", 1, "Only do a full scan every this many intervals; in between, just re-read the state, CPU time and memory of known processes")
+	flag.DurationVar(&flagLogHeartbeat, "log-heartbeat", time.Minute, "In verbose mode, log the process table at least this often even if nothing changed (0 logs every scan)")
+	flag.BoolVar(&flagTUI, "tui", false, "Show a live full-screen view of the tracked processes instead of the status line (* marks throttled, ! unmanaged processes)")
+	flag.StringVar(&flagSortBy, "sort-by", "starttime", "Order in which processes are let run, the last ones being throttled first: starttime, vsz, rss, cputime or growth (VSZ growth rate over the last 10s, in MiB/s)")
+	flag.StringVar(&flagPolicyScript, "policy-script", "", "File of rules, as name = Go-style expression over each process and the scan, that order processes (order), throttle them regardless of the limits (stop) or let them run regardless (run), for policies the other flags can't express")
+	flag.BoolVar(&flagSortDesc, "sort-desc", false, "Reverse -sort-by, e.g. to let the largest processes run first")
+	flag.BoolVar(&flagKeepNewest, "keep-newest", false, "Keep the most recently started processes running and throttle the oldest first, e.g. for pipelined builds whose consumers need the newest producers to finish (same as -sort-by starttime -sort-desc)")
+	flag.Var(&flagWarnVszLimit, "warn-vsz-limit-mb", "Only log a warning (and record an event) when the overall VSZ crosses this, as early warning of throttling; 0 disables")
+	flag.Var(&flagHardVszLimit, "hard-vsz-limit-mb", "Kill the largest filtered process when the total VSZ, including LTO links and throttled processes, exceeds this; 0 disables")
+	flag.StringVar(&flagEscalate, "escalate", "", "Signals for the last throttled process in victim order under each limit still exceeded, as comma-separated delay:signal steps, e.g. 60s:TERM,30s:KILL; the first delay counts from when it was throttled, and a process surviving a signal is throttled again")
+	flag.Var(&flagPerProcVszLimit, "per-proc-vsz-limit-mb", "VSZ limit of any single filtered process, regardless of the other limits; 0 disables")
+	flag.StringVar(&flagPerProcAction, "per-proc-action", "term", "What to do with a process over -per-proc-vsz-limit-mb: term (SIGTERM), kill (SIGKILL) or stop (throttle it until it is back under)")
+	flag.Var(&flagMinVszLimit, "min-vsz-limit-mb", "Let -vsz-limit-mb shrink down to this under memory pressure (PSI) or while other workloads leave little memory available; 0 to keep it from shrinking")
+	flag.Var(&flagMaxVszLimit, "max-vsz-limit-mb", "Let -vsz-limit-mb grow up to this while the system is otherwise idle; 0 to keep it from growing")
+	flag.Var(&flagNodeLimit, "node-limit-mb", "Limit on the memory filtered processes have on any one NUMA node (from numa_maps), throttling processes on a node over it; 0 disables")
+	flag.BoolVar(&flagNUMAPlace, "numa-place", false, "When running a command, bind the filtered processes it spawns to NUMA nodes in turn to spread their memory, skipping nodes over -node-limit-mb")
+	flag.StringVar(&flagCgroup, "cgroup", "", "When running a command, run it in this cgroup v2 (created if needed), e.g. one delegated by systemd, given as a path under /sys/fs/cgroup")
+	flag.StringVar(&flagCgroupSwapMax, "cgroup-swap-max-mb", "", "Set memory.swap.max of -cgroup to this size (or max), so a throttled build can't use up all swap")
+	flag.DurationVar(&flagMinAge, "min-age", 0, "Leave filtered processes running until they are this old (counted from when first seen), as short-lived ones like most runs of as exit before throttling them pays off; 0 throttles processes of any age")
+	flag.DurationVar(&flagResumeGrace, "resume-grace", 0, "Leave a released process running for at least this long before throttling it again, so processes don't flap while usage hovers at the limit; 0 disables")
+	flag.DurationVar(&flagSmooth, "smooth", 0, "Average the VSZ and RSS of filtered processes over this window (EWMA) before comparing them against limits, so that a spike lasting a scan or two, e.g. a transient mmap while linking, doesn't throttle anything; 0 disables")
+	flag.DurationVar(&flagPageOutStopped, "page-out-stopped", 0, "Once a process has been held stopped this long, have the kernel page out its memory (process_madvise MADV_PAGEOUT, Linux 5.10+, requires CAP_SYS_NICE), so that its pages are reclaimed before those of running processes; 0 disables")
+	flag.Var(&flagHooks, "hook", "Run this command with sh -c at a point in the life of throttled processes, as hook=command where hook is pre-stop, post-stop, pre-resume or target-exit (a top-level process exiting); it gets the event as JSON on stdin and in MEMLIMIT_HOOK_* environment variables, pre hooks hold up the action until they finish (up to 1s in all per scan, after which they run in the background), and all are killed after 5s (repeatable)")
+	flag.StringVar(&flagDBus, "dbus", "", "Export the org.memlimit.Monitor D-Bus interface, with properties for current usage and Pause and Resume methods for enforcement, on the session or system bus; the system bus needs a policy file letting memlimit own the name")
+	flag.BoolVar(&flagNotify, "notify", false, "Show a desktop notification (org.freedesktop.Notifications on the session D-Bus) when processes start being throttled, and when one is signalled to exit by -hard-vsz-limit-mb, -per-proc-vsz-limit-mb or -escalate")
+	flag.BoolVar(&flagStopJVMDaemons, "stop-jvm-daemons", false, "Throttle Gradle, Kotlin and mvnd daemons like other filtered processes; by default their memory counts against the limits but they are never stopped, as later builds would hang on them")
+	flag.BoolVar(&flagProtectUnfiltered, "protect-unfiltered", false, "Lower oom_score_adj of unfiltered processes such as make and shells, so the OOM killer picks a compiler over them (requires CAP_SYS_RESOURCE)")
+	flag.BoolVar(&flagPauseNinja, "pause-ninja", false, "While processes are held throttled, also stop the ninja processes in the tracked trees so they start no new jobs")
+	flag.IntVar(&flagJobserver, "jobserver", 0, "Run the command as make -jN through a jobserver of ours, withholding tokens from it in proportion to the share of the overall limit in use, so that make runs fewer jobs as memory fills up rather than having them throttled; don't also pass -j to make; 0 disables")
+	flag.IntVar(&flagMaxStopped, "max-stopped", 0, "Throttle at most this many processes at once; past that, pause the top-level processes so no new jobs start, and if processes are still over limit after 5s, kill the largest of them, one at a time; 0 throttles any number")
+	flag.Float64Var(&flagMaxLoad, "max-load", 0, "Once the 1-minute load average exceeds this, throttle filtered processes in victim order on top of those throttled for memory, cutting the ones running by the excess, until it falls back under; 0 disables")
+	flag.IntVar(&flagMaxLinkers, "max-linkers", 0, "Let at most this many linkers (ld, lld, mold, Go's link) run at once across the tracked trees, throttling the others until one exits, regardless of memory; 0 lets any number run")
+	flag.Var(&flagHostVszLimit, "host-vsz-limit-mb", "VSZ limit of the non-stopped filtered processes of all memlimit instances sharing -state-dir, each getting what the others leave and at least an equal share; 0 disables")
+	flag.StringVar(&flagReportTo, "report-to", "", "Report our status every 10s to the memlimit aggregate instance at this host:port or unix socket path")
+	flag.StringVar(&flagConfig, "config", "", "Read flags from this file, one per line as name value, for the environment and the command line to override; -vsz-limit-mb, -lto-vsz-limit-mb, -profile, -match-exe, -match-name and -sort-by are reapplied when it changes or on SIGHUP, and can be set differently for the compile and link phases of the build in [compile] and [link] sections")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args...]]\n       %s [flags] doctor\n       %s [flags] attach [-limit size]\n       %s -listen addr reserve -size size command [args...]\n       %s -listen addr aggregate\n       %s -listen addr top-fleet\n       %s -memory-db file expensive\n       %s [-listen addr] explain pid\n       %s [flags] simulate -trace file [-vsz-limit size] [-lto-vsz-limit size] [-policy policy]\n\nTracks the given command, or the processes given by -pid and -tree, and\nthe ones that -attach matches as they start.\nThe doctor command instead checks that this would work with the given flags.\nThe attach command has the calling shell tracked, by the instance serving\n-listen if given, and otherwise by a new one started in the background.\nThe reserve command waits for the instance serving -listen to reserve size\nunder its overall limit, and runs the command with it.\nThe aggregate command collects the reports of instances run with -report-to\non -listen, and the top-fleet command shows those of the aggregator there.\nThe expensive command lists the compile jobs that took the most memory, as\nlearned in -memory-db.\nThe explain command shows why a process is stopped or running, as told by\nthe instance serving -listen, or else by the state files in -state-dir.\nThe simulate command replays a trace recorded with -record-trace under other\nlimits or victim orders, and reports how often and for how long processes\nwould have been throttled.\n\n", os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nEach flag can also be set by a MEMLIMIT_<FLAG> environment variable, e.g. MEMLIMIT_VSZ_LIMIT_MB.")
+		fmt.Fprintln(flag.CommandLine.Output(), "Sizes take a K, M, G or T suffix (optionally followed by B or iB, all binary), e.g. 4GiB or 0.5T; a bare number is in megabytes.")
+	}
+	if err := setFlagsFromEnv(); err != nil {
+		log.Fatalln("Invalid environment variable", err)
+	}
 	flag.Parse()
 
-	for true {
-		stats, err := getProcStats()
+	if flagBazel {
+		if flag.NArg() == 0 {
+			log.Fatalln("-bazel requires a bazel command line")
+		}
+		limit := uint64(unlimited)
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "vsz-limit-mb" {
+				limit = uint64(flagVszLimit)
+			}
+		})
+		log.Fatalln("Error running bazel:", execBazel(flag.Args(), limit))
+	}
+
+	var apiToken string
+	if flagAPITokenFile != "" {
+		var err error
+		if apiToken, err = readToken(flagAPITokenFile); err != nil {
+			log.Fatalln("Error reading -api-token-file:", err)
+		}
+	}
+
+	var configFile *liveConfig
+	if flagConfig != "" {
+		c, phases, err := readConfig(flagConfig)
 		if err != nil {
-			log.Println("Error listing procs", err)
-			continue
+			log.Fatalln("Error reading -config:", err)
+		}
+		fixed, err := setFlagsFromConfig(c)
+		if err != nil {
+			log.Fatalf("Invalid flag in %s: %v", flagConfig, err)
 		}
+		configFile = &liveConfig{path: flagConfig, fixed: fixed, applied: c, phases: phases}
+	}
 
-		if _, ok := stats[flagPid]; !ok {
-			log.Printf("Process %d not found. Exiting", flagPid)
-			return
+	var simulated string
+	if flag.NArg() > 0 && flag.Arg(0) == "simulate" {
+		var err error
+		if simulated, err = parseSimulate(flag.Args()[1:]); err != nil {
+			log.Fatalln("Invalid simulate:", err)
 		}
+	}
 
-		if err == nil {
-			pmap := getPidMap(stats)
+	var ok bool
+	if whitelistedProcesses, ok = profiles[flagProfile]; !ok {
+		log.Fatalf("Unknown -profile %q", flagProfile)
+	}
+	processCharges = profileCharges[flagProfile]
+	exes, err := parseMatchExe(flagMatchExe)
+	if err != nil {
+		log.Fatalln("Invalid -match-exe:", err)
+	}
+	whitelistedExes = exes
+	if whitelistedNames, err = parseMatchName(flagMatchName); err != nil {
+		log.Fatalln("Invalid -match-name:", err)
+	}
 
-			queue := []int{flagPid}
-			var loopPid int
-			m := make(map[int]struct{})
-			m[flagPid] = struct{}{}
-			for len(queue) > 0 {
-				loopPid, queue = queue[0], queue[1:]
+	if flagWalk != "all" && flagWalk != "children" {
+		log.Fatalf("Unknown -walk %q", flagWalk)
+	}
+	if len(flagAttach) > 0 && flagWalk != "all" {
+		log.Fatalln("-attach requires -walk all to see new processes")
+	}
+	if flagKeepNewest {
+		if flagSortBy != "starttime" {
+			log.Fatalln("-keep-newest can't be combined with -sort-by", flagSortBy)
+		}
+		flagSortDesc = true
+	}
+	var script *policy
+	if flagPolicyScript != "" {
+		var err error
+		if script, err = readPolicy(flagPolicyScript); err != nil {
+			log.Fatalf("Error reading -policy-script %s: %v", flagPolicyScript, err)
+		}
+	}
+	if flagHostVszLimit != 0 && flagStateDir == "" {
+		log.Fatalln("-host-vsz-limit-mb requires -state-dir to find the other instances in")
+	}
+	if flagMaxLoad < 0 {
+		log.Fatalln("-max-load can't be negative")
+	}
+	if flagMaxLoad != 0 && flagPauseTop {
+		log.Fatalln("-max-load has no effect with -pause-top, which throttles no filtered processes")
+	}
+	if flagMaxLinkers < 0 {
+		log.Fatalln("-max-linkers can't be negative")
+	}
+	if flagJobserver < 0 {
+		log.Fatalln("-jobserver can't be negative")
+	}
+	if flagJobserver != 0 && flag.NArg() == 0 {
+		log.Fatalln("-jobserver requires a command to run")
+	}
+	if flagMaxStopped < 0 {
+		log.Fatalln("-max-stopped can't be negative")
+	}
+	if flagPauseNinja && flagPauseTop {
+		log.Fatalln("-pause-ninja has no effect with -pause-top, which throttles no filtered processes")
+	}
+	if flagMaxStopped != 0 && flagPauseTop {
+		log.Fatalln("-max-stopped has no effect with -pause-top, which throttles no filtered processes")
+	}
+	if flagPerProcAction != "term" && flagPerProcAction != "kill" && flagPerProcAction != "stop" {
+		log.Fatalf("Unknown -per-proc-action %q", flagPerProcAction)
+	}
+	steps, err := parseEscalation(flagEscalate)
+	if err != nil {
+		log.Fatalln("Invalid -escalate:", err)
+	}
 
-				for _, childPid := range pmap[loopPid] {
-					if _, ok := m[childPid]; ok {
-						continue
-					} else {
-						m[childPid] = struct{}{}
-						queue = append(queue, childPid)
-					}
-				}
-			}
+	var adapt *adaptive
+	if flagMinVszLimit != 0 || flagMaxVszLimit != 0 {
+		adapt = &adaptive{min: uint64(flagMinVszLimit), max: uint64(flagMaxVszLimit)}
+		if adapt.min == 0 {
+			adapt.min = uint64(flagVszLimit)
+		}
+		if adapt.max == 0 {
+			adapt.max = uint64(flagVszLimit)
+		}
+		if adapt.min > uint64(flagVszLimit) || adapt.max < uint64(flagVszLimit) {
+			log.Fatalln("-vsz-limit-mb has to be between -min-vsz-limit-mb and -max-vsz-limit-mb")
+		}
+		if _, err := memoryPressure(); err != nil {
+			log.Println("Memory pressure (PSI) not available, adapting the limit to available memory alone:", err)
+		}
+	}
 
-			filterableVsz := uint64(0)
-			filterableRss := uint64(0)
+	if flag.NArg() > 0 && flag.Arg(0) == "attach" {
+		flags := os.Args[1 : len(os.Args)-flag.NArg()]
+		if err := attachSession(flag.Args()[1:], flagListen, apiToken, flagStateDir, flags); err != nil {
+			log.Fatalln("Error attaching session:", err)
+		}
+		return
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "reserve" {
+		code, err := reserveAndRun(flag.Args()[1:], flagListen, apiToken)
+		if err != nil {
+			log.Fatalln("Error reserving memory:", err)
+		}
+		os.Exit(code)
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "explain" {
+		if flag.NArg() != 2 {
+			log.Fatalln("explain takes the PID of a process")
+		}
+		pid, err := strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			log.Fatalln("Invalid PID:", err)
+		}
+		if err := explainCommand(os.Stdout, pid, flagListen, apiToken, flagStateDir); err != nil {
+			log.Fatalln("Error explaining process:", err)
+		}
+		return
+	}
+	if flag.NArg() == 1 && (flag.Arg(0) == "aggregate" || flag.Arg(0) == "top-fleet") {
+		if flagListen == "" {
+			log.Fatalf("%s requires -listen", flag.Arg(0))
+		}
+		if flag.Arg(0) == "aggregate" {
+			log.Fatalln("Error aggregating reports:", aggregate(flagListen, apiToken))
+		}
+		if err := topFleet(flagListen, apiToken); err != nil {
+			log.Fatalln("Error showing the fleet:", err)
+		}
+		return
+	}
 
-			unfilterableVsz := uint64(0)
-			unfilterableRss := uint64(0)
+	fds := newPidfds()
+	thr, err := newThrottler(flagMode, flagSqueezeCPUs, fds)
+	if err != nil {
+		log.Fatalln("Invalid -mode:", err)
+	}
 
-			pids := make([]int, 0, len(m))
-			for pid := range m {
-				pids = append(pids, pid)
-			}
-			sort.Ints(pids)
-			filteredRunning := 0
-			filteredStopped := 0
-			unfiltered := 0
-
-			var filteredStats []procfs.ProcStat
-
-			for _, pid := range pids {
-				if _, ok := whitelistedProcesses[stats[pid].Comm]; !ok {
-					unfiltered++
-					unfilterableVsz += stats[pid].VirtualMemory()
-					unfilterableRss += stats[pid].ResidentMemory()
-					continue
-				}
+	if flag.NArg() == 1 && flag.Arg(0) == "expensive" {
+		if flagMemoryDB == "" {
+			log.Fatalln("expensive requires -memory-db")
+		}
+		if err := printExpensive(os.Stdout, flagMemoryDB, expensiveTop); err != nil {
+			log.Fatalln("Error reading -memory-db:", err)
+		}
+		return
+	}
 
-				if stats[pid].State == "T" {
-					filteredStopped++
-				} else {
-					filteredRunning++
-				}
-				filteredStats = append(filteredStats, stats[pid])
+	if flag.NArg() > 0 && flag.Arg(0) == "report" {
+		if flagHistoryDB == "" {
+			log.Fatalln("report requires -history-db")
+		}
+		query := func(query string) ([][]string, error) { return queryHistoryDB(flagHistoryDB, query) }
+		if err := printReport(os.Stdout, query, flag.Args()[1:], time.Now()); err != nil {
+			log.Fatalln("Error reporting on -history-db:", err)
+		}
+		return
+	}
+
+	if flag.NArg() == 1 && flag.Arg(0) == "doctor" {
+		trees := flagTrees
+		if flagPid != 0 {
+			trees = append(trees, newTree(flagPid, unlimited))
+		}
+		if !doctor(os.Stdout, trees, flagMode, flagCheckInterval, flagProtectUnfiltered, flagPageOutStopped != 0) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var cgroup string
+	if flagCgroup != "" {
+		if flag.NArg() == 0 {
+			log.Fatalln("-cgroup requires a command to run")
+		}
+		if cgroup, err = cgroupDir(flagCgroup); err != nil {
+			log.Fatalln("Invalid -cgroup:", err)
+		}
+	} else if flagCgroupSwapMax != "" {
+		log.Fatalln("-cgroup-swap-max-mb requires -cgroup")
+	}
+	swapMax, err := parseSwapMax(flagCgroupSwapMax)
+	if err != nil {
+		log.Fatalln("Invalid -cgroup-swap-max-mb:", err)
+	}
+
+	// Opened before the command is started, so that failing to leaves
+	// nothing behind.
+	l, err := activationListener()
+	if err != nil {
+		log.Fatalln("Error using activated socket for control API:", err)
+	}
+	if l == nil && flagListen != "" {
+		if l, err = listen(flagListen); err != nil {
+			log.Fatalln("Error listening for control API:", err)
+		}
+	}
+
+	var exited <-chan int
+	var cgroupCreated bool
+	var js *jobserver
+	if flag.NArg() > 0 {
+		if flagPid != 0 || flagReplay != "" || len(flagAttach) > 0 {
+			log.Fatalln("A command to run can't be combined with -pid, -replay or -attach")
+		}
+		var cmd *exec.Cmd
+		var ch <-chan int
+		if flagJobserver != 0 {
+			if js, err = newJobserver(flagJobserver); err != nil {
+				log.Fatalln("Error setting up -jobserver:", err)
+			}
+		}
+		if cgroup != "" {
+			if cgroupCreated, err = makeCgroup(cgroup, swapMax); err != nil {
+				log.Fatalln("Error setting up -cgroup:", err)
 			}
+			cmd, ch, err = wrapInCgroup(flag.Args(), !flagTUI, cgroup, js)
+		} else {
+			cmd, ch, err = wrap(flag.Args(), !flagTUI, nil, js)
+		}
+		if err != nil {
+			if cgroupCreated {
+				os.Remove(cgroup)
+			}
+			log.Fatalln("Error running command:", err)
+		}
+		flagPid, exited = cmd.Process.Pid, ch
+	}
 
-			sort.Slice(filteredStats, func(i, j int) bool {
-				if filteredStats[i].Starttime != filteredStats[j].Starttime {
-					return filteredStats[i].Starttime < filteredStats[j].Starttime
-				}
-				return filteredStats[i].PID < filteredStats[j].PID
-			})
+	trees := flagTrees
+	if flagPid != 0 {
+		trees = append([]*tree{newTree(flagPid, unlimited)}, trees...)
+	}
+	// With nothing to track given, keep running for trees to be attached
+	// by -attach or the control API.
+	daemon := len(flagAttach) > 0 || len(trees) == 0
 
-			var resumed int
-			var atleastOneStopped bool
+	topExited := make(chan int, len(trees)+16)
+	m := &monitor{
+		trees:             trees,
+		global:            budget{name: "overall", limit: uint64(flagVszLimit)},
+		lto:               budget{name: "LTO", limit: uint64(flagLTOVszLimit)},
+		hostLimit:         uint64(flagHostVszLimit),
+		host:              budget{name: "host"},
+		resumeLimit:       flagResumeLimit,
+		signalLimit:       flagSignalLimit,
+		warnLimit:         uint64(flagWarnVszLimit),
+		hardLimit:         uint64(flagHardVszLimit),
+		escalation:        steps,
+		maxLinkers:        flagMaxLinkers,
+		maxLoad:           flagMaxLoad,
+		maxStopped:        flagMaxStopped,
+		procLimit:         uint64(flagPerProcVszLimit),
+		procAction:        flagPerProcAction,
+		adaptive:          adapt,
+		nodeLimit:         uint64(flagNodeLimit),
+		nodes:             make(map[int]*budget),
+		placed:            make(originals[struct{}]),
+		minAge:            flagMinAge,
+		firstSeen:         make(originals[time.Time]),
+		resumeGrace:       flagResumeGrace,
+		resumedAt:         make(originals[time.Time]),
+		smoothWindow:      flagSmooth,
+		smoothed:          make(originals[ewma]),
+		growth:            make(originals[growth]),
+		stopDrivers:       flagMode == "stop",
+		pauseNinjas:       flagPauseNinja,
+		jobserver:         js,
+		ninjas:            make(originals[procfs.ProcStat]),
+		drivers:           make(originals[procfs.ProcStat]),
+		pageOutAfter:      flagPageOutStopped,
+		pagedOut:          make(originals[struct{}]),
+		protectUnfiltered: flagProtectUnfiltered,
+		attachRules:       flagAttach,
+		declined:          make(originals[struct{}]),
+		lockDir:           flagStateDir,
+		topExited:         topExited,
+		pidfds:            fds,
+		kill:              fds.signal,
+		verbose:           flagVerbose,
+		logHeartbeat:      flagLogHeartbeat,
+		interval:          flagCheckInterval,
+		started:           time.Now(),
+		clock:             realClock{},
+		pauseTop:          flagPauseTop,
+		sortDesc:          flagSortDesc,
+		sortBy:            flagSortBy,
+		policy:            script,
+		thr:               thr,
+		topThr:            newStopThrottler(fds),
+		classify:          liveClassify,
+		swapOf:            liveSwap,
+		ioOf:              liveIO,
+		io:                make(originals[procIO]),
+		jobOf:             liveJob,
+		jobs:              make(originals[compileJob]),
+		lastReason:        make(originals[string]),
+		uid:               os.Geteuid(),
+		protectJVMDaemons: !flagStopJVMDaemons,
+		jvmChecked:        make(originals[struct{}]),
+		unmanaged:         make(originals[struct{}]),
+		stoppedElsewhere:  make(originals[struct{}]),
+		since:             make(originals[time.Time]),
+		overrides:         make(originals[string]),
+		killed:            make(originals[struct{}]),
+		protected:         make(originals[struct{}]),
+		escalations:       make(originals[escalation]),
+		pending:           make(originals[pendingSignal]),
+		uninterruptible:   make(originals[dState]),
+	}
+	sortKey, ok := m.sortKeyFunc(flagSortBy)
+	if !ok {
+		fatalf("Unknown -sort-by %q", flagSortBy)
+	}
+	m.sortKey = sortKey
 
-			for counter, stat := range filteredStats {
-				filterableVsz += stat.VirtualMemory()
-				filterableRss += stat.ResidentMemory()
-				if flagVerbose {
-					log.Println(stat.Starttime, stat.PID, stat.State, stat.Comm, toMB(stat.VirtualMemory()), toMB(stat.ResidentMemory()))
-				}
+	if configFile != nil {
+		if err := m.checkPhases(configFile.phases); err != nil {
+			fatalf("Invalid flag in %s: %v", configFile.path, err)
+		}
+		m.config = configFile
+	}
 
-				if (filterableVsz > flagVszLimitMb*1024*1024 || atleastOneStopped) && counter > 0 {
-					if stat.State != "T" {
-						if flagVerbose {
-							log.Printf("Stopping %d %s", stat.PID, stat.Comm)
-						}
-						syscall.Kill(stat.PID, syscall.SIGSTOP)
-						atleastOneStopped = true
-					}
-				} else if stat.State == "T" && resumed < flagResumeLimit {
-					if flagVerbose {
-						log.Printf("Resuming %d %s", stat.PID, stat.Comm)
-					}
-					syscall.Kill(stat.PID, syscall.SIGCONT)
-					resumed++
-				} else if stat.State == "T" {
-					atleastOneStopped = true
-				}
+	if flagNUMAPlace {
+		if exited == nil {
+			fatalln("-numa-place requires a command to run")
+		}
+		nodes, err := numaNodes()
+		if err != nil {
+			fatalln("Error listing NUMA nodes:", err)
+		}
+		if len(nodes) < 2 {
+			log.Println("Only one NUMA node with CPUs, -numa-place has no effect")
+		} else {
+			m.placement = nodes
+		}
+	}
+
+	if flagDBus != "" && flagDBus != "session" && flagDBus != "system" {
+		fatalf("Unknown -dbus bus %q, want session or system", flagDBus)
+	}
+	if flagNotify {
+		m.notify = newNotifier()
+	}
+	if len(flagHooks) > 0 {
+		if flagSandbox {
+			fatalln("-hook can't be combined with -sandbox, which keeps hook commands from running")
+		}
+		m.hooks = &hooks{cmds: flagHooks, clock: m.clock}
+	}
+
+	if flagReplay != "" {
+		m.thr = &dryRunThrottler{set: make(originals[struct{}])}
+		m.topThr = &dryRunThrottler{set: make(originals[struct{}])}
+		m.kill = func(procfs.ProcStat, syscall.Signal) error { return nil }
+		m.protectUnfiltered = false
+		m.adaptive = nil
+		m.nodeLimit = 0
+		m.hostLimit = 0
+		m.maxLoad = 0
+		m.pageOutAfter = 0
+		m.stopDrivers = false
+		m.uid = 0
+		m.protectJVMDaemons = false
+		m.notify = nil
+		m.hooks = nil
+		m.verbose = true
+		out := os.Stderr
+		if simulated != "" {
+			// Only the outcome matters, not every decision.
+			log.SetOutput(io.Discard)
+			out = os.Stdout
+			fmt.Fprintf(out, "Simulated %s\n", simulated)
+		}
+		if err := replay(m, flagReplay); err != nil {
+			log.SetOutput(os.Stderr)
+			fatalln("Error replaying trace:", err)
+		}
+		m.report(out, m.now)
+		return
+	}
+	if exited != nil {
+		// Exit like the command did, once everything else is cleaned up.
+		defer func() {
+			code := <-exited
+			if cgroupCreated {
+				os.Remove(cgroup)
 			}
+			os.Exit(code)
+		}()
+	}
+	// Once stopped by a signal, die of it as we would have without the
+	// handler, after everything else is cleaned up.
+	var stopSig os.Signal
+	defer func() {
+		if stopSig != nil {
+			signal.Reset(stopSig)
+			syscall.Kill(os.Getpid(), stopSig.(syscall.Signal))
+			select {}
+		}
+	}()
+	// Deferred before the rest so that it is printed last, once the TUI has given the
+	// screen back.
+	defer func() { m.report(os.Stderr, m.clock.Now()) }()
+
+	if err := preflight(trees, flagMode, flagProtectUnfiltered, flagPageOutStopped != 0); err != nil {
+		fatalln("Preflight check failed:", err)
+	}
 
-			if flagVerbose {
-				log.Printf("Total VSZ: %dM RSS: %dM Procs: %d (Stopped: %d Running %d)", toMB(filterableVsz), toMB(filterableRss), filteredRunning+filteredStopped, filteredStopped, filteredRunning)
-				log.Printf("Unfiltered VSZ: %dM RSS: %dM Procs: %d", toMB(unfilterableVsz), toMB(unfilterableRss), unfiltered)
-			} else {
-				fmt.Printf(
-					"\r\033[2K[R:%d|S:%d|I:%d][V:%dM][R:%dM]",
-					filteredRunning,
-					filteredStopped,
-					unfiltered,
-					toMB(filterableVsz),
-					toMB(filterableRss),
-				)
+	if flagRecordTrace != "" {
+		f, err := os.Create(flagRecordTrace)
+		if err != nil {
+			fatalln("Error creating trace:", err)
+		}
+		defer f.Close()
+		m.trace = json.NewEncoder(f)
+	}
+
+	if flagHistoryDB != "" {
+		// sqlite3 is started before -sandbox, which only confines us.
+		if m.historyDB, err = openHistoryDB(flagHistoryDB, m.clock.Now(), strings.Join(os.Args, " ")); err != nil {
+			fatalln("Error opening -history-db:", err)
+		}
+	}
+
+	if flagAuditLog != "" && flagReplay == "" {
+		f, err := os.OpenFile(flagAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fatalln("Error opening audit log:", err)
+		}
+		defer f.Close()
+		m.audit = json.NewEncoder(f)
+		fds.sent = m.auditSignal
+	}
+
+	if flagMemoryDB != "" {
+		if m.memoryDB, err = openMemoryDB(flagMemoryDB); err != nil {
+			fatalln("Error opening -memory-db:", err)
+		}
+	}
+
+	if len(trees) == 0 && len(flagAttach) == 0 && l == nil {
+		fatalln("Nothing to track: give a command to run, -pid, -tree, -attach, or -listen for memlimit attach")
+	}
+	if l != nil {
+		h, err := authenticate(l, apiToken, m.controlHandler())
+		if err != nil {
+			fatalln("Error serving control API:", err)
+		}
+		go func() {
+			log.Println("Control API stopped:", serveControl(l, h))
+		}()
+	}
+	if flagDBus != "" {
+		go m.serveDBus(flagDBus)
+	}
+
+	wd, err := newWatchdog()
+	if err != nil {
+		fatalln("Error connecting to the systemd watchdog:", err)
+	}
+	if wd != nil && flagCheckInterval > wd.timeout/4 {
+		log.Printf("-check-interval %v is too long for the %v systemd watchdog timeout", flagCheckInterval, wd.timeout)
+	}
+
+	if flagPidFile != "" {
+		f, err := writePidFile(flagPidFile)
+		if err != nil {
+			fatalf("Error writing pidfile %s: %v", flagPidFile, err)
+		}
+		heldLocks = append(heldLocks, f)
+		defer os.Remove(flagPidFile)
+	}
+
+	var stateFile string
+	if flagStateDir != "" {
+		var locks []*os.File
+		stateFile, locks = lockState(flagStateDir, trees)
+		heldLocks = append(heldLocks, locks...)
+		m.adoptOrphans(flagStateDir, flagMode)
+	}
+
+	if configFile != nil {
+		if err := watchConfig(configFile.path, m.reloadConfig); err != nil {
+			log.Println("Error watching -config, only reloading it on SIGHUP:", err)
+		}
+	}
+
+	if flagSandbox {
+		readPaths := []string{"/proc"}
+		if configFile != nil {
+			readPaths = append(readPaths, filepath.Dir(configFile.path))
+		}
+		// Jobs are named after the target in .ninja_log.
+		readPaths = append(readPaths, buildDirs(flag.Args())...)
+		var writePaths []string
+		if flagProtectUnfiltered {
+			writePaths = append(writePaths, "/proc")
+		}
+		if flagStateDir != "" {
+			writePaths = append(writePaths, flagStateDir)
+		}
+		if flagPidFile != "" {
+			writePaths = append(writePaths, filepath.Dir(flagPidFile))
+		}
+		if flagMemoryDB != "" {
+			writePaths = append(writePaths, filepath.Dir(flagMemoryDB))
+		}
+		if cgroupCreated {
+			writePaths = append(writePaths, filepath.Dir(cgroup))
+		}
+		// Load the local time zone used by log while we still can.
+		time.Now().Zone()
+		if err := sandbox(readPaths, writePaths); err != nil {
+			fatalln("Error sandboxing:", err)
+		}
+	}
+
+	var oh *overhead
+	if flagReportOverhead {
+		oh = newOverhead()
+		defer oh.report(os.Stderr, flagCheckInterval)
+	}
+	if flagTUI {
+		if m.tui, err = newTUI(os.Stdin, os.Stdout, flagMode); err != nil {
+			fatalln("Error starting -tui:", err)
+		}
+		defer m.tui.close()
+		if m.tui.in != nil {
+			go m.handleKeys()
+		}
+	}
+
+	m.walk, m.fullScanEvery, m.daemon = flagWalk, flagFullScanEvery, daemon
+	m.stateFile, m.mode, m.wd, m.oh = stateFile, flagMode, wd, oh
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if exited != nil {
+		signal.Notify(sigs, syscall.SIGQUIT)
+	}
+	go func() {
+		for sig := range sigs {
+			// A wrapped command decides for itself how to react, and we
+			// exit once it has.
+			if exited != nil {
+				forward(flagPid, sig.(syscall.Signal))
+				continue
 			}
+			if ctx.Err() != nil {
+				// Asked again: die right away.
+				signal.Reset(sig)
+				syscall.Kill(os.Getpid(), sig.(syscall.Signal))
+				continue
+			}
+			log.Printf("Got %v, releasing throttled processes and exiting", sig)
+			stopSig = sig
+			stop()
+		}
+	}()
+
+	if flagReportTo != "" {
+		go m.reportTo(ctx, flagReportTo, apiToken)
+	}
+
+	// Scan right away when a top-level process exits, rather than holding
+	// what is left of its tree throttled until the next scan.
+	for _, t := range trees {
+		if t.pid != 0 {
+			watchExit(t.pid, topExited)
 		}
-		time.Sleep(flagCheckInterval)
 	}
+
+	m.run(ctx)
 }
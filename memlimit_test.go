@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/prometheus/procfs"
+)
+
+// startSleepers starts n processes that sleep until the test ends, and
+// returns their stats.
+func startSleepers(tb testing.TB, n int) map[int]procfs.ProcStat {
+	stats := make(map[int]procfs.ProcStat, n)
+	for i := 0; i < n; i++ {
+		cmd := exec.Command("sleep", "60")
+		if err := cmd.Start(); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+		proc, err := procfs.NewProc(cmd.Process.Pid)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if stats[proc.PID], err = proc.Stat(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return stats
+}
+
+// TestRefreshMemory checks that partial scans read what full scans do of
+// the fields they refresh, and leave out processes that have exited or
+// whose PID was reused.
+func TestRefreshMemory(t *testing.T) {
+	self, err := procfs.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := self.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use up some CPU time to be seen.
+	for i := 0; stat.UTime+stat.STime == 0 && i < 1e9; i++ {
+		if i%1e6 == 0 {
+			if stat, err = self.Stat(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := stat
+	old.State, old.UTime, old.STime, old.VSize, old.RSS = "", 0, 0, 0, 0
+	reused := procfs.ProcStat{PID: 1, Starttime: 1 << 40}
+	prev := map[int]procfs.ProcStat{stat.PID: old, 1: reused, 1 << 30: {PID: 1 << 30}}
+	got := refreshMemory(prev, []int{stat.PID, 1, 1 << 30, 1<<30 + 1})
+	if len(got) != 1 {
+		t.Fatalf("got %d processes, want just us", len(got))
+	}
+	after, err := self.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := got[stat.PID]
+	if g.State == "" {
+		t.Errorf("state not read")
+	}
+	if g.UTime+g.STime < stat.UTime+stat.STime || g.UTime+g.STime > after.UTime+after.STime {
+		t.Errorf("CPU time %d, want between %d and %d as in stat", g.UTime+g.STime, stat.UTime+stat.STime, after.UTime+after.STime)
+	}
+	if g.VSize == 0 || g.RSS == 0 {
+		t.Errorf("VSZ %d and RSS %d, want ours", g.VSize, g.RSS)
+	}
+}
+
+// BenchmarkRefreshMemory compares re-reading the fields of stat that partial
+// scans refresh with reading all of it, as full scans do.
+func BenchmarkRefreshMemory(b *testing.B) {
+	prev := startSleepers(b, 64)
+	pids := make([]int, 0, len(prev))
+	for pid := range prev {
+		pids = append(pids, pid)
+	}
+	b.Run("partial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if stats := refreshMemory(prev, pids); len(stats) != len(pids) {
+				b.Fatalf("read %d of %d processes", len(stats), len(pids))
+			}
+		}
+	})
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stats := make(map[int]procfs.ProcStat, len(pids))
+			for _, pid := range pids {
+				proc, err := procfs.NewProc(pid)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if stats[pid], err = proc.Stat(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,209 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+const (
+	// How often the -memory-db is written while jobs keep finishing.
+	memoryDBSaveEvery = 30 * time.Second
+	// Number of jobs listed by memlimit expensive.
+	expensiveTop = 20
+)
+
+// jobCost is the memory a compile job was seen to peak at, the last time it
+// ran to completion.
+type jobCost struct {
+	Path    string    `json:"path"`
+	Comm    string    `json:"comm"`
+	Flags   string    `json:"flags"`
+	PeakVsz uint64    `json:"peak_vsz"`
+	PeakRss uint64    `json:"peak_rss"`
+	Runs    int       `json:"runs"`
+	Last    time.Time `json:"last"`
+}
+
+func (c jobCost) key() string {
+	return c.Path + "\x00" + c.Comm + "\x00" + c.Flags
+}
+
+// memoryDB learns the peak memory of compile jobs across builds, by source
+// file, compiler and flags.
+type memoryDB struct {
+	path  string
+	costs map[string]jobCost
+	// Peaks of the jobs running, recorded in costs once they exit.
+	running originals[jobCost]
+	dirty   bool
+	saved   time.Time
+}
+
+// openMemoryDB reads the -memory-db at path, which doesn't have to exist
+// yet.
+func openMemoryDB(path string) (*memoryDB, error) {
+	costs, err := readMemoryDB(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		costs, err = make(map[string]jobCost), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &memoryDB{path: path, costs: costs, running: make(originals[jobCost])}, nil
+}
+
+func readMemoryDB(path string) (map[string]jobCost, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []jobCost
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	costs := make(map[string]jobCost, len(list))
+	for _, c := range list {
+		costs[c.key()] = c
+	}
+	return costs, nil
+}
+
+// observe records the memory of stat, running job, as of this scan.
+func (db *memoryDB) observe(stat procfs.ProcStat, job compileJob) {
+	c, ok := db.running.get(stat)
+	if !ok {
+		c = jobCost{Path: job.path, Comm: stat.Comm, Flags: job.flags}
+	}
+	if vsz := stat.VirtualMemory(); vsz > c.PeakVsz {
+		c.PeakVsz = vsz
+	}
+	if rss := uint64(stat.ResidentMemory()); rss > c.PeakRss {
+		c.PeakRss = rss
+	}
+	db.running.save(stat, c)
+}
+
+// predict returns stat with the VSZ its job was last seen to peak at, if
+// higher, so that it is charged its expected cost before it gets there.
+func (db *memoryDB) predict(stat procfs.ProcStat, job compileJob) procfs.ProcStat {
+	c, ok := db.costs[jobCost{Path: job.path, Comm: stat.Comm, Flags: job.flags}.key()]
+	if ok && c.PeakVsz > stat.VSize {
+		stat.VSize = c.PeakVsz
+	}
+	return stat
+}
+
+// prune records the peaks of the jobs that exited, except those that killed
+// reports were killed rather than run to completion.
+func (db *memoryDB) prune(stats map[int]procfs.ProcStat, now time.Time, killed func(procfs.ProcStat) bool) {
+	for pid, e := range db.running {
+		if s, ok := stats[pid]; ok && s.Starttime == e.starttime {
+			continue
+		}
+		if killed(procfs.ProcStat{PID: pid, Starttime: e.starttime}) {
+			delete(db.running, pid)
+			continue
+		}
+		c := e.value
+		c.Runs = db.costs[c.key()].Runs + 1
+		c.Last = now
+		db.costs[c.key()] = c
+		db.dirty = true
+		delete(db.running, pid)
+	}
+}
+
+// save writes the database out if it changed, merging in what other
+// instances wrote to it since it was read, unless it was written less than
+// memoryDBSaveEvery ago and force is not set.
+func (db *memoryDB) save(now time.Time, force bool) error {
+	if !db.dirty || !force && now.Sub(db.saved) < memoryDBSaveEvery {
+		return nil
+	}
+	if disk, err := readMemoryDB(db.path); err == nil {
+		for key, c := range disk {
+			if o, ok := db.costs[key]; !ok || c.Last.After(o.Last) {
+				db.costs[key] = c
+			}
+		}
+	}
+	data, err := json.MarshalIndent(db.sorted(), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(db.path, data); err != nil {
+		return err
+	}
+	db.dirty, db.saved = false, now
+	return nil
+}
+
+// sorted returns the jobs in the database, most expensive first.
+func (db *memoryDB) sorted() []jobCost {
+	list := make([]jobCost, 0, len(db.costs))
+	for _, c := range db.costs {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PeakVsz != list[j].PeakVsz {
+			return list[i].PeakVsz > list[j].PeakVsz
+		}
+		return list[i].key() < list[j].key()
+	})
+	return list
+}
+
+// finishJobs records the jobs that exited in m.memoryDB, if any, for when
+// there is no scan left to.
+func (m *monitor) finishJobs(stats map[int]procfs.ProcStat) {
+	if m.memoryDB == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.memoryDB.prune(stats, m.clock.Now(), m.killedJob)
+}
+
+// saveMemoryDB saves m.memoryDB, if any, as save does.
+func (m *monitor) saveMemoryDB(force bool) {
+	if m.memoryDB == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.memoryDB.save(m.clock.Now(), force); err != nil {
+		log.Println("Error writing -memory-db:", err)
+	}
+}
+
+// printExpensive implements memlimit expensive: it lists the n compile jobs
+// in the -memory-db at path that peaked highest.
+func printExpensive(w io.Writer, path string, n int) error {
+	costs, err := readMemoryDB(path)
+	if err != nil {
+		return err
+	}
+	db := &memoryDB{costs: costs}
+	fmt.Fprintf(w, "%8s %8s %5s %-10s %-16s %s\n", "PEAK VSZ", "PEAK RSS", "RUNS", "LAST", "COMMAND", "SOURCE")
+	for i, c := range db.sorted() {
+		if i == n {
+			fmt.Fprintf(w, "... %d more\n", len(costs)-i)
+			break
+		}
+		fmt.Fprintf(w, "%8s %8s %5d %-10s %-16s %s\n", formatSize(c.PeakVsz), formatSize(c.PeakRss), c.Runs, c.Last.Format("2006-01-02"), c.Comm, c.Path)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestMemoryDBSkipsKilled checks that only jobs that exited on their own are
+// recorded, not those killed for a limit or by escalating.
+func TestMemoryDBSkipsKilled(t *testing.T) {
+	db, err := openMemoryDB(filepath.Join(t.TempDir(), "memory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, clock := newTestMonitor(unlimited, isCompiler)
+	m.memoryDB = db
+	stats := buildStats(3)
+	for pid := 1001; pid <= 1003; pid++ {
+		db.observe(stats[pid], compileJob{path: filepath.Join("/src", stats[pid].Comm+string(rune('a'+pid-1001))+".cc")})
+	}
+	m.killed.save(stats[1002], struct{}{})
+	m.escalations.save(stats[1003], escalation{steps: 1, at: clock.Now()})
+
+	m.finishJobs(map[int]procfs.ProcStat{1000: stats[1000]})
+	if len(db.running) != 0 {
+		t.Errorf("%d jobs still running, want none", len(db.running))
+	}
+	if len(db.costs) != 1 {
+		t.Fatalf("recorded %d jobs, want 1", len(db.costs))
+	}
+	for _, c := range db.costs {
+		if c.Path != "/src/cc1plusa.cc" || c.PeakVsz != stats[1001].VSize || !c.Last.Equal(clock.Now()) {
+			t.Errorf("recorded %+v, want the job of 1001 as of %v", c, clock.Now().Format(time.RFC3339))
+		}
+	}
+}
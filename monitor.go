@@ -0,0 +1,1580 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// budget is a limit, on VSZ unless set otherwise, that a group of filtered
+// processes is charged against, in victim order.
+type budget struct {
+	name  string
+	limit uint64
+	// What processes are charged if not their VSZ, and what to call it.
+	usage  func(stat procfs.ProcStat) uint64
+	metric string
+
+	vsz   uint64
+	rss   uint64
+	procs int
+	// Set once a process charged to this budget is held throttled, so that
+	// every newer process charged to it is throttled as well.
+	stopped bool
+	// Set while a single process that is let run exceeds the limit on its
+	// own, so that the limit cannot be enforced. Kept across scans.
+	unattainable bool
+}
+
+// Limit of budgets that are not limited.
+const unlimited = math.MaxUint64
+
+func (b *budget) reset() {
+	b.vsz, b.rss, b.procs, b.stopped = 0, 0, 0, false
+}
+
+// cost returns what stat is charged to the budget.
+func (b *budget) cost(stat procfs.ProcStat) uint64 {
+	if b.usage != nil {
+		return b.usage(stat)
+	}
+	return charged(stat)
+}
+
+// what returns what the budget limits, for messages.
+func (b *budget) what() string {
+	if b.metric != "" {
+		return b.metric
+	}
+	return "VSZ"
+}
+
+func (b *budget) charge(stat procfs.ProcStat) {
+	b.vsz += b.cost(stat)
+	b.rss += stat.ResidentMemory()
+	b.procs++
+}
+
+// exceeded reports whether the most recently charged process has to be
+// throttled to respect this budget. The first process charged is always let
+// run.
+func (b *budget) exceeded() bool {
+	return b.procs > 1 && (b.vsz > b.limit || b.stopped)
+}
+
+// tree is a tracked process tree with its own budget.
+type tree struct {
+	pid    int
+	budget budget
+	pids   []int
+
+	running, stopped, unfiltered int
+	unfilterableVsz              uint64
+	unfilterableRss              uint64
+
+	// For attached trees, what attached them (the -attach rule that
+	// matched, or the control API), when, and the lock of the tree if any.
+	rule     string
+	comm     string
+	attached time.Time
+	lock     *os.File
+	// Peak memory of the whole tree, and most processes held throttled at
+	// once.
+	peakVsz, peakRss uint64
+	peakStopped      int
+}
+
+func (t *tree) reset() {
+	t.budget.reset()
+	t.running, t.stopped, t.unfiltered = 0, 0, 0
+	t.unfilterableVsz, t.unfilterableRss = 0, 0
+}
+
+// procStatus identifies a tracked process.
+type procStatus struct {
+	PID       int    `json:"pid"`
+	Starttime uint64 `json:"starttime"`
+	Comm      string `json:"comm"`
+}
+
+// Manual overrides of the policy for a single process, set through the
+// control API or the TUI and kept until cleared or the process exits.
+const (
+	// Never throttle the process, releasing it if it is throttled.
+	overrideRun = "run"
+	// Keep the process throttled regardless of the limits.
+	overrideStop = "stop"
+)
+
+// overrideStatus is a process with a manual override.
+type overrideStatus struct {
+	procStatus
+	Action string `json:"action"`
+}
+
+// treeStatus summarizes a tracked tree as of the last scan.
+type treeStatus struct {
+	PID int `json:"pid"`
+	// What the tree was attached by, if it was: the -attach rule that
+	// matched, or the control API.
+	Rule       string `json:"rule,omitempty"`
+	Pids       []int  `json:"pids"`
+	VszLimit   uint64 `json:"vsz_limit,omitempty"`
+	Vsz        uint64 `json:"vsz"`
+	Rss        uint64 `json:"rss"`
+	Running    int    `json:"running"`
+	Stopped    int    `json:"stopped"`
+	Unfiltered int    `json:"unfiltered"`
+}
+
+// status summarizes the state of the monitor as of the last scan. Sizes are
+// in bytes; a zero limit means the tree has no limit of its own.
+type status struct {
+	VszLimit        uint64       `json:"vsz_limit"`
+	LTOVszLimit     uint64       `json:"lto_vsz_limit"`
+	Vsz             uint64       `json:"vsz"`
+	Rss             uint64       `json:"rss"`
+	Swap            uint64       `json:"swap"`
+	LTOVsz          uint64       `json:"lto_vsz"`
+	LTORss          uint64       `json:"lto_rss"`
+	Running         int          `json:"running"`
+	Stopped         int          `json:"stopped"`
+	Unfiltered      int          `json:"unfiltered"`
+	UnfilterableVsz uint64       `json:"unfilterable_vsz"`
+	UnfilterableRss uint64       `json:"unfilterable_rss"`
+	Trees           []treeStatus `json:"trees"`
+	WarnVszLimit    uint64       `json:"warn_vsz_limit,omitempty"`
+	HardVszLimit    uint64       `json:"hard_vsz_limit,omitempty"`
+	// Number of processes killed for exceeding HardVszLimit or the
+	// per-process limit so far.
+	Killed  int  `json:"killed"`
+	Warning bool `json:"warning,omitempty"`
+	// Names of the budgets that a single running process exceeds alone.
+	Unattainable []string         `json:"unattainable,omitempty"`
+	Throttled    []procStatus     `json:"throttled"`
+	Overrides    []overrideStatus `json:"overrides"`
+	// Memory of filtered processes per NUMA node, with -node-limit-mb.
+	NodeLimit uint64       `json:"node_limit,omitempty"`
+	Nodes     []nodeStatus `json:"nodes,omitempty"`
+	// How long the last full scan took, and how old its process data was
+	// by the time decisions were made.
+	ScanMillis    float64 `json:"scan_ms"`
+	DataAgeMillis float64 `json:"data_age_ms"`
+	// Phase the build is in, with -config.
+	Phase string `json:"phase,omitempty"`
+	// The 1-minute load average, with -max-load.
+	Load    float64 `json:"load,omitempty"`
+	MaxLoad float64 `json:"max_load,omitempty"`
+	// The -j make is left with, with -jobserver.
+	Jobs int `json:"jobs,omitempty"`
+	// Memory reserved through the control API that jobs don't use yet,
+	// counted in Vsz, and the reservations granted or waiting, in order.
+	Reserved     uint64              `json:"reserved,omitempty"`
+	Reservations []reservationStatus `json:"reservations,omitempty"`
+	// VSZ of the filtered processes let run, which other instances count
+	// against the host limit, what they leave of it to us, and how many
+	// of them there are.
+	RunningVsz   uint64 `json:"running_vsz"`
+	HostVszLimit uint64 `json:"host_vsz_limit,omitempty"`
+	Peers        int    `json:"peers,omitempty"`
+	// Whether enforcement is paused, with -dbus.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// monitor enforces the memory limits on one or more process trees.
+type monitor struct {
+	// Guards everything below against the control API.
+	mu sync.Mutex
+
+	trees []*tree
+	// Overall cap across all trees, excluding LTO links.
+	global budget
+	// LTO links are charged to a separate budget instead of their tree's.
+	lto budget
+
+	resumeLimit int
+	// Number of processes throttled or released per scan by the policy,
+	// so that large changes are spread over several scans.
+	signalLimit int
+	verbose     bool
+	pauseTop    bool
+	// Limit on the filtered processes let run by all instances keeping
+	// their state in lockDir, 0 if none, the budget of what the others
+	// leave of it, and how many others there were as of the last scan.
+	hostLimit uint64
+	host      budget
+	peers     int
+	// Lower threshold on the overall VSZ that only warns when crossed, 0 if
+	// disabled.
+	warnLimit uint64
+	warning   bool
+	// Limit on the total VSZ, including LTO links and throttled processes,
+	// beyond which the largest process is killed. 0 if disabled.
+	hardLimit uint64
+	// Number of linkers let run at once, 0 if any number.
+	maxLinkers int
+	// 1-minute load average over which filtered processes are throttled,
+	// 0 if disabled, the last one read, and the number of filtered
+	// processes let run while over it along with the load they were set
+	// at, 0 while under it.
+	maxLoad     float64
+	load        float64
+	loadSlots   int
+	loadSlotsAt float64
+	// Number of processes held throttled at once, 0 if any number, the
+	// processes held back by it in the current scan, and since when some
+	// have been.
+	maxStopped int
+	heldBack   []procfs.ProcStat
+	heldSince  time.Time
+	// Steps taken for processes held throttled over limit.
+	escalation []escalationStep
+	// VSZ limit of any single process, 0 if disabled, and what to do with
+	// processes over it: "term", "kill" or "stop".
+	procLimit  uint64
+	procAction string
+	// Limit on the memory filtered processes have on any one NUMA node, 0
+	// if disabled, the budgets of the nodes seen so far, and how much each
+	// process had on each node as of this scan.
+	nodeLimit uint64
+	nodes     map[int]*budget
+	nodeUsage map[int]map[int]uint64
+	// If set, filtered processes are placed on these NUMA nodes in turn
+	// as they appear, and the ones that were.
+	placement []numaNode
+	placeNext int
+	placed    originals[struct{}]
+	// How old a process has to be before it is throttled, 0 if any age,
+	// and when each one was first seen, which its age is counted from and
+	// explain reports.
+	minAge    time.Duration
+	firstSeen originals[time.Time]
+	// How long a released process is left running before it may be
+	// throttled again, 0 if not at all, and when each one was last
+	// released.
+	resumeGrace time.Duration
+	resumedAt   originals[time.Time]
+	// Window over which the memory of filtered processes is smoothed
+	// before being compared against limits, 0 if it isn't, and the
+	// smoothed memory of each.
+	smoothWindow time.Duration
+	smoothed     originals[ewma]
+	// The VSZ growth rate of each filtered process.
+	growth originals[growth]
+	// If set, compiler drivers are stopped along with their children in
+	// stop mode, and the ones that are.
+	stopDrivers bool
+	drivers     originals[procfs.ProcStat]
+	// How long a process has to be held stopped before its memory is paged
+	// out, 0 if never, and the ones that were since they were stopped.
+	pageOutAfter time.Duration
+	pagedOut     originals[struct{}]
+	// If set, the overall limit adapts to system conditions within these
+	// bounds.
+	adaptive *adaptive
+	// Sends the signals of enforceHard, escalate and adopt; a no-op when
+	// replaying.
+	kill   func(stat procfs.ProcStat, sig syscall.Signal) error
+	pidfds *pidfds
+	// Orders processes within the LTO and non-LTO groups, ascending unless
+	// sortDesc is set, and its -sort-by name.
+	sortKey  func(stat procfs.ProcStat) uint64
+	sortDesc bool
+	sortBy   string
+	// If set, the -policy-script, whose order applies after sortKey.
+	policy *policy
+	thr    throttler
+	// Throttles top-level processes in pause-top mode, and ninja with
+	// -pause-ninja.
+	topThr throttler
+	// If set, ninja processes are stopped while processes are held
+	// throttled, and the ones that are.
+	pauseNinjas bool
+	ninjas      originals[procfs.ProcStat]
+	// With -jobserver, the jobserver make runs its jobs through.
+	jobserver *jobserver
+	// Rules for processes to attach to as they start, the processes that
+	// matched one but are managed by another instance, and where tree locks
+	// are kept, if anywhere.
+	attachRules []attachRule
+	declined    originals[struct{}]
+	lockDir     string
+	// Told the PIDs of top-level processes as they exit, to scan right
+	// away.
+	topExited chan int
+	// Effective UID we run as. Unless root, processes of other users are
+	// left unmanaged.
+	uid int
+	// Whether JVM build daemons are left unmanaged, and the filtered
+	// processes checked for being one.
+	protectJVMDaemons bool
+	jvmChecked        originals[struct{}]
+
+	// Decides whether a process may be throttled, and whether it is an LTO
+	// link.
+	classify func(stat procfs.ProcStat) (filtered, lto bool)
+	// Returns how much of a filtered process is swapped out.
+	swapOf func(stat procfs.ProcStat) uint64
+	// Memory reserved through the control API, granted or waiting in
+	// order, and the token of the last reservation.
+	reservations []*reservation
+	nextToken    int
+	// If set, the -config file, the build phase its sections are applied
+	// for, and the phase the build has seemed to be in since nextSince.
+	config    *liveConfig
+	phase     string
+	nextPhase string
+	nextSince time.Time
+	// Returns how much a filtered process has read and written so far, and
+	// what each one had as of the last scan, for events.
+	ioOf func(stat procfs.ProcStat) procIO
+	io   originals[procIO]
+	// Returns the compile job a filtered process is running, if any, and
+	// what each one is, for logs and reports.
+	jobOf func(stat procfs.ProcStat) compileJob
+	jobs  originals[compileJob]
+	// If set, the peak memory of compile jobs is learned in it, and jobs are
+	// charged what they were seen to peak at from the start.
+	memoryDB *memoryDB
+	// If set, each scan is recorded to it.
+	trace *json.Encoder
+	// If set, the memory of each scan and every event are recorded in it.
+	historyDB *historyDB
+	// If set, each signal sent is recorded to it, along with the reason of
+	// the last event about each process.
+	audit      *json.Encoder
+	lastReason originals[string]
+	// Time of the current scan, and the clock it is read from.
+	now   time.Time
+	clock clock
+
+	// Processes we are not permitted to throttle. They are still accounted
+	// for, but never signalled.
+	unmanaged originals[struct{}]
+	// Processes left unmanaged because something other than memlimit
+	// stopped them, until they are continued.
+	stoppedElsewhere originals[struct{}]
+	// When each throttled process was throttled.
+	since originals[time.Time]
+	// Progress of escalation, for the process being escalated.
+	escalations originals[escalation]
+	// If set, unfiltered processes are made unlikely OOM killer targets, and
+	// the ones that were.
+	protectUnfiltered bool
+	protected         originals[struct{}]
+	// Processes in uninterruptible sleep, since when.
+	uninterruptible originals[dState]
+	// Throttles and releases not yet seen to have taken effect.
+	pending originals[pendingSignal]
+	// Processes killed for exceeding hardLimit or procLimit.
+	killed originals[struct{}]
+	// Manual overrides by process, overrideRun or overrideStop.
+	overrides originals[string]
+	// Filtered processes of the last scan, in victim order.
+	procs []tracked
+	// All processes of the last scan, and their children, for the
+	// dashboard.
+	lastStats map[int]procfs.ProcStat
+	lastPmap  map[int][]int
+	// Number of processes released, and throttled or released, so far in
+	// the current scan.
+	resumed  int
+	signaled int
+	// Set while enforcement is paused through -dbus, letting everything
+	// run.
+	enforcementPaused bool
+	// Result of the last scan.
+	status status
+	// Most recent events, oldest first.
+	events []event
+	// Runs the -hook commands, nil if there are none.
+	hooks *hooks
+	// With -notify, what shows desktop notifications, and whether one was
+	// shown since processes started being held throttled.
+	notify   *notifier
+	notified bool
+	// Clients of /events/stream, sent each event as it is emitted.
+	subscribers map[chan event]bool
+	// Memory of the most recent scans, oldest first.
+	history []sample
+	// Totals over the whole run.
+	summary summary
+
+	// How run finds processes: the -walk mode, and how often it does a full
+	// scan. Unless daemon is set, it returns once no trees are left.
+	walk          string
+	fullScanEvery int
+	daemon        bool
+	// Where run keeps the state file, if anywhere, and the -mode recorded
+	// in it.
+	stateFile string
+	mode      string
+	wd        *watchdog
+	oh        *overhead
+	// For the health checks: the check interval, when we started, and
+	// when the last scan finished and how long it took.
+	interval     time.Duration
+	started      time.Time
+	lastScan     time.Time
+	scanDuration time.Duration
+
+	// In verbose mode, the per-process table is only logged when it
+	// changes, or every logHeartbeat.
+	logHeartbeat  time.Duration
+	lastTable     string
+	lastTableTime time.Time
+
+	// If set, redrawn after each scan instead of printing the status line.
+	tui *tui
+}
+
+// Keys processes can be ordered by, from the first to be let run to the
+// first to be throttled. Ties are broken by starttime, then PID.
+var sortKeys = map[string]func(stat procfs.ProcStat) uint64{
+	"starttime": func(stat procfs.ProcStat) uint64 { return stat.Starttime },
+	"vsz":       func(stat procfs.ProcStat) uint64 { return stat.VirtualMemory() },
+	"rss":       func(stat procfs.ProcStat) uint64 { return stat.ResidentMemory() },
+	"cputime":   func(stat procfs.ProcStat) uint64 { return uint64(stat.UTime + stat.STime) },
+}
+
+// tracked is a filtered process along with the budgets it is charged to.
+type tracked struct {
+	stat    procfs.ProcStat
+	isLTO   bool
+	budgets []*budget
+	// VmSwap, so that RSS dropping can be told apart from memory being
+	// freed.
+	swap uint64
+	io   procIO
+}
+
+// procIO is how much a process has read from and written to storage.
+type procIO struct {
+	read, write uint64
+}
+
+// treePids returns the PIDs of the tree rooted at root, in ascending order.
+func treePids(pmap map[int][]int, root int) []int {
+	queue := []int{root}
+	var loopPid int
+	m := make(map[int]struct{})
+	m[root] = struct{}{}
+	for len(queue) > 0 {
+		loopPid, queue = queue[0], queue[1:]
+
+		for _, childPid := range pmap[loopPid] {
+			if _, ok := m[childPid]; ok {
+				continue
+			} else {
+				m[childPid] = struct{}{}
+				queue = append(queue, childPid)
+			}
+		}
+	}
+
+	pids := make([]int, 0, len(m))
+	for pid := range m {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// setScanDuration records how long the last scan took.
+func (m *monitor) setScanDuration(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status.ScanMillis = millis(d)
+	m.lastScan = m.clock.Now()
+	m.scanDuration = d
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// roots returns the top-level PIDs of the tracked trees.
+func (m *monitor) roots() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roots := make([]int, 0, len(m.trees))
+	for _, t := range m.trees {
+		roots = append(roots, t.pid)
+	}
+	return roots
+}
+
+// trackedPids returns the PIDs of all processes in the tracked trees as of
+// the last scan.
+func (m *monitor) trackedPids() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pids []int
+	for _, t := range m.trees {
+		pids = append(pids, t.pids...)
+	}
+	return pids
+}
+
+// prune drops trees whose top-level process has exited, logging each one,
+// and releases what is left of them rather than leaving it throttled with
+// nobody to release it. It returns false once no trees are left.
+func (m *monitor) prune(stats map[int]procfs.ProcStat) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	trees := m.trees[:0]
+	for _, t := range m.trees {
+		if s, ok := stats[t.pid]; ok && s.State != "Z" {
+			trees = append(trees, t)
+			continue
+		}
+		if t.rule != "" {
+			m.detach(t)
+		} else {
+			log.Printf("Process %d not found", t.pid)
+		}
+		if m.hooks != nil {
+			m.hooks.run("target-exit", m.newEvent("exit", procfs.ProcStat{PID: t.pid, Comm: t.comm}, 0, fmt.Sprintf("top-level process %d exited", t.pid)))
+		}
+
+		in := make(map[int]bool, len(t.pids))
+		for _, pid := range t.pids {
+			in[pid] = true
+		}
+		// With -walk children, processes that outlived the top-level one
+		// were reparented out of the tree and are no longer listed: read
+		// them afresh, or they would be left throttled.
+		var orphans map[int]procfs.ProcStat
+		if m.walk == "children" {
+			prev := make(map[int]procfs.ProcStat)
+			var pids []int
+			for _, p := range m.procs {
+				if _, ok := stats[p.stat.PID]; !ok && in[p.stat.PID] {
+					prev[p.stat.PID] = p.stat
+					pids = append(pids, p.stat.PID)
+				}
+			}
+			orphans = refreshMemory(prev, pids)
+		}
+		var releases []pendingRelease
+		for _, p := range m.procs {
+			stat, ok := stats[p.stat.PID]
+			if !ok {
+				stat, ok = orphans[p.stat.PID]
+			}
+			if !ok || stat.Starttime != p.stat.Starttime || !in[stat.PID] || !m.thr.throttled(stat) && !m.since.has(stat) {
+				continue
+			}
+			releases = append(releases, pendingRelease{stat, 0, fmt.Sprintf("top-level process %d exited", t.pid)})
+		}
+		m.releaseChildrenFirst(releases)
+	}
+	m.trees = trees
+	return len(m.trees) > 0
+}
+
+// PF_KTHREAD from linux/sched.h.
+const pfKthread = 0x00200000
+
+// ignored reports whether stat is a zombie or a kernel thread. Neither has
+// memory of its own to account, nor can be usefully signalled.
+func ignored(stat procfs.ProcStat) bool {
+	return stat.State == "Z" || stat.Flags&pfKthread != 0
+}
+
+// liveSwap reads VmSwap of stat from /proc.
+func liveSwap(stat procfs.ProcStat) uint64 {
+	proc, err := procfs.NewProc(stat.PID)
+	if err != nil {
+		return 0
+	}
+	status, err := proc.NewStatus()
+	if err != nil {
+		return 0
+	}
+	return status.VmSwap
+}
+
+// liveIO reads the storage I/O of stat from /proc.
+func liveIO(stat procfs.ProcStat) procIO {
+	proc, err := procfs.NewProc(stat.PID)
+	if err != nil {
+		return procIO{}
+	}
+	pio, err := proc.IO()
+	if err != nil {
+		return procIO{}
+	}
+	return procIO{read: pio.ReadBytes, write: pio.WriteBytes}
+}
+
+// liveClassify classifies processes from /proc.
+func liveClassify(stat procfs.ProcStat) (filtered, lto bool) {
+	if !isFiltered(stat) {
+		return false, false
+	}
+	return true, isLTO(stat)
+}
+
+// newTree returns a tree rooted at pid with the given VSZ limit.
+func newTree(pid int, limit uint64) *tree {
+	return &tree{pid: pid, budget: budget{name: "tree " + strconv.Itoa(pid), limit: limit}}
+}
+
+// scan applies the limits once, given a snapshot of all processes taken at
+// now.
+func (m *monitor) scan(now time.Time, stats map[int]procfs.ProcStat) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.now = now
+	m.hooks.startScan()
+	m.adapt()
+	var snap traceSnapshot
+	if m.trace != nil {
+		snap.Time = now
+		for _, t := range m.trees {
+			snap.Roots = append(snap.Roots, t.pid)
+		}
+	}
+
+	// Before the escalations and kills that tell which jobs were killed are
+	// pruned.
+	if m.memoryDB != nil {
+		m.memoryDB.prune(stats, m.now, m.killedJob)
+	}
+	m.thr.prune(stats)
+	m.topThr.prune(stats)
+	m.pidfds.prune(stats)
+	m.unmanaged.prune(stats)
+	m.jvmChecked.prune(stats)
+	m.stoppedElsewhere.prune(stats)
+	m.since.prune(stats)
+	m.overrides.prune(stats)
+	m.killed.prune(stats)
+	m.pending.prune(stats)
+	m.uninterruptible.prune(stats)
+	m.protected.prune(stats)
+	m.escalations.prune(stats)
+	m.placed.prune(stats)
+	m.pagedOut.prune(stats)
+	m.firstSeen.prune(stats)
+	m.resumedAt.prune(stats)
+	m.smoothed.prune(stats)
+	m.growth.prune(stats)
+	m.drivers.prune(stats)
+	m.ninjas.prune(stats)
+	m.io.prune(stats)
+	m.jobs.prune(stats)
+	m.lastReason.prune(stats)
+	m.resumed = 0
+	m.signaled = 0
+	m.global.reset()
+	m.lto.reset()
+	if m.hostLimit != 0 {
+		m.host.reset()
+		m.shareHost()
+	}
+	for _, b := range m.nodes {
+		b.reset()
+	}
+	if m.nodeLimit != 0 {
+		m.nodeUsage = make(map[int]map[int]uint64)
+	}
+
+	pmap := getPidMap(stats)
+	seen := make(map[int]bool)
+	var procs []tracked
+
+	for _, t := range m.trees {
+		t.reset()
+		t.pids = treePids(pmap, t.pid)
+		for _, pid := range t.pids {
+			// Nested trees are accounted to the first one listed.
+			if seen[pid] {
+				continue
+			}
+			seen[pid] = true
+
+			stat, ok := stats[pid]
+			if !ok || ignored(stat) {
+				continue
+			}
+			filtered, lto := m.classify(stat)
+			var swap uint64
+			var pio procIO
+			var job compileJob
+			if filtered {
+				swap = m.swapOf(stat)
+				pio = m.ioOf(stat)
+				m.io.save(stat, pio)
+				var ok bool
+				if job, ok = m.jobs.get(stat); !ok {
+					job = m.jobOf(stat)
+					m.jobs.save(stat, job)
+				}
+			}
+			if m.trace != nil {
+				snap.Procs = append(snap.Procs, newTraceProc(stat, filtered, lto, swap, pio, job))
+			}
+			if !filtered {
+				if m.protectUnfiltered && !m.protected.has(stat) {
+					m.protect(stat)
+				}
+				t.unfiltered++
+				t.unfilterableVsz += stat.VirtualMemory()
+				t.unfilterableRss += stat.ResidentMemory()
+				continue
+			}
+
+			if m.uid != 0 && !m.unmanaged.has(stat) && procUID(pid) != m.uid {
+				m.markUnmanaged(stat, "owned by another user")
+			}
+			if m.protectJVMDaemons && !m.unmanaged.has(stat) && !m.jvmChecked.has(stat) {
+				m.jvmChecked.save(stat, struct{}{})
+				if name, ok := jvmDaemon(stat); ok {
+					m.markUnmanaged(stat, name+", which builds after ours would hang on if stopped")
+				}
+			}
+			if m.thr.throttled(stat) {
+				t.stopped++
+			} else {
+				t.running++
+			}
+			if m.memoryDB != nil && job.source != "" {
+				m.memoryDB.observe(stat, job)
+			}
+			m.trackGrowth(stat)
+			if m.smoothWindow != 0 {
+				stat = m.smooth(stat)
+			}
+			if m.memoryDB != nil && job.source != "" {
+				stat = m.memoryDB.predict(stat, job)
+			}
+			if !m.firstSeen.has(stat) {
+				m.firstSeen.save(stat, now)
+			}
+			p := tracked{stat: stat, isLTO: lto, swap: swap, io: pio}
+			m.summary.sample(newProcStatus(stat), swap, pio, job)
+			if p.isLTO {
+				p.budgets = []*budget{&m.lto}
+			} else {
+				p.budgets = []*budget{&t.budget, &m.global}
+			}
+			if m.placement != nil && !m.unmanaged.has(stat) {
+				m.place(stat)
+			}
+			if m.hostLimit != 0 {
+				p.budgets = append(p.budgets, &m.host)
+			}
+			if m.nodeLimit != 0 {
+				p.budgets = append(p.budgets, m.nodeBudgets(stat)...)
+			}
+			procs = append(procs, p)
+		}
+	}
+
+	if m.trace != nil {
+		if err := m.trace.Encode(snap); err != nil {
+			log.Println("Error recording trace, disabling it:", err)
+			m.trace = nil
+		}
+	}
+
+	if m.config != nil {
+		m.detectPhase(procs)
+	}
+	m.chargeReservations(pmap, procs)
+	if m.maxLoad != 0 {
+		m.checkLoad(procs)
+	}
+	dataAge := m.clock.Now().Sub(now)
+	throttled := m.enforce(procs)
+	m.grantReservations()
+	if m.jobserver != nil {
+		m.adjustJobs()
+	}
+	if m.stopDrivers {
+		m.holdDrivers(stats, throttled)
+	}
+	if m.pauseNinjas {
+		m.holdNinjas(stats, throttled)
+	}
+	m.checkWarning()
+	m.checkAttainable(procs, throttled)
+	m.pageOutStopped(procs)
+	m.escalate(procs, throttled)
+	m.enforceHard(procs)
+	if m.maxStopped != 0 {
+		m.overMaxStopped(stats, procs)
+	}
+
+	if m.pauseTop {
+		for _, t := range m.trees {
+			m.pauseTree(t, stats[t.pid])
+		}
+	}
+
+	st := status{
+		VszLimit:      m.global.limit,
+		LTOVszLimit:   m.lto.limit,
+		Vsz:           m.global.vsz + m.lto.vsz,
+		Rss:           m.global.rss + m.lto.rss,
+		LTOVsz:        m.lto.vsz,
+		LTORss:        m.lto.rss,
+		WarnVszLimit:  m.warnLimit,
+		Warning:       m.warning,
+		HardVszLimit:  m.hardLimit,
+		Killed:        m.summary.kills,
+		Throttled:     throttled,
+		ScanMillis:    m.status.ScanMillis,
+		DataAgeMillis: millis(dataAge),
+		Phase:         m.phase,
+		Paused:        m.enforcementPaused,
+	}
+	if m.maxLoad != 0 {
+		st.Load, st.MaxLoad = m.load, m.maxLoad
+	}
+	if m.jobserver != nil {
+		st.Jobs = m.jobserver.effective()
+	}
+	st.Reserved, st.Reservations = m.reservationStatuses()
+	stopped := make(map[procStatus]bool, len(throttled))
+	for _, p := range throttled {
+		stopped[p] = true
+	}
+	for _, p := range procs {
+		if !stopped[newProcStatus(p.stat)] {
+			st.RunningVsz += p.stat.VirtualMemory()
+		}
+	}
+	if m.hostLimit != 0 {
+		st.HostVszLimit, st.Peers = m.host.limit, m.peers
+	}
+	for _, b := range m.budgets() {
+		if b.unattainable {
+			st.Unattainable = append(st.Unattainable, b.name)
+		}
+	}
+	for _, p := range procs {
+		st.Swap += p.swap
+		if action, ok := m.overrides.get(p.stat); ok {
+			st.Overrides = append(st.Overrides, overrideStatus{procStatus: newProcStatus(p.stat), Action: action})
+		}
+	}
+	if m.nodeLimit != 0 {
+		st.NodeLimit = m.nodeLimit
+		for _, node := range m.nodeIDs() {
+			b := m.nodes[node]
+			st.Nodes = append(st.Nodes, nodeStatus{Node: node, Usage: b.vsz, Procs: b.procs})
+		}
+	}
+	for _, t := range m.trees {
+		if vsz := t.budget.vsz + t.unfilterableVsz; vsz > t.peakVsz {
+			t.peakVsz = vsz
+		}
+		if rss := t.budget.rss + t.unfilterableRss; rss > t.peakRss {
+			t.peakRss = rss
+		}
+		if t.stopped > t.peakStopped {
+			t.peakStopped = t.stopped
+		}
+		ts := treeStatus{
+			PID:        t.pid,
+			Rule:       t.rule,
+			Pids:       t.pids,
+			Vsz:        t.budget.vsz,
+			Rss:        t.budget.rss,
+			Running:    t.running,
+			Stopped:    t.stopped,
+			Unfiltered: t.unfiltered,
+		}
+		if t.budget.limit != unlimited {
+			ts.VszLimit = t.budget.limit
+		}
+		st.Trees = append(st.Trees, ts)
+		st.Running += t.running
+		st.Stopped += t.stopped
+		st.Unfiltered += t.unfiltered
+		st.UnfilterableVsz += t.unfilterableVsz
+		st.UnfilterableRss += t.unfilterableRss
+	}
+	m.status = st
+	m.recordHistoryDB(st)
+	m.procs = procs
+	m.lastStats, m.lastPmap = stats, pmap
+	m.recordHistory(st)
+	if m.notify != nil {
+		m.notifyThrottling(st)
+	}
+	m.summary.scan(now, st)
+
+	if m.verbose && m.tableChanged(procs) {
+		for _, p := range procs {
+			stat := p.stat
+			job, _ := m.jobs.get(stat)
+			log.Println(stat.Starttime, stat.PID, stat.State, stat.Comm, formatSize(stat.VirtualMemory()), formatSize(stat.ResidentMemory()), formatSize(p.swap), formatSize(p.io.read), formatSize(p.io.write), job)
+		}
+		if len(st.Trees) > 1 {
+			for _, t := range st.Trees {
+				log.Printf("Tree %d VSZ: %s RSS: %s Procs: %d (Stopped: %d Running %d) Unfiltered: %d", t.PID, formatSize(t.Vsz), formatSize(t.Rss), t.Running+t.Stopped, t.Stopped, t.Running, t.Unfiltered)
+			}
+		}
+		log.Printf("Total VSZ: %s RSS: %s Swap: %s Procs: %d (Stopped: %d Running %d)", formatSize(st.Vsz), formatSize(st.Rss), formatSize(st.Swap), st.Running+st.Stopped, st.Stopped, st.Running)
+		if m.lto.procs > 0 {
+			log.Printf("LTO VSZ: %s RSS: %s Procs: %d", formatSize(st.LTOVsz), formatSize(st.LTORss), m.lto.procs)
+		}
+		log.Printf("Unfiltered VSZ: %s RSS: %s Procs: %d", formatSize(st.UnfilterableVsz), formatSize(st.UnfilterableRss), st.Unfiltered)
+	}
+	if m.tui != nil {
+		m.draw(procs, st)
+	} else if !m.verbose {
+		fmt.Printf(
+			"\r\033[2K[R:%d|S:%d|I:%d][V:%s][R:%s]",
+			st.Running,
+			st.Stopped,
+			st.Unfiltered,
+			formatSize(st.Vsz),
+			formatSize(st.Rss),
+		)
+	}
+}
+
+// checkWarning warns when the overall VSZ crosses warnLimit, and once it has
+// dropped clearly below it again.
+func (m *monitor) checkWarning() {
+	if m.warnLimit == 0 {
+		return
+	}
+	vsz := m.global.vsz
+	if !m.warning && vsz > m.warnLimit {
+		m.warning = true
+		m.emit(event{Time: m.now, Type: "warn", Vsz: vsz, Reason: fmt.Sprintf("overall VSZ %s exceeds %s warning threshold (limit %s)", formatSize(vsz), formatSize(m.warnLimit), formatSize(m.global.limit))})
+	} else if m.warning && vsz < m.warnLimit/10*9 {
+		m.warning = false
+		m.emit(event{Time: m.now, Type: "unwarn", Vsz: vsz, Reason: fmt.Sprintf("overall VSZ %s back below %s warning threshold", formatSize(vsz), formatSize(m.warnLimit))})
+	}
+}
+
+// checkAttainable warns when a process that is let run, such as the first in
+// victim order or one that is unmanaged or overridden, exceeds a limit on its
+// own: throttling everything else cannot bring usage under such a limit.
+func (m *monitor) checkAttainable(procs []tracked, throttled []procStatus) {
+	held := make(map[procStatus]bool, len(throttled))
+	for _, p := range throttled {
+		held[p] = true
+	}
+	over := make(map[*budget]procfs.ProcStat)
+	for _, p := range procs {
+		if held[newProcStatus(p.stat)] {
+			continue
+		}
+		for _, b := range p.budgets {
+			if cost := b.cost(p.stat); cost > b.limit && (over[b].PID == 0 || cost > b.cost(over[b])) {
+				over[b] = p.stat
+			}
+		}
+	}
+
+	for _, b := range m.budgets() {
+		stat, ok := over[b]
+		if ok && !b.unattainable {
+			b.unattainable = true
+			m.emit(m.newEvent("unattainable", stat, 0, fmt.Sprintf("%s %s alone exceeds %s limit of %s, which cannot be enforced while it runs", b.what(), formatSize(b.cost(stat)), b.name, formatSize(b.limit))))
+		} else if !ok && b.unattainable {
+			b.unattainable = false
+			m.emit(event{Time: m.now, Type: "attainable", Vsz: b.vsz, Reason: fmt.Sprintf("%s limit of %s can be enforced again", b.name, formatSize(b.limit))})
+		}
+	}
+}
+
+// budgets returns the overall, LTO, per-tree and per-node budgets.
+func (m *monitor) budgets() []*budget {
+	budgets := []*budget{&m.global, &m.lto}
+	if m.hostLimit != 0 {
+		budgets = append(budgets, &m.host)
+	}
+	for _, t := range m.trees {
+		budgets = append(budgets, &t.budget)
+	}
+	for _, node := range m.nodeIDs() {
+		budgets = append(budgets, m.nodes[node])
+	}
+	return budgets
+}
+
+// enforceHard kills the largest process once the total VSZ exceeds
+// hardLimit. Only one process is killed at a time, and not before the last
+// one has exited, to give its memory a chance to be freed.
+func (m *monitor) enforceHard(procs []tracked) {
+	total := m.global.vsz + m.lto.vsz
+	if m.hardLimit == 0 || total <= m.hardLimit {
+		return
+	}
+
+	var victim procfs.ProcStat
+	for _, p := range procs {
+		if m.killed.has(p.stat) && p.stat.State != "Z" {
+			return
+		}
+		if action, _ := m.overrides.get(p.stat); action == overrideRun || m.unmanaged.has(p.stat) {
+			continue
+		}
+		if p.stat.VirtualMemory() > victim.VirtualMemory() {
+			victim = p.stat
+		}
+	}
+	if victim.PID == 0 {
+		return
+	}
+
+	m.terminate(victim, syscall.SIGKILL, fmt.Sprintf("total VSZ %s exceeds %s hard limit by %s", formatSize(total), formatSize(m.hardLimit), formatSize(total-m.hardLimit)))
+}
+
+// terminate sends sig to stat to get rid of it, recording why.
+func (m *monitor) terminate(stat procfs.ProcStat, sig syscall.Signal, reason string) {
+	m.emit(m.newEvent("kill", stat, 0, reason))
+	if err := m.kill(stat, sig); err != nil {
+		log.Printf("Error killing %d %s: %v", stat.PID, stat.Comm, err)
+		return
+	}
+	if sig != syscall.SIGKILL {
+		// A stopped process only acts on the signal once continued.
+		m.kill(stat, syscall.SIGCONT)
+	}
+	m.killed.save(stat, struct{}{})
+	m.summary.kills++
+}
+
+// killedJob reports whether stat was killed by us, for a limit or by
+// escalating, rather than exiting on its own.
+func (m *monitor) killedJob(stat procfs.ProcStat) bool {
+	e, _ := m.escalations.get(stat)
+	return m.killed.has(stat) || e.steps > 0
+}
+
+// tableChanged reports whether the per-process table should be logged for
+// this scan: when a process appeared, exited or changed state, when a limit
+// was crossed, or when logHeartbeat has passed since it was last logged.
+func (m *monitor) tableChanged(procs []tracked) bool {
+	var sig strings.Builder
+	for _, p := range procs {
+		fmt.Fprintf(&sig, "%d:%s:%t ", p.stat.PID, p.stat.State, m.thr.throttled(p.stat))
+	}
+	for _, b := range m.budgets() {
+		fmt.Fprintf(&sig, "%t ", b.vsz > b.limit)
+	}
+
+	if sig.String() == m.lastTable && m.now.Sub(m.lastTableTime) < m.logHeartbeat {
+		return false
+	}
+	m.lastTable = sig.String()
+	m.lastTableTime = m.now
+	return true
+}
+
+// pauseTree stops or resumes the top-level process of t depending on whether
+// t or the overall cap is over its limit. Pausing the driver stops new jobs
+// from being spawned; the ones already running are left alone to finish.
+func (m *monitor) pauseTree(t *tree, top procfs.ProcStat) {
+	var exceeded []*budget
+	for _, b := range []*budget{&t.budget, &m.global, &m.lto} {
+		if b.vsz > b.limit && !m.enforcementPaused {
+			exceeded = append(exceeded, b)
+		}
+	}
+	if len(exceeded) > 0 && !m.topThr.throttled(top) {
+		m.emit(m.newEvent("pause", top, 0, exceededReason(exceeded)))
+		if err := m.topThr.throttle(top); err != nil {
+			log.Printf("Error pausing %d %s: %v", top.PID, top.Comm, err)
+		} else {
+			m.summary.pauses++
+		}
+	} else if len(exceeded) == 0 && m.topThr.throttled(top) {
+		m.emit(m.newEvent("unpause", top, 0, withinReason([]*budget{&t.budget, &m.global, &m.lto})))
+		if err := m.topThr.release(top); err != nil {
+			log.Printf("Error unpausing %d %s: %v", top.PID, top.Comm, err)
+		}
+	}
+}
+
+// enforce keeps the first processes in sortKey order running and throttles
+// the rest once a budget they are charged to is exceeded, releasing
+// processes again as room frees up. LTO links go first so that they are
+// released before anything else once memory frees up. It returns the
+// processes left throttled.
+func (m *monitor) enforce(procs []tracked) []procStatus {
+	var throttled []procStatus
+	var releases []pendingRelease
+
+	// Drivers that were throttled in their own right, whose children are
+	// throttled with them.
+	frozen := make(map[int]bool)
+	if m.stopDrivers {
+		for _, p := range procs {
+			if m.since.has(p.stat) && isDriver(p.stat) {
+				frozen[p.stat.PID] = true
+			}
+		}
+	}
+
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].isLTO != procs[j].isLTO {
+			return procs[i].isLTO
+		}
+		if ki, kj := m.sortKey(procs[i].stat), m.sortKey(procs[j].stat); ki != kj {
+			return ki < kj != m.sortDesc
+		}
+		if procs[i].stat.Starttime != procs[j].stat.Starttime {
+			return procs[i].stat.Starttime < procs[j].stat.Starttime
+		}
+		return procs[i].stat.PID < procs[j].stat.PID
+	})
+	var envs map[int]policyEnv
+	if m.policy != nil {
+		envs = m.sortByPolicy(procs)
+	}
+
+	var nLinkers, nLoad, nStopped int
+	for _, p := range procs {
+		if m.thr.throttled(p.stat) {
+			nStopped++
+		}
+	}
+	m.heldBack = m.heldBack[:0]
+	for i, p := range procs {
+		stat := p.stat
+		rank := i + 1
+		var exceeded []*budget
+		for _, b := range p.budgets {
+			b.charge(stat)
+			if b.exceeded() {
+				exceeded = append(exceeded, b)
+			}
+		}
+		// Like memory, linker slots go to processes in victim order,
+		// whether or not they are throttled.
+		overLinkers := false
+		if m.maxLinkers != 0 && isLinker(stat) {
+			nLinkers++
+			overLinkers = nLinkers > m.maxLinkers
+		}
+		// So do -max-load slots.
+		overLoad := false
+		if m.loadSlots != 0 && !m.unmanaged.has(stat) {
+			nLoad++
+			overLoad = nLoad > m.loadSlots
+		}
+		if !m.pauseTop {
+			m.checkStoppedElsewhere(stat, rank)
+		}
+		if m.pauseTop || m.unmanaged.has(stat) {
+			continue
+		}
+		if m.drivers.has(stat) {
+			// Held along with its children by holdDrivers.
+			throttled = append(throttled, newProcStatus(stat))
+			continue
+		}
+
+		// Signals only take effect once a process is out of
+		// uninterruptible sleep, so leave it be until then. It doesn't
+		// hold back newer processes meanwhile.
+		if stat.State == "D" {
+			m.checkUninterruptible(stat)
+			continue
+		}
+		m.uninterruptible.take(stat)
+
+		// Stopping and continuing are asynchronous, so check on the
+		// last action before deciding on the next one.
+		if pending, ok := m.pending.get(stat); ok {
+			if m.thr.throttled(stat) != pending.throttle {
+				m.retry(stat, pending)
+				if pending.throttle {
+					throttled = append(throttled, newProcStatus(stat))
+					for _, b := range p.budgets {
+						b.stopped = true
+					}
+				}
+				continue
+			}
+			m.pending.take(stat)
+		} else if m.since.has(stat) && !m.thr.throttled(stat) {
+			m.emit(m.newEvent("continued", stat, rank, "continued by something other than memlimit"))
+			m.since.take(stat)
+		}
+
+		// While enforcement is paused, everything is let run.
+		if m.enforcementPaused {
+			if m.thr.throttled(stat) {
+				releases = append(releases, pendingRelease{stat, rank, "enforcement paused"})
+			}
+			continue
+		}
+
+		// Overridden processes don't hold back newer ones, so budgets are
+		// not marked stopped on their account.
+		if action, ok := m.overrides.get(stat); ok {
+			if action == overrideStop {
+				if m.thr.throttled(stat) || m.throttle(stat, rank, "manual override") {
+					throttled = append(throttled, newProcStatus(stat))
+				}
+			} else if m.thr.throttled(stat) {
+				releases = append(releases, pendingRelease{stat, rank, "manual override"})
+			}
+			continue
+		}
+
+		// So aren't they on account of the -policy-script.
+		if env, ok := envs[stat.PID]; ok {
+			env["rank"], env["used"], env["stopped"] = float64(rank), float64(m.global.vsz+m.lto.vsz), float64(nStopped)
+			action, reason := m.policy.decide(env)
+			if action == overrideStop {
+				if m.thr.throttled(stat) {
+					throttled = append(throttled, newProcStatus(stat))
+				} else if m.throttle(stat, rank, reason) {
+					throttled = append(throttled, newProcStatus(stat))
+					nStopped++
+				}
+				continue
+			} else if action == overrideRun {
+				if m.thr.throttled(stat) {
+					releases = append(releases, pendingRelease{stat, rank, reason})
+				}
+				continue
+			}
+		}
+
+		if m.procLimit != 0 && stat.VirtualMemory() > m.procLimit {
+			reason := fmt.Sprintf("VSZ %s exceeds %s per-process limit", formatSize(stat.VirtualMemory()), formatSize(m.procLimit))
+			switch {
+			case m.procAction == "stop":
+				if m.thr.throttled(stat) || m.throttle(stat, rank, reason) {
+					throttled = append(throttled, newProcStatus(stat))
+				}
+			case m.killed.has(stat):
+			case m.procAction == "kill":
+				m.terminate(stat, syscall.SIGKILL, reason)
+			default:
+				m.terminate(stat, syscall.SIGTERM, reason)
+			}
+			continue
+		}
+
+		if frozen[stat.PPID] {
+			if m.thr.throttled(stat) || m.throttle(stat, rank, fmt.Sprintf("its driver %d is throttled", stat.PPID)) {
+				throttled = append(throttled, newProcStatus(stat))
+			}
+			continue
+		}
+
+		if len(exceeded) > 0 || overLinkers || overLoad {
+			// Young processes are likely to exit before throttling
+			// them pays off, and throttling processes just released
+			// would have them flap while usage hovers at the limit.
+			if !m.thr.throttled(stat) && (m.young(stat) || m.inGrace(stat)) {
+				continue
+			}
+			reason := exceededReason(exceeded)
+			switch {
+			case len(exceeded) > 0:
+			case overLinkers:
+				reason = fmt.Sprintf("all %d -max-linkers slots taken by linkers ahead of it", m.maxLinkers)
+			default:
+				reason = fmt.Sprintf("1-minute load average %.2f exceeds -max-load %.2f, with %d processes ahead of it let run", m.load, m.maxLoad, m.loadSlots)
+			}
+			if !m.thr.throttled(stat) {
+				if m.maxStopped != 0 && nStopped >= m.maxStopped {
+					m.heldBack = append(m.heldBack, stat)
+					continue
+				}
+				if !m.throttle(stat, rank, reason) {
+					continue
+				}
+				nStopped++
+			}
+			throttled = append(throttled, newProcStatus(stat))
+			for _, b := range exceeded {
+				b.stopped = true
+			}
+		} else if m.thr.throttled(stat) && m.resumed < m.resumeLimit && m.signaled < m.signalLimit {
+			releases = append(releases, pendingRelease{stat, rank, withinReason(p.budgets)})
+			m.resumed++
+			m.signaled++
+		} else if m.thr.throttled(stat) {
+			throttled = append(throttled, newProcStatus(stat))
+			for _, b := range p.budgets {
+				b.stopped = true
+			}
+		}
+	}
+	m.releaseChildrenFirst(releases)
+
+	return throttled
+}
+
+// pendingRelease is a release decided on, carried out along with the others
+// of the scan.
+type pendingRelease struct {
+	stat   procfs.ProcStat
+	rank   int
+	reason string
+}
+
+// releaseChildrenFirst carries out releases, newest process first. Children
+// start after their parents, so they are resumed first, and a parent doesn't
+// block right away on a pipe to a child that is still stopped.
+func (m *monitor) releaseChildrenFirst(releases []pendingRelease) {
+	sort.Slice(releases, func(i, j int) bool {
+		if releases[i].stat.Starttime != releases[j].stat.Starttime {
+			return releases[i].stat.Starttime > releases[j].stat.Starttime
+		}
+		// Started within the same clock tick.
+		return releases[i].stat.PID > releases[j].stat.PID
+	})
+	for _, r := range releases {
+		m.release(r.stat, r.rank, r.reason)
+	}
+}
+
+// young reports whether stat is younger than minAge.
+func (m *monitor) young(stat procfs.ProcStat) bool {
+	seen, ok := m.firstSeen.get(stat)
+	return ok && m.now.Sub(seen) < m.minAge
+}
+
+// inGrace reports whether stat was released less than resumeGrace ago.
+func (m *monitor) inGrace(stat procfs.ProcStat) bool {
+	at, ok := m.resumedAt.get(stat)
+	return ok && m.now.Sub(at) < m.resumeGrace
+}
+
+// throttle throttles stat, recording why. It returns false if stat turned
+// out to be unmanageable, or if -signal-limit processes were already
+// throttled or released in this scan.
+func (m *monitor) throttle(stat procfs.ProcStat, rank int, reason string) bool {
+	if m.signaled >= m.signalLimit {
+		return false
+	}
+	m.signaled++
+	e := m.newEvent("throttle", stat, rank, reason)
+	m.emit(e)
+	m.hooks.run("pre-stop", e)
+	if err := m.thr.throttle(stat); errors.Is(err, syscall.EPERM) {
+		m.markUnmanaged(stat, err.Error())
+		return false
+	} else if err != nil {
+		log.Printf("Error throttling %d %s: %v", stat.PID, stat.Comm, err)
+	} else {
+		m.since.save(stat, m.now)
+		m.pending.save(stat, pendingSignal{throttle: true})
+		m.summary.proc(newProcStatus(stat)).throttles++
+		m.hooks.run("post-stop", e)
+	}
+	return true
+}
+
+// release releases stat, recording why.
+func (m *monitor) release(stat procfs.ProcStat, rank int, reason string) {
+	e := m.newEvent("release", stat, rank, reason)
+	m.emit(e)
+	m.hooks.run("pre-resume", e)
+	if err := m.thr.release(stat); errors.Is(err, syscall.EPERM) {
+		m.markUnmanaged(stat, err.Error())
+	} else if err != nil {
+		log.Printf("Error releasing %d %s: %v", stat.PID, stat.Comm, err)
+	} else {
+		if since, ok := m.since.get(stat); ok {
+			m.summary.freeze(m.now.Sub(since))
+		}
+		m.since.take(stat)
+		m.resumedAt.save(stat, m.now)
+		m.pending.save(stat, pendingSignal{throttle: false})
+		m.summary.proc(newProcStatus(stat)).releases++
+	}
+}
+
+// releaseAll releases every process we throttled, and unpauses the
+// top-level processes paused in pause-top mode, for when we stop.
+func (m *monitor) releaseAll(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks.startScan()
+
+	var releases []pendingRelease
+	for _, p := range m.procs {
+		if m.thr.throttled(p.stat) || m.since.has(p.stat) {
+			releases = append(releases, pendingRelease{p.stat, 0, reason})
+		}
+	}
+	m.releaseChildrenFirst(releases)
+	for _, e := range m.drivers {
+		m.releaseDriver(e.value, reason)
+	}
+	m.drivers = make(originals[procfs.ProcStat])
+	m.releaseNinjas(reason)
+	if !m.pauseTop && m.maxStopped == 0 {
+		return
+	}
+	for _, t := range m.trees {
+		proc, err := procfs.NewProc(t.pid)
+		if err != nil {
+			continue
+		}
+		top, err := proc.Stat()
+		if err != nil || !m.topThr.throttled(top) {
+			continue
+		}
+		m.emit(m.newEvent("unpause", top, 0, reason))
+		if err := m.topThr.release(top); err != nil {
+			log.Printf("Error unpausing %d %s: %v", top.PID, top.Comm, err)
+		}
+	}
+}
+
+// How long a process may be in uninterruptible sleep before it is reported.
+const dStateWarn = 10 * time.Second
+
+// dState is when a process went into uninterruptible sleep.
+type dState struct {
+	since    time.Time
+	reported bool
+}
+
+// checkUninterruptible reports stat once it has been in uninterruptible
+// sleep for dStateWarn. Compilers rarely block on I/O for that long, unless
+// they are waiting on swap.
+func (m *monitor) checkUninterruptible(stat procfs.ProcStat) {
+	d, ok := m.uninterruptible.get(stat)
+	if !ok {
+		d.since = m.now
+	}
+	if !d.reported && m.now.Sub(d.since) >= dStateWarn {
+		m.emit(m.newEvent("uninterruptible", stat, 0, fmt.Sprintf("in uninterruptible sleep for %v, possibly thrashing swap", m.now.Sub(d.since).Round(time.Second))))
+		d.reported = true
+	}
+	m.uninterruptible.save(stat, d)
+}
+
+// Number of scans after which a process that was not stopped or continued
+// as asked is reported as stuck.
+const stuckScans = 4
+
+// pendingSignal is a throttle or release of a process yet to take effect.
+type pendingSignal struct {
+	throttle bool
+	// Number of scans it has not taken effect for.
+	scans int
+}
+
+// retry throttles or releases stat again, as p did not take effect, and
+// reports the process once it looks stuck, e.g. in uninterruptible sleep
+// or being continued as soon as it is stopped.
+func (m *monitor) retry(stat procfs.ProcStat, p pendingSignal) {
+	p.scans++
+	m.pending.save(stat, p)
+
+	action, err := "continued", error(nil)
+	if p.throttle {
+		action, err = "throttled", m.thr.throttle(stat)
+	} else {
+		err = m.thr.release(stat)
+	}
+	if err != nil {
+		log.Printf("Error retrying %d %s: %v", stat.PID, stat.Comm, err)
+	}
+	if p.scans == stuckScans {
+		m.emit(m.newEvent("stuck", stat, 0, fmt.Sprintf("not %s after %d attempts, in state %s", action, p.scans+1, stat.State)))
+	}
+}
+
+// setOverride sets (or, with an empty action, clears) the manual override of
+// pid, which has to be a filtered process of the last scan. It takes effect
+// on the next scan.
+func (m *monitor) setOverride(pid int, action string) error {
+	for _, p := range m.procs {
+		if p.stat.PID != pid {
+			continue
+		}
+		if action == "" {
+			log.Printf("Clearing override of %d %s", pid, p.stat.Comm)
+			m.overrides.take(p.stat)
+		} else {
+			log.Printf("Overriding %d %s: %s", pid, p.stat.Comm, action)
+			m.overrides.save(p.stat, action)
+		}
+		return nil
+	}
+	return fmt.Errorf("process %d is not a tracked filtered process", pid)
+}
+
+func newProcStatus(stat procfs.ProcStat) procStatus {
+	return procStatus{PID: stat.PID, Starttime: stat.Starttime, Comm: stat.Comm}
+}
+
+// OOM score adjustment of unfiltered processes with -protect-unfiltered. Short
+// of -1000, so that they remain the OOM killer's last resort.
+const protectedOOMScoreAdj = -900
+
+// protect makes stat, the build orchestrator or a shell, an unlikely target
+// for the OOM killer, so that it survives over a compiler if it comes to it.
+func (m *monitor) protect(stat procfs.ProcStat) {
+	m.protected.save(stat, struct{}{})
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", stat.PID)
+	if err := os.WriteFile(path, []byte(strconv.Itoa(protectedOOMScoreAdj)), 0); err != nil && m.verbose {
+		log.Printf("Error protecting %d %s from the OOM killer: %v", stat.PID, stat.Comm, err)
+	}
+}
+
+// checkStoppedElsewhere leaves stat unmanaged while it is stopped by
+// something other than memlimit, e.g. suspended with Ctrl-Z or by another
+// tool, rather than continuing it. A process with a throttle or release of
+// ours yet to take effect is stopped by us, even if the throttler no longer
+// counts it as throttled, e.g. as the stop took more than a scan to land.
+func (m *monitor) checkStoppedElsewhere(stat procfs.ProcStat, rank int) {
+	switch {
+	case m.stoppedElsewhere.has(stat):
+		if stat.State != "T" {
+			m.emit(m.newEvent("continued", stat, rank, "continued by something other than memlimit, managing it again"))
+			m.stoppedElsewhere.take(stat)
+			m.unmanaged.take(stat)
+		}
+	case stat.State == "T" && !m.thr.throttled(stat) && !m.pending.has(stat) && !m.unmanaged.has(stat):
+		m.emit(m.newEvent("stopped", stat, rank, "stopped by something other than memlimit, leaving it unmanaged until continued"))
+		m.stoppedElsewhere.save(stat, struct{}{})
+		m.unmanaged.save(stat, struct{}{})
+	}
+}
+
+// markUnmanaged stops us from ever signalling stat again.
+func (m *monitor) markUnmanaged(stat procfs.ProcStat, reason string) {
+	log.Printf("Leaving %d %s unmanaged: %s", stat.PID, stat.Comm, reason)
+	m.unmanaged.save(stat, struct{}{})
+}
+
+// procUID returns the UID owning pid, or -1 if it cannot be determined.
+func procUID(pid int) int {
+	fi, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	if err != nil {
+		return -1
+	}
+	return int(fi.Sys().(*syscall.Stat_t).Uid)
+}
@@ -0,0 +1,379 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// newTestMonitor returns a monitor with an overall limit of limit over trees,
+// set up as main does for -replay: nothing is signalled, time only moves with
+// the returned clock, processes are filtered by filtered rather than by what
+// /proc says about them, and the process table is logged (rather than the
+// status line printed) only when it changes.
+func newTestMonitor(limit uint64, filtered func(procfs.ProcStat) bool, trees ...*tree) (*monitor, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := &monitor{
+		trees:            trees,
+		global:           budget{name: "overall", limit: limit},
+		lto:              budget{name: "LTO", limit: unlimited},
+		host:             budget{name: "host"},
+		resumeLimit:      math.MaxInt,
+		signalLimit:      math.MaxInt,
+		nodes:            make(map[int]*budget),
+		placed:           make(originals[struct{}]),
+		firstSeen:        make(originals[time.Time]),
+		resumedAt:        make(originals[time.Time]),
+		smoothed:         make(originals[ewma]),
+		growth:           make(originals[growth]),
+		ninjas:           make(originals[procfs.ProcStat]),
+		drivers:          make(originals[procfs.ProcStat]),
+		pagedOut:         make(originals[struct{}]),
+		declined:         make(originals[struct{}]),
+		pidfds:           newPidfds(),
+		kill:             func(procfs.ProcStat, syscall.Signal) error { return nil },
+		verbose:          true,
+		logHeartbeat:     time.Hour,
+		interval:         time.Second,
+		started:          clock.now,
+		clock:            clock,
+		sortBy:           "starttime",
+		thr:              &dryRunThrottler{set: make(originals[struct{}])},
+		topThr:           &dryRunThrottler{set: make(originals[struct{}])},
+		classify:         func(stat procfs.ProcStat) (bool, bool) { return filtered(stat), false },
+		swapOf:           func(procfs.ProcStat) uint64 { return 0 },
+		ioOf:             func(procfs.ProcStat) procIO { return procIO{} },
+		io:               make(originals[procIO]),
+		jobOf:            func(procfs.ProcStat) compileJob { return compileJob{} },
+		jobs:             make(originals[compileJob]),
+		lastReason:       make(originals[string]),
+		jvmChecked:       make(originals[struct{}]),
+		unmanaged:        make(originals[struct{}]),
+		stoppedElsewhere: make(originals[struct{}]),
+		since:            make(originals[time.Time]),
+		overrides:        make(originals[string]),
+		killed:           make(originals[struct{}]),
+		protected:        make(originals[struct{}]),
+		escalations:      make(originals[escalation]),
+		pending:          make(originals[pendingSignal]),
+		uninterruptible:  make(originals[dState]),
+	}
+	m.sortKey, _ = m.sortKeyFunc(m.sortBy)
+	return m, clock
+}
+
+// buildStats returns a make process, as PID 1000, and n compilers under it
+// of 100 to 400 MiB each, started one clock tick apart.
+func buildStats(n int) map[int]procfs.ProcStat {
+	stats := map[int]procfs.ProcStat{
+		1000: {PID: 1000, PPID: 1, Comm: "make", State: "S", Starttime: 1, VSize: 8 << 20, RSS: 1 << 10},
+	}
+	for i := 1; i <= n; i++ {
+		vsz := uint64(100+i*37%300) << 20
+		stats[1000+i] = procfs.ProcStat{PID: 1000 + i, PPID: 1000, Comm: "cc1plus", State: "R", Starttime: uint64(1 + i), VSize: vsz, RSS: vsz / 2 / 4096}
+	}
+	return stats
+}
+
+func isCompiler(stat procfs.ProcStat) bool {
+	return stat.Comm == "cc1plus"
+}
+
+// BenchmarkScan measures a scan of a build of as many compilers as the
+// sub-benchmark is named after, with about half of them over the limit.
+func BenchmarkScan(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			stats := buildStats(n)
+			m, clock := newTestMonitor(uint64(n)*125<<20, isCompiler, newTree(1000, unlimited))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				clock.Sleep(time.Second)
+				m.prune(stats)
+				m.scan(clock.Now(), stats)
+			}
+		})
+	}
+}
+
+// TestLateStopNotStoppedElsewhere checks that a process whose stop only
+// lands after the throttler stopped counting it as throttled is stopped
+// again, rather than left unmanaged as stopped by someone else.
+func TestLateStopNotStoppedElsewhere(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	stats := buildStats(2)
+	m, clock := newTestMonitor(200<<20, isCompiler, newTree(1000, unlimited))
+	newest := stats[1002]
+	scan := func() {
+		clock.Sleep(time.Second)
+		m.prune(stats)
+		m.scan(clock.Now(), stats)
+	}
+
+	scan()
+	if !m.thr.throttled(newest) {
+		t.Fatalf("%d not throttled", newest.PID)
+	}
+	// Seen still running, and so no longer counted as stopped, then
+	// stopped on the next scan.
+	m.thr.(*dryRunThrottler).set.take(newest)
+	newest.State = "T"
+	stats[newest.PID] = newest
+	scan()
+	if m.unmanaged.has(newest) || m.stoppedElsewhere.has(newest) {
+		t.Errorf("%d taken as stopped by something other than memlimit", newest.PID)
+	}
+	if !m.thr.throttled(newest) {
+		t.Errorf("%d not throttled again", newest.PID)
+	}
+}
+
+// TestOrphansReleased checks that with -walk children, processes throttled
+// when the top-level process exits are released, though reparented out of
+// the tree and no longer listed.
+func TestOrphansReleased(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	const top = 1 << 30
+	stats := map[int]procfs.ProcStat{
+		top: {PID: top, PPID: 1, Comm: "make", State: "S", Starttime: 1},
+	}
+	for pid, stat := range startSleepers(t, 2) {
+		stat.PPID = top
+		stats[pid] = stat
+	}
+	m, clock := newTestMonitor(unlimited, func(stat procfs.ProcStat) bool { return stat.PID != top }, newTree(top, unlimited))
+	m.walk = "children"
+	m.prune(stats)
+	m.scan(clock.Now(), stats)
+	for pid, stat := range stats {
+		if pid != top {
+			if err := m.thr.throttle(stat); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	m.prune(map[int]procfs.ProcStat{})
+	for pid, stat := range stats {
+		if pid != top && m.thr.throttled(stat) {
+			t.Errorf("%d left throttled", pid)
+		}
+	}
+}
+
+// TestDriverStopsChildren checks that drivers and their compilers are held
+// as a unit in stop mode, whichever of the two was throttled.
+func TestDriverStopsChildren(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	// Past any PID in use, so that drivers are told apart by name.
+	const top, driver, cc1 = 1 << 23, 1<<23 + 1, 1<<23 + 2
+	stats := map[int]procfs.ProcStat{
+		top:    {PID: top, PPID: 1, Comm: "make", State: "S", Starttime: 1, VSize: 8 << 20},
+		driver: {PID: driver, PPID: top, Comm: "clang", State: "S", Starttime: 2, VSize: 64 << 20},
+		cc1:    {PID: cc1, PPID: driver, Comm: "cc1plus", State: "R", Starttime: 3, VSize: 512 << 20},
+	}
+	filtered := func(stat procfs.ProcStat) bool { return stat.PID != top }
+	for _, tc := range []struct {
+		name  string
+		limit uint64
+		stop  int
+	}{
+		{"compiler over the limit", 256 << 20, 0},
+		{"driver stopped by hand", unlimited, driver},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m, clock := newTestMonitor(tc.limit, filtered, newTree(top, unlimited))
+			m.stopDrivers = true
+			for i := 0; i < 3; i++ {
+				clock.Sleep(time.Second)
+				m.prune(stats)
+				m.scan(clock.Now(), stats)
+				if i == 0 && tc.stop != 0 {
+					if err := m.setOverride(tc.stop, overrideStop); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, pid := range []int{driver, cc1} {
+				if !m.thr.throttled(stats[pid]) {
+					t.Errorf("%d %s not throttled", pid, stats[pid].Comm)
+				}
+			}
+		})
+	}
+}
+
+// enforceStep is a number of scans a second apart, after setting the VSZ of
+// some processes and having others exit, and what is expected after them.
+type enforceStep struct {
+	scans int
+	// VSZs to set, in MiB, and processes that exited, before the scans.
+	vsz  map[int]uint64
+	exit []int
+	// The compilers throttled, whether the top-level process is paused,
+	// and the signals sent since the start, after the scans.
+	throttled []int
+	paused    bool
+	signals   []string
+	// If set, the time each process was held throttled in all, and the
+	// longest any was at a stretch, as accounted in the summary.
+	heldFor map[int]time.Duration
+	freeze  time.Duration
+}
+
+// TestEnforceOverTime drives scans of builds of compilers of 137, 174, 211
+// and 248 MiB, under make 1000, on the fake clock.
+func TestEnforceOverTime(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range []struct {
+		name      string
+		limit     uint64
+		compilers int
+		setup     func(m *monitor)
+		steps     []enforceStep
+	}{
+		{
+			name: "over limit", limit: 200 << 20, compilers: 2,
+			steps: []enforceStep{
+				{scans: 1, throttled: []int{1002}},
+				{scans: 1, vsz: map[int]uint64{1001: 10}},
+			},
+		},
+		{
+			// Let young processes run until they are 5s old.
+			name: "-min-age", limit: 200 << 20, compilers: 2,
+			setup: func(m *monitor) { m.minAge = 5 * time.Second },
+			steps: []enforceStep{
+				{scans: 5},
+				{scans: 1, throttled: []int{1002}},
+			},
+		},
+		{
+			// Don't throttle a process within 10s of releasing it.
+			name: "-resume-grace", limit: 200 << 20, compilers: 2,
+			setup: func(m *monitor) { m.resumeGrace = 10 * time.Second },
+			steps: []enforceStep{
+				{scans: 1, throttled: []int{1002}},
+				{scans: 1, vsz: map[int]uint64{1001: 10}},
+				{scans: 9, vsz: map[int]uint64{1001: 137}},
+				{scans: 1, throttled: []int{1002}},
+			},
+		},
+		{
+			// A process stopped for 5s, then released.
+			name: "stop duration", limit: 200 << 20, compilers: 2,
+			steps: []enforceStep{
+				{scans: 1, throttled: []int{1002}, heldFor: map[int]time.Duration{1002: 0}},
+				{scans: 4, throttled: []int{1002}, heldFor: map[int]time.Duration{1002: 4 * time.Second}},
+				{scans: 1, vsz: map[int]uint64{1001: 10}, heldFor: map[int]time.Duration{1002: 5 * time.Second}, freeze: 5 * time.Second},
+				{scans: 3, heldFor: map[int]time.Duration{1002: 5 * time.Second}, freeze: 5 * time.Second},
+			},
+		},
+		{
+			// TERM 10s after throttling, which the process survives and
+			// is throttled again, then KILL 5s later.
+			name: "-escalate", limit: 200 << 20, compilers: 2,
+			setup: func(m *monitor) { m.escalation, _ = parseEscalation("10s:TERM,5s:KILL") },
+			steps: []enforceStep{
+				{scans: 10, throttled: []int{1002}},
+				{scans: 1, throttled: []int{1002}, signals: []string{"1002 terminated", "1002 continued"}},
+				{scans: 4, throttled: []int{1002}, signals: []string{"1002 terminated", "1002 continued"}},
+				{scans: 1, throttled: []int{1002}, signals: []string{"1002 terminated", "1002 continued", "1002 killed"}},
+			},
+		},
+		{
+			// Released processes start over.
+			name: "-escalate after release", limit: 200 << 20, compilers: 2,
+			setup: func(m *monitor) { m.escalation, _ = parseEscalation("10s:TERM") },
+			steps: []enforceStep{
+				{scans: 8, throttled: []int{1002}},
+				{scans: 1, vsz: map[int]uint64{1001: 10}},
+				{scans: 1, vsz: map[int]uint64{1001: 137}, throttled: []int{1002}},
+				{scans: 9, throttled: []int{1002}},
+				{scans: 1, throttled: []int{1002}, signals: []string{"1002 terminated", "1002 continued"}},
+			},
+		},
+		{
+			// With 1002 throttled, 1003 is held back by pausing make,
+			// and killed if that didn't help within maxStoppedGrace.
+			name: "-max-stopped", limit: 200 << 20, compilers: 3,
+			setup: func(m *monitor) { m.maxStopped = 1 },
+			steps: []enforceStep{
+				{scans: 1, throttled: []int{1002}, paused: true},
+				{scans: 4, throttled: []int{1002}, paused: true},
+				{scans: 1, throttled: []int{1002}, paused: true, signals: []string{"1003 killed"}},
+				{scans: 1, exit: []int{1003}, throttled: []int{1002}, signals: []string{"1003 killed"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := buildStats(tt.compilers)
+			m, clock := newTestMonitor(tt.limit, isCompiler, newTree(1000, unlimited))
+			var signals []string
+			m.kill = func(stat procfs.ProcStat, sig syscall.Signal) error {
+				signals = append(signals, fmt.Sprint(stat.PID, " ", sig))
+				return nil
+			}
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			scans := 0
+			for _, step := range tt.steps {
+				for pid, mib := range step.vsz {
+					stat := stats[pid]
+					stat.VSize = mib << 20
+					stats[pid] = stat
+				}
+				for _, pid := range step.exit {
+					delete(stats, pid)
+				}
+				for i := 0; i < step.scans; i++ {
+					clock.Sleep(time.Second)
+					m.prune(stats)
+					m.scan(clock.Now(), stats)
+				}
+				scans += step.scans
+
+				var throttled []int
+				for pid := 1001; pid <= 1000+tt.compilers; pid++ {
+					if stat, ok := stats[pid]; ok && m.thr.throttled(stat) {
+						throttled = append(throttled, pid)
+					}
+				}
+				if fmt.Sprint(throttled) != fmt.Sprint(step.throttled) {
+					t.Errorf("after %d scans: throttled %v, want %v", scans, throttled, step.throttled)
+				}
+				if paused := m.topThr.throttled(stats[1000]); paused != step.paused {
+					t.Errorf("after %d scans: make paused %v, want %v", scans, paused, step.paused)
+				}
+				if fmt.Sprint(signals) != fmt.Sprint(step.signals) {
+					t.Errorf("after %d scans: sent %q, want %q", scans, signals, step.signals)
+				}
+				for pid, want := range step.heldFor {
+					if got := m.summary.proc(newProcStatus(stats[pid])).throttledFor; got != want {
+						t.Errorf("after %d scans: %d held for %v, want %v", scans, pid, got, want)
+					}
+				}
+				if step.heldFor != nil && m.summary.longestFreeze != step.freeze {
+					t.Errorf("after %d scans: longest freeze %v, want %v", scans, m.summary.longestFreeze, step.freeze)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/procfs"
+)
+
+// How far up from a compiler to look for the ninja running it.
+const ninjaDepth = 8
+
+// ninjaTarget returns the output of the ninja edge that stat is part of, or
+// "" if it isn't run by ninja. The edge is looked up by the hash of its
+// command in the .ninja_log of ninja, which has it once the edge was built
+// before, and its -o is used otherwise.
+func ninjaTarget(stat procfs.ProcStat) string {
+	edge := stat
+	for i := 0; i < ninjaDepth && edge.PPID > 1; i++ {
+		proc, err := procfs.NewProc(edge.PPID)
+		if err != nil {
+			return ""
+		}
+		parent, err := proc.Stat()
+		if err != nil {
+			return ""
+		}
+		if parent.Comm == "ninja" {
+			return edgeTarget(edge.PID, parent.PID)
+		}
+		edge = parent
+	}
+	return ""
+}
+
+// edgeTarget returns the output of the edge ninja runs as pid.
+func edgeTarget(pid, ninja int) string {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return ""
+	}
+	// Ninja runs edges with /bin/sh -c.
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if len(args) != 3 || args[1] != "-c" {
+		return ""
+	}
+	command := args[2]
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", ninja)); err == nil {
+		if out, ok := ninjaLogs.lookup(filepath.Join(cwd, ".ninja_log"), murmurHash64A([]byte(command))); ok {
+			return out
+		}
+	}
+	fields := strings.Fields(command)
+	for i, f := range fields {
+		if f == "-o" && i+1 < len(fields) {
+			return strings.TrimRight(fields[i+1], ";&|")
+		}
+	}
+	return ""
+}
+
+// buildDirs returns the directories that ninja may keep the .ninja_log of a
+// build of the command line args in: the current one, and the one given to
+// ninja, or to make or cmake running it, with -C, if it exists.
+func buildDirs(args []string) []string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	dirs := []string{cwd}
+	for i, arg := range args {
+		dir := strings.TrimPrefix(arg, "-C")
+		if dir == arg {
+			continue
+		}
+		if dir == "" && i+1 < len(args) {
+			dir = args[i+1]
+		}
+		if dir != "" && !filepath.IsAbs(dir) {
+			dir = filepath.Join(cwd, dir)
+		}
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// ninjaLog is the part of a .ninja_log read so far: the outputs of edges
+// by the hash of their commands.
+type ninjaLog struct {
+	offset  int64
+	outputs map[uint64]string
+}
+
+// ninjaLogCache keeps the .ninja_logs read, reading only what ninja
+// appended to them since.
+type ninjaLogCache struct {
+	mu   sync.Mutex
+	logs map[string]*ninjaLog
+}
+
+var ninjaLogs = ninjaLogCache{logs: make(map[string]*ninjaLog)}
+
+func (c *ninjaLogCache) lookup(path string, hash uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false
+	}
+	l := c.logs[path]
+	if l == nil || fi.Size() < l.offset {
+		// New, or rewritten by ninja to drop stale entries.
+		l = &ninjaLog{outputs: make(map[uint64]string)}
+		c.logs[path] = l
+	}
+	if fi.Size() > l.offset {
+		if _, err := f.Seek(l.offset, io.SeekStart); err == nil {
+			l.read(f)
+		}
+	}
+	out, ok := l.outputs[hash]
+	return out, ok
+}
+
+// read reads the complete lines of r, which are start, end, mtime, output
+// and command hash, separated by tabs.
+func (l *ninjaLog) read(r io.Reader) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		l.offset += int64(len(line))
+		fields := bytes.Split(bytes.TrimSuffix(line, []byte("\n")), []byte("\t"))
+		if len(fields) != 5 {
+			continue
+		}
+		if hash, err := strconv.ParseUint(string(fields[4]), 16, 64); err == nil {
+			l.outputs[hash] = string(fields[3])
+		}
+	}
+}
+
+// murmurHash64A is the hash of commands in .ninja_log.
+func murmurHash64A(data []byte) uint64 {
+	const (
+		seed = 0xDECAFBADDECAFBAD
+		m    = 0xc6a4a7935bd1e995
+		r    = 47
+	)
+	h := uint64(seed) ^ uint64(len(data))*m
+	for ; len(data) >= 8; data = data[8:] {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// holdNinjas stops the ninja processes in the tracked trees while processes
+// are held throttled, so that they start no new edges, and continues them
+// once none are.
+func (m *monitor) holdNinjas(stats map[int]procfs.ProcStat, throttled []procStatus) {
+	if len(throttled) == 0 {
+		m.releaseNinjas("no processes held throttled")
+		return
+	}
+	for _, t := range m.trees {
+		for _, pid := range t.pids {
+			stat, ok := stats[pid]
+			if !ok || stat.Comm != "ninja" || m.ninjas.has(stat) {
+				continue
+			}
+			m.emit(m.newEvent("pause", stat, 0, fmt.Sprintf("%d processes held throttled", len(throttled))))
+			if err := m.topThr.throttle(stat); err != nil {
+				log.Printf("Error pausing %d %s: %v", stat.PID, stat.Comm, err)
+				continue
+			}
+			m.ninjas.save(stat, stat)
+			m.summary.pauses++
+		}
+	}
+}
+
+// releaseNinjas continues the ninja processes stopped by holdNinjas.
+func (m *monitor) releaseNinjas(reason string) {
+	for pid, e := range m.ninjas {
+		m.emit(m.newEvent("unpause", e.value, 0, reason))
+		if err := m.topThr.release(e.value); err != nil {
+			log.Printf("Error unpausing %d %s: %v", pid, e.value.Comm, err)
+		}
+		delete(m.ninjas, pid)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// How long sending a desktop notification may take, and how many may wait
+// to be sent.
+const (
+	notifyTimeout = 5 * time.Second
+	notifyQueue   = 16
+)
+
+// notification is a desktop notification to show.
+type notification struct {
+	summary, body string
+	critical      bool
+}
+
+// notifier shows desktop notifications through the
+// org.freedesktop.Notifications service on the session D-Bus, one at a time
+// in the background so scans never wait on the bus.
+type notifier struct {
+	queue chan notification
+}
+
+func newNotifier() *notifier {
+	n := &notifier{queue: make(chan notification, notifyQueue)}
+	go n.run()
+	return n
+}
+
+// send queues a notification, dropping it if too many are waiting.
+func (n *notifier) send(summary, body string, critical bool) {
+	select {
+	case n.queue <- notification{summary, body, critical}:
+	default:
+	}
+}
+
+func (n *notifier) run() {
+	// Only log changes, not every notification while the bus is down.
+	failing := false
+	for note := range n.queue {
+		err := notify(note)
+		if err != nil && !failing {
+			log.Println("Error showing desktop notification:", err)
+		} else if err == nil && failing {
+			log.Println("Showing desktop notifications again")
+		}
+		failing = err != nil
+	}
+}
+
+// notifyThrottling notifies when processes start being held throttled,
+// and again only once none are.
+func (m *monitor) notifyThrottling(st status) {
+	switch {
+	case st.Stopped > 0 && !m.notified:
+		m.notify.send("Build throttled by memlimit", fmt.Sprintf("%d processes stopped, VSZ %s of the %s limit", st.Stopped, formatSize(st.Vsz), formatSize(st.VszLimit)), false)
+		m.notified = true
+	case st.Stopped == 0:
+		m.notified = false
+	}
+}
+
+// notify calls org.freedesktop.Notifications.Notify on the session bus.
+func notify(note notification) error {
+	addr, err := sessionBus()
+	if err != nil {
+		return err
+	}
+	c, err := dialDBus(addr, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(notifyTimeout))
+
+	urgency := byte(1)
+	if note.critical {
+		urgency = 2
+	}
+	var call dbusMessage
+	call.body.str("memlimit") // app_name
+	call.body.uint32(0)       // replaces_id
+	call.body.str("")         // app_icon
+	call.body.str(note.summary)
+	call.body.str(note.body)
+	call.body.uint32(0) // actions
+	// hints: {"urgency": <byte urgency>}
+	call.body.array(8, 1, func(int) {
+		call.body.str("urgency")
+		call.body.sig("y")
+		call.body.b = append(call.body.b, urgency)
+	})
+	call.body.int32(-1) // expire_timeout
+	// Wait for the reply, so that the call isn't dropped with the
+	// connection, and errors are seen.
+	_, err = c.call(&call, "/org/freedesktop/Notifications", "org.freedesktop.Notifications", "Notify", "org.freedesktop.Notifications", "susssasa{sv}i")
+	return err
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/prometheus/procfs"
+)
+
+// nodeStatus is the memory filtered processes have on a NUMA node.
+type nodeStatus struct {
+	Node  int    `json:"node"`
+	Usage uint64 `json:"usage"`
+	Procs int    `json:"procs"`
+}
+
+// numaUsage returns how much memory pid has on each NUMA node, from
+// /proc/<pid>/numa_maps.
+func numaUsage(pid int) (map[int]uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/numa_maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	usage := make(map[int]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		pageSize := uint64(4096)
+		pages := make(map[int]uint64)
+		for _, field := range strings.Fields(s.Text()) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if key == "kernelpagesize_kB" {
+				pageSize = n * 1024
+			} else if len(key) > 1 && key[0] == 'N' {
+				if node, err := strconv.Atoi(key[1:]); err == nil {
+					pages[node] += n
+				}
+			}
+		}
+		for node, n := range pages {
+			usage[node] += n * pageSize
+		}
+	}
+	return usage, s.Err()
+}
+
+// nodeBudgets reads which NUMA nodes stat has memory on, and returns the
+// budgets of those nodes, creating them on first use.
+func (m *monitor) nodeBudgets(stat procfs.ProcStat) []*budget {
+	usage, err := numaUsage(stat.PID)
+	if err != nil {
+		return nil
+	}
+	m.nodeUsage[stat.PID] = usage
+
+	var nodes []int
+	for node, bytes := range usage {
+		if bytes > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Ints(nodes)
+	budgets := make([]*budget, 0, len(nodes))
+	for _, node := range nodes {
+		b := m.nodes[node]
+		if b == nil {
+			node := node
+			b = &budget{
+				name:   fmt.Sprintf("node %d", node),
+				limit:  m.nodeLimit,
+				metric: "memory",
+				usage: func(stat procfs.ProcStat) uint64 {
+					return m.nodeUsage[stat.PID][node]
+				},
+			}
+			m.nodes[node] = b
+		}
+		budgets = append(budgets, b)
+	}
+	return budgets
+}
+
+// nodeIDs returns the NUMA nodes seen so far, in ascending order.
+func (m *monitor) nodeIDs() []int {
+	nodes := make([]int, 0, len(m.nodes))
+	for node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Ints(nodes)
+	return nodes
+}
+
+// numaNode is a NUMA node that compile jobs can be placed on.
+type numaNode struct {
+	id   int
+	cpus cpuSet
+}
+
+// numaNodes returns the NUMA nodes that have CPUs, from sysfs.
+func numaNodes() ([]numaNode, error) {
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var nodes []numaNode
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		list, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(list)) == "" {
+			// Memory-only node.
+			continue
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(list)))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, numaNode{id: id, cpus: cpus})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes, nil
+}
+
+// nodeMask is a NUMA node mask as passed to migrate_pages(2).
+type nodeMask [1024 / 64]uint64
+
+// place binds a newly seen process to the next NUMA node in turn, skipping
+// nodes that were over -node-limit-mb as of the last scan. Its CPUs are
+// confined to the node, so that its allocations from now on are local to
+// it, and what it has allocated so far is moved there.
+func (m *monitor) place(stat procfs.ProcStat) {
+	if m.placed.has(stat) {
+		return
+	}
+	m.placed.save(stat, struct{}{})
+
+	over := make(map[int]bool)
+	for _, n := range m.status.Nodes {
+		over[n.Node] = m.nodeLimit != 0 && n.Usage > m.nodeLimit
+	}
+	node := m.placement[m.placeNext%len(m.placement)]
+	for i := range m.placement {
+		if n := m.placement[(m.placeNext+i)%len(m.placement)]; !over[n.id] {
+			node = n
+			m.placeNext += i
+			break
+		}
+	}
+	m.placeNext++
+
+	if _, err := affinityAttr.apply(stat.PID, node.cpus); err != nil {
+		log.Printf("Error placing %d %s on node %d: %v", stat.PID, stat.Comm, node.id, err)
+		return
+	}
+	var from, to nodeMask
+	for _, n := range m.placement {
+		if n.id != node.id {
+			from[n.id/64] |= 1 << (uint(n.id) % 64)
+		}
+	}
+	to[node.id/64] |= 1 << (uint(node.id) % 64)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_MIGRATE_PAGES, uintptr(stat.PID), uintptr(len(from)*64+1), uintptr(unsafe.Pointer(&from)), uintptr(unsafe.Pointer(&to)), 0, 0); errno != 0 {
+		log.Printf("Error moving memory of %d %s to node %d: %v", stat.PID, stat.Comm, node.id, errno)
+	}
+	if m.verbose {
+		log.Printf("Placed %d %s on NUMA node %d", stat.PID, stat.Comm, node.id)
+	}
+}
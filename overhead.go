@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// overhead measures what memlimit itself costs: how long scans take, how
+// much CPU it burns and how much it allocates.
+type overhead struct {
+	// Guards against reporting from a signal handler mid-scan.
+	mu sync.Mutex
+
+	start       time.Time
+	startRusage syscall.Rusage
+	startMem    runtime.MemStats
+
+	procs     int
+	latencies []time.Duration
+}
+
+func newOverhead() *overhead {
+	o := &overhead{start: time.Now()}
+	syscall.Getrusage(syscall.RUSAGE_SELF, &o.startRusage)
+	runtime.ReadMemStats(&o.startMem)
+	return o
+}
+
+// record accounts one scan over procs processes that took d.
+func (o *overhead) record(d time.Duration, procs int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.latencies = append(o.latencies, d)
+	o.procs += procs
+}
+
+func (o *overhead) report(w io.Writer, interval time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	wall := time.Since(o.start)
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano() - o.startRusage.Utime.Nano() - o.startRusage.Stime.Nano())
+	scans := len(o.latencies)
+	fmt.Fprintf(w, "Overhead over %v at %v interval:\n", wall.Round(time.Millisecond), interval)
+	fmt.Fprintf(w, "  CPU: %v (%.2f%% of one core)\n", cpu.Round(time.Millisecond), 100*cpu.Seconds()/wall.Seconds())
+	if scans == 0 {
+		return
+	}
+
+	sorted := append([]time.Duration(nil), o.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	fmt.Fprintf(w, "  Scans: %d over %d processes on average\n", scans, o.procs/scans)
+	fmt.Fprintf(w, "  Scan latency: min %v avg %v p50 %v p99 %v max %v\n",
+		sorted[0], total/time.Duration(scans), sorted[scans/2], sorted[scans*99/100], sorted[scans-1])
+	fmt.Fprintf(w, "  Allocations per scan: %d (%d bytes)\n",
+		(mem.Mallocs-o.startMem.Mallocs)/uint64(scans), (mem.TotalAlloc-o.startMem.TotalAlloc)/uint64(scans))
+}
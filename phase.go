@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Build phases a -config file can have sections for.
+var buildPhases = map[string]bool{
+	"compile": true,
+	"link":    true,
+}
+
+// How long a build has to look like it is in another phase before it is
+// taken to be, so that a link in between compiles doesn't switch limits
+// back and forth.
+const phaseSettle = 2 * time.Second
+
+// checkPhases validates the flags of -config phase sections.
+func (m *monitor) checkPhases(phases map[string]config) error {
+	for phase, c := range phases {
+		for name, value := range c {
+			if _, err := m.reloader(name, value); err != nil {
+				return fmt.Errorf("[%s] %s: %v", phase, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// detectPhase works out the phase the build is in from its filtered
+// processes: linking while linkers are at least as many as the other
+// processes, and compiling otherwise. Once the build has been in another
+// phase for phaseSettle, the flags of its section in -config are applied.
+func (m *monitor) detectPhase(procs []tracked) {
+	var linking, compiling int
+	var vsz uint64
+	for _, p := range procs {
+		vsz += p.stat.VirtualMemory()
+		if p.isLTO || isLinker(p.stat) {
+			linking++
+		} else {
+			compiling++
+		}
+	}
+	var phase string
+	switch {
+	case linking > 0 && linking >= compiling:
+		phase = "link"
+	case compiling > 0:
+		phase = "compile"
+	default:
+		// Nothing running to tell by.
+		return
+	}
+	if phase == m.phase {
+		m.nextPhase = ""
+		return
+	}
+	if phase != m.nextPhase {
+		m.nextPhase, m.nextSince = phase, m.now
+	}
+	if m.phase != "" && m.now.Sub(m.nextSince) < phaseSettle {
+		return
+	}
+
+	m.emit(event{Time: m.now, Type: "phase", Vsz: vsz, Reason: fmt.Sprintf("build in %s phase with %d linking and %d other processes", phase, linking, compiling)})
+	from := m.config.phases[m.phase]
+	m.phase, m.nextPhase = phase, ""
+	m.applyPhase(from, m.config.phases[phase])
+}
+
+// applyPhase moves from the flags of the phase section from to those of to,
+// setting the flags from sets back to their base values.
+func (m *monitor) applyPhase(from, to config) {
+	values := make(map[string]string)
+	for name := range from {
+		values[name] = m.config.base(name)
+	}
+	for name, value := range to {
+		values[name] = value
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		apply, err := m.reloader(name, values[name])
+		if err != nil {
+			log.Printf("Error setting %s to %q: %v", name, values[name], err)
+			continue
+		}
+		apply()
+	}
+	_, profile := values["profile"]
+	_, exes := values["match-exe"]
+	_, matchNames := values["match-name"]
+	if profile || exes || matchNames {
+		m.releaseUnfiltered("no longer filtered in the " + m.phase + " phase")
+	}
+}
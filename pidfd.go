@@ -0,0 +1,146 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/prometheus/procfs"
+)
+
+// pidfd syscalls, the same on every architecture.
+const (
+	sysPidfdSendSignal = 424
+	sysPidfdOpen       = 434
+	sysProcessMadvise  = 440
+)
+
+// pidfds signals processes through pidfds, opened the first time a process
+// is signalled and kept until it is gone. A pidfd is checked against the
+// starttime of the process seen by the scan right after it is opened, and
+// refers to that process for good, so that a PID reused between a scan and
+// a signal is never hit.
+type pidfds struct {
+	fds originals[int]
+	// Set once pidfd_open turned out not to be supported (before Linux
+	// 5.3), to fall back to signalling by PID.
+	unsupported bool
+	// If set, called with every signal sent and its outcome.
+	sent func(stat procfs.ProcStat, sig syscall.Signal, err error)
+}
+
+func newPidfds() *pidfds {
+	return &pidfds{fds: make(originals[int])}
+}
+
+// signal sends sig to the process stat was read from, failing with ESRCH if
+// it is gone, even if its PID has been reused since.
+func (p *pidfds) signal(stat procfs.ProcStat, sig syscall.Signal) error {
+	err := p.send(stat, sig)
+	if p.sent != nil {
+		p.sent(stat, sig, err)
+	}
+	return err
+}
+
+func (p *pidfds) send(stat procfs.ProcStat, sig syscall.Signal) error {
+	if p.unsupported {
+		return syscall.Kill(stat.PID, sig)
+	}
+	fd, err := p.get(stat)
+	if err == syscall.ENOSYS {
+		p.unsupported = true
+		return syscall.Kill(stat.PID, sig)
+	} else if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall6(sysPidfdSendSignal, uintptr(fd), uintptr(sig), 0, 0, 0, 0); errno != 0 {
+		if errno == syscall.ESRCH {
+			syscall.Close(p.fds.take(stat))
+		}
+		return errno
+	}
+	return nil
+}
+
+// get returns the pidfd of the process stat was read from, opening it if it
+// isn't yet.
+func (p *pidfds) get(stat procfs.ProcStat) (int, error) {
+	if fd, ok := p.fds.get(stat); ok {
+		return fd, nil
+	}
+	return p.open(stat)
+}
+
+// open opens a pidfd for stat and caches it, once it is certain to refer to
+// the same process as stat.
+func (p *pidfds) open(stat procfs.ProcStat) (int, error) {
+	r, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(stat.PID), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	fd := int(r)
+
+	// The PID may have been reused before the pidfd was opened; once it
+	// is open, it can't be anymore.
+	proc, err := procfs.NewProc(stat.PID)
+	if err == nil {
+		var now procfs.ProcStat
+		if now, err = proc.Stat(); err == nil && now.Starttime != stat.Starttime {
+			err = syscall.ESRCH
+		}
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, syscall.ESRCH
+	}
+	if old, ok := p.fds[stat.PID]; ok {
+		syscall.Close(old.value)
+	}
+	p.fds.save(stat, fd)
+	return fd, nil
+}
+
+// prune closes the pidfds of processes that are gone.
+func (p *pidfds) prune(stats map[int]procfs.ProcStat) {
+	for pid, e := range p.fds {
+		if s, ok := stats[pid]; !ok || s.Starttime != e.starttime {
+			syscall.Close(e.value)
+			delete(p.fds, pid)
+		}
+	}
+}
+
+// pollfd is struct pollfd from poll.h.
+type pollfd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// POLLIN from asm-generic/poll.h.
+const pollIn = 0x1
+
+// watchExit sends pid on exited as soon as the process exits, as told by
+// its pidfd becoming readable. Without pidfds, nothing is ever sent.
+func watchExit(pid int, exited chan<- int) {
+	r, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	if errno != 0 {
+		return
+	}
+	go func() {
+		defer syscall.Close(int(r))
+		fds := []pollfd{{fd: int32(r), events: pollIn}}
+		for {
+			_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 1, 0, 0, 0, 0)
+			if errno == syscall.EINTR {
+				continue
+			}
+			if errno == 0 {
+				exited <- pid
+			}
+			return
+		}
+	}()
+}
@@ -0,0 +1,412 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// policy is a -policy-script: expressions over each process and the scan,
+// for policies the flags can't express. A script has one rule per line, as
+// name = expression, and blank lines and lines starting with # are skipped:
+//
+//	order  the order processes are let run in, lowest first, replacing
+//	       -sort-by and LTO links going first, which only break ties
+//	stop   whether to throttle a process even within the limits
+//	run    whether to let a process run even over the limits
+//
+// Expressions are written as in Go, with numbers, strings and booleans,
+// arithmetic, comparisons, && || and !, the size constants K, M, G and T,
+// and the functions match(s, glob), min(a, b) and max(a, b). They are given
+// the variables of policyVars.
+type policy struct {
+	path             string
+	order, stop, run ast.Expr
+	// The source of stop and run, for reasons.
+	stopSrc, runSrc string
+}
+
+// Kinds of policy values, held as float64, string and bool.
+const (
+	kindNumber = "number"
+	kindString = "string"
+	kindBool   = "bool"
+)
+
+// Variables policy expressions are given, with their kinds. Sizes are in
+// bytes, times in seconds, and growth is the VSZ growth rate in bytes per
+// second.
+var policyVars = map[string]string{
+	// The scan: VSZ of all filtered processes, the overall limit (+Inf if
+	// none), the 1-minute load average, the number of filtered processes
+	// and the build phase (compile, link or "").
+	"total": kindNumber,
+	"limit": kindNumber,
+	"load":  kindNumber,
+	"procs": kindNumber,
+	"phase": kindString,
+	// The process.
+	"pid":       kindNumber,
+	"ppid":      kindNumber,
+	"comm":      kindString,
+	"state":     kindString,
+	"vsz":       kindNumber,
+	"rss":       kindNumber,
+	"swap":      kindNumber,
+	"cputime":   kindNumber,
+	"growth":    kindNumber,
+	"age":       kindNumber,
+	"read":      kindNumber,
+	"write":     kindNumber,
+	"lto":       kindBool,
+	"linker":    kindBool,
+	"driver":    kindBool,
+	"throttled": kindBool,
+}
+
+// Variables only stop and run are given, as they depend on the order: the
+// position of the process in it from 1, the VSZ of the processes up to and
+// including it, and how many processes ahead of it are throttled.
+var policyRankVars = map[string]string{
+	"rank":    kindNumber,
+	"used":    kindNumber,
+	"stopped": kindNumber,
+}
+
+var policyConsts = map[string]interface{}{
+	"true":  true,
+	"false": false,
+	"K":     float64(1 << 10),
+	"M":     float64(1 << 20),
+	"G":     float64(1 << 30),
+	"T":     float64(1 << 40),
+}
+
+// policyEnv is the values of the variables for one process.
+type policyEnv map[string]interface{}
+
+// readPolicy reads and checks a -policy-script.
+func readPolicy(path string) (*policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{path: path}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, src, ok := strings.Cut(line, "=")
+		name, src = strings.TrimSpace(name), strings.TrimSpace(src)
+		if !ok || src == "" {
+			return nil, fmt.Errorf("line %d: want rule = expression", i+1)
+		}
+		var rule *ast.Expr
+		want, vars := kindBool, []map[string]string{policyVars, policyRankVars}
+		switch name {
+		case "order":
+			rule, want, vars = &p.order, kindNumber, vars[:1]
+		case "stop":
+			rule, p.stopSrc = &p.stop, src
+		case "run":
+			rule, p.runSrc = &p.run, src
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q, want order, stop or run", i+1, name)
+		}
+		if *rule != nil {
+			return nil, fmt.Errorf("line %d: %s given twice", i+1, name)
+		}
+		expr, err := parser.ParseExpr(src)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		kind, err := checkPolicy(expr, vars)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if kind != want {
+			return nil, fmt.Errorf("line %d: %s is a %s, want a %s", i+1, name, kind, want)
+		}
+		*rule = expr
+	}
+	return p, nil
+}
+
+// checkPolicy returns the kind of expr, or why it can't be evaluated with
+// vars.
+func checkPolicy(expr ast.Expr, vars []map[string]string) (string, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return checkPolicy(e.X, vars)
+	case *ast.Ident:
+		if v, ok := policyConsts[e.Name]; ok {
+			return kindOf(v), nil
+		}
+		for _, vars := range vars {
+			if kind, ok := vars[e.Name]; ok {
+				return kind, nil
+			}
+		}
+		if policyRankVars[e.Name] != "" {
+			return "", fmt.Errorf("%s depends on the order, so order can't use it", e.Name)
+		}
+		return "", fmt.Errorf("unknown variable %s", e.Name)
+	case *ast.BasicLit:
+		if literal(e) == nil {
+			return "", fmt.Errorf("invalid literal %s", e.Value)
+		}
+		return kindOf(literal(e)), nil
+	case *ast.UnaryExpr:
+		kind, err := checkPolicy(e.X, vars)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case e.Op == token.SUB && kind == kindNumber, e.Op == token.NOT && kind == kindBool:
+			return kind, nil
+		}
+		return "", fmt.Errorf("%s of a %s", e.Op, kind)
+	case *ast.BinaryExpr:
+		x, err := checkPolicy(e.X, vars)
+		if err != nil {
+			return "", err
+		}
+		y, err := checkPolicy(e.Y, vars)
+		if err != nil {
+			return "", err
+		}
+		if x != y {
+			return "", fmt.Errorf("%s %s %s", x, e.Op, y)
+		}
+		switch e.Op {
+		case token.ADD:
+			if x != kindBool {
+				return x, nil
+			}
+		case token.SUB, token.MUL, token.QUO, token.REM:
+			if x == kindNumber {
+				return x, nil
+			}
+		case token.EQL, token.NEQ:
+			return kindBool, nil
+		case token.LSS, token.LEQ, token.GTR, token.GEQ:
+			if x != kindBool {
+				return kindBool, nil
+			}
+		case token.LAND, token.LOR:
+			if x == kindBool {
+				return x, nil
+			}
+		}
+		return "", fmt.Errorf("%s %s %s", x, e.Op, y)
+	case *ast.CallExpr:
+		fun, ok := e.Fun.(*ast.Ident)
+		if !ok || len(e.Args) != 2 {
+			return "", fmt.Errorf("unknown function, want match(s, glob), min(a, b) or max(a, b)")
+		}
+		var kinds []string
+		for _, arg := range e.Args {
+			kind, err := checkPolicy(arg, vars)
+			if err != nil {
+				return "", err
+			}
+			kinds = append(kinds, kind)
+		}
+		switch {
+		case fun.Name == "match" && kinds[0] == kindString && kinds[1] == kindString:
+			return kindBool, nil
+		case (fun.Name == "min" || fun.Name == "max") && kinds[0] == kindNumber && kinds[1] == kindNumber:
+			return kindNumber, nil
+		}
+		return "", fmt.Errorf("can't call %s(%s)", fun.Name, strings.Join(kinds, ", "))
+	}
+	return "", fmt.Errorf("unsupported expression %T", expr)
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return kindNumber
+	case string:
+		return kindString
+	}
+	return kindBool
+}
+
+// literal returns the value of a number or string literal, or nil.
+func literal(lit *ast.BasicLit) interface{} {
+	switch lit.Kind {
+	case token.INT, token.FLOAT:
+		if v, err := strconv.ParseFloat(lit.Value, 64); err == nil {
+			return v
+		}
+		if v, err := strconv.ParseInt(lit.Value, 0, 64); err == nil {
+			return float64(v)
+		}
+	case token.STRING:
+		if s, err := strconv.Unquote(lit.Value); err == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// eval evaluates an expression checkPolicy accepted.
+func (env policyEnv) eval(expr ast.Expr) interface{} {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return env.eval(e.X)
+	case *ast.Ident:
+		if v, ok := policyConsts[e.Name]; ok {
+			return v
+		}
+		return env[e.Name]
+	case *ast.BasicLit:
+		return literal(e)
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			return !env.eval(e.X).(bool)
+		}
+		return -env.eval(e.X).(float64)
+	case *ast.BinaryExpr:
+		x := env.eval(e.X)
+		switch e.Op {
+		case token.LAND:
+			return x.(bool) && env.eval(e.Y).(bool)
+		case token.LOR:
+			return x.(bool) || env.eval(e.Y).(bool)
+		}
+		y := env.eval(e.Y)
+		switch e.Op {
+		case token.EQL:
+			return x == y
+		case token.NEQ:
+			return x != y
+		}
+		if xs, ok := x.(string); ok {
+			ys := y.(string)
+			switch e.Op {
+			case token.ADD:
+				return xs + ys
+			case token.LSS:
+				return xs < ys
+			case token.LEQ:
+				return xs <= ys
+			case token.GTR:
+				return xs > ys
+			}
+			return xs >= ys
+		}
+		xf, yf := x.(float64), y.(float64)
+		switch e.Op {
+		case token.ADD:
+			return xf + yf
+		case token.SUB:
+			return xf - yf
+		case token.MUL:
+			return xf * yf
+		case token.QUO:
+			return xf / yf
+		case token.REM:
+			return math.Mod(xf, yf)
+		case token.LSS:
+			return xf < yf
+		case token.LEQ:
+			return xf <= yf
+		case token.GTR:
+			return xf > yf
+		}
+		return xf >= yf
+	case *ast.CallExpr:
+		x, y := env.eval(e.Args[0]), env.eval(e.Args[1])
+		switch e.Fun.(*ast.Ident).Name {
+		case "match":
+			return matchName(y.(string), x.(string))
+		case "min":
+			return math.Min(x.(float64), y.(float64))
+		}
+		return math.Max(x.(float64), y.(float64))
+	}
+	return nil
+}
+
+// policyEnv returns the variables for p, without those of policyRankVars.
+func (m *monitor) policyEnv(p tracked, total uint64, procs int) policyEnv {
+	stat := p.stat
+	limit := math.Inf(1)
+	if m.global.limit != unlimited {
+		limit = float64(m.global.limit)
+	}
+	age := 0.0
+	if seen, ok := m.firstSeen.get(stat); ok {
+		age = m.now.Sub(seen).Seconds()
+	}
+	return policyEnv{
+		"total":     float64(total),
+		"limit":     limit,
+		"load":      m.load,
+		"procs":     float64(procs),
+		"phase":     m.phase,
+		"pid":       float64(stat.PID),
+		"ppid":      float64(stat.PPID),
+		"comm":      stat.Comm,
+		"state":     stat.State,
+		"vsz":       float64(stat.VirtualMemory()),
+		"rss":       float64(stat.ResidentMemory()),
+		"swap":      float64(p.swap),
+		"cputime":   stat.CPUTime(),
+		"growth":    m.growthRate(stat),
+		"age":       age,
+		"read":      float64(p.io.read),
+		"write":     float64(p.io.write),
+		"lto":       p.isLTO,
+		"linker":    isLinker(stat),
+		"driver":    isDriver(stat),
+		"throttled": m.thr.throttled(stat),
+	}
+}
+
+// sortByPolicy sorts procs by the order rule, keeping their order on ties,
+// and returns the environments of the processes by PID.
+func (m *monitor) sortByPolicy(procs []tracked) map[int]policyEnv {
+	var total uint64
+	for _, p := range procs {
+		total += p.stat.VirtualMemory()
+	}
+	envs := make(map[int]policyEnv, len(procs))
+	keys := make(map[int]float64, len(procs))
+	for _, p := range procs {
+		env := m.policyEnv(p, total, len(procs))
+		envs[p.stat.PID] = env
+		if m.policy.order != nil {
+			keys[p.stat.PID] = env.eval(m.policy.order).(float64)
+		}
+	}
+	if m.policy.order != nil {
+		sort.SliceStable(procs, func(i, j int) bool {
+			return keys[procs[i].stat.PID] < keys[procs[j].stat.PID]
+		})
+	}
+	return envs
+}
+
+// decide returns the action of the stop or run rule for a process, as an
+// override would, and the rule that decided it. Run wins if both match.
+func (p *policy) decide(env policyEnv) (action, reason string) {
+	if p.run != nil && env.eval(p.run).(bool) {
+		return overrideRun, "policy: " + p.runSrc
+	}
+	if p.stop != nil && env.eval(p.stop).(bool) {
+		return overrideStop, "policy: " + p.stopSrc
+	}
+	return "", ""
+}
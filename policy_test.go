@@ -0,0 +1,251 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestReadPolicy checks that readPolicy accepts a valid script and rejects
+// each kind of mistake with the line and what is wrong with it.
+func TestReadPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		script, err string
+	}{
+		{"# LTO first, big compilers last.\n\norder = -vsz / G\nstop = vsz > 2*G && !lto\nrun = match(comm, \"ld*\") || rank == 1", ""},
+		{"order = min(vsz, 1*G) + max(age, 0) % 60", ""},
+		{"stop = comm + \"x\" == \"cc1x\" && state != \"T\"", ""},
+		// Syntax.
+		{"stop", "line 1: want rule = expression"},
+		{"stop =", "line 1: want rule = expression"},
+		{"\nkill = true", "line 2: unknown rule \"kill\""},
+		{"stop = true\nstop = false", "line 2: stop given twice"},
+		{"stop = vsz >", "line 1: 1:6: expected operand"},
+		{"stop = 1 +* 2", "line 1:"},
+		{"stop = vsz[0] > 1", "unsupported expression *ast.IndexExpr"},
+		{"stop = 'x' == 'y'", "invalid literal 'x'"},
+		// Names.
+		{"stop = rss > limt", "unknown variable limt"},
+		{"order = rank", "rank depends on the order, so order can't use it"},
+		{"order = used - vsz", "used depends on the order"},
+		// Kinds.
+		{"stop = vsz", "stop is a number, want a bool"},
+		{"run = comm", "run is a string, want a bool"},
+		{"order = lto", "order is a bool, want a number"},
+		{"stop = vsz > comm", "number > string"},
+		{"stop = lto + linker", "bool + bool"},
+		{"stop = comm * 2 == \"\"", "string * number"},
+		{"stop = comm - comm == \"\"", "string - string"},
+		{"stop = lto < linker", "bool < bool"},
+		{"stop = vsz && lto", "number && bool"},
+		{"stop = comm || lto", "string || bool"},
+		{"stop = !vsz", "! of a number"},
+		{"stop = -comm == \"\"", "- of a string"},
+		{"stop = ^pid > 0", "^ of a number"},
+		// Functions.
+		{"stop = match(comm, 1)", "can't call match(string, number)"},
+		{"stop = match(vsz, \"cc*\")", "can't call match(number, string)"},
+		{"order = min(comm, vsz)", "can't call min(string, number)"},
+		{"order = max(lto, 1)", "can't call max(bool, number)"},
+		{"order = min(vsz)", "unknown function"},
+		{"order = abs(vsz, 1)", "can't call abs(number, number)"},
+		{"order = math.Max(vsz, 1)", "unknown function"},
+		{"order = max(vsz, bogus)", "unknown variable bogus"},
+	} {
+		_, err := readPolicy(writePolicy(t, tt.script))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.script, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%q: no error, want %q", tt.script, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%q: %v, want %q", tt.script, err, tt.err)
+		}
+	}
+}
+
+// TestPolicyEval checks the value of expressions over a cc1plus process.
+func TestPolicyEval(t *testing.T) {
+	env := policyEnv{
+		"total": 6.0 * (1 << 30),
+		"limit": math.Inf(1),
+		"procs": 3.0,
+		"phase": "compile",
+		"comm":  "cc1plus",
+		"state": "R",
+		"vsz":   2.0 * (1 << 30),
+		"swap":  0.0,
+		"lto":   false,
+	}
+	for _, tt := range []struct {
+		expr string
+		want interface{}
+	}{
+		{"1 + 2*3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"7 % 3", 1.0},
+		{"-7 % 3", -1.0},
+		{"7.5 / 2", 3.75},
+		{"0x10 - 1", 15.0},
+		{"-vsz", -2.0 * (1 << 30)},
+		{"vsz / G", 2.0},
+		{"1*K + 1*M + 1*T", float64(1<<10 + 1<<20 + 1<<40)},
+		{"total / procs", 2.0 * (1 << 30)},
+		{"vsz / swap", math.Inf(1)},
+		{"-vsz / swap", math.Inf(-1)},
+		{"swap / swap", math.NaN()},
+		{"vsz % swap", math.NaN()},
+		{"limit > total", true},
+		{"vsz >= 2*G", true},
+		{"vsz < 2*G", false},
+		{"vsz <= 2*G && vsz == total/3", true},
+		{"vsz != 2*G", false},
+		{"comm + \"-14\"", "cc1plus-14"},
+		{"comm == \"cc1plus\"", true},
+		{"comm < \"cc1\"", false},
+		{"comm > \"cc1\"", true},
+		{"comm <= \"cc1plus\" && comm >= \"cc1plus\"", true},
+		{"phase != \"link\"", true},
+		{"!lto", true},
+		{"lto == false", true},
+		// The right side isn't evaluated when the left decides.
+		{"lto && rank > 1", false},
+		{"!lto || rank > 1", true},
+		{"lto || state == \"R\"", true},
+		{"match(comm, \"cc1*\")", true},
+		{"match(comm, \"*plus\")", true},
+		{"match(comm, \"cc1\")", false},
+		{"match(\"cc1*\", comm)", false},
+		{"min(vsz, 1*G)", float64(1 << 30)},
+		{"min(swap, -1)", -1.0},
+		{"max(vsz, 1*G)", 2.0 * (1 << 30)},
+		{"max(limit, vsz)", math.Inf(1)},
+	} {
+		expr, err := parser.ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		got := env.eval(expr)
+		if want, ok := tt.want.(float64); ok && math.IsNaN(want) {
+			if got, ok := got.(float64); !ok || !math.IsNaN(got) {
+				t.Errorf("%s = %v, want NaN", tt.expr, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v (%T), want %v (%T)", tt.expr, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+// TestPolicyDecide checks that run wins over stop, and that the reason is
+// the rule that decided.
+func TestPolicyDecide(t *testing.T) {
+	p, err := readPolicy(writePolicy(t, "stop = vsz > 1*G\nrun = comm == \"ld\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		comm           string
+		vsz            float64
+		action, reason string
+	}{
+		{"cc1plus", 2 << 30, overrideStop, "policy: vsz > 1*G"},
+		{"cc1plus", 1 << 20, "", ""},
+		{"ld", 2 << 30, overrideRun, "policy: comm == \"ld\""},
+		{"ld", 1 << 20, overrideRun, "policy: comm == \"ld\""},
+	} {
+		action, reason := p.decide(policyEnv{"comm": tt.comm, "vsz": tt.vsz})
+		if action != tt.action || reason != tt.reason {
+			t.Errorf("%s of %v: %q, %q; want %q, %q", tt.comm, tt.vsz, action, reason, tt.action, tt.reason)
+		}
+	}
+}
+
+// TestSortByPolicy checks that order sorts lowest first, and keeps the
+// order on ties.
+func TestSortByPolicy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	m, _ := newTestMonitor(unlimited, isCompiler)
+	// Largest first, up to 200 MiB.
+	var err error
+	if m.policy, err = readPolicy(writePolicy(t, "order = -min(vsz, 200*M)")); err != nil {
+		t.Fatal(err)
+	}
+	var procs []tracked
+	for i, mib := range []uint64{300, 100, 150, 250, 120} {
+		procs = append(procs, tracked{stat: procfs.ProcStat{PID: 1001 + i, Comm: "cc1plus", VSize: mib << 20}})
+	}
+	m.sortByPolicy(procs)
+	var got []int
+	for _, p := range procs {
+		got = append(got, p.stat.PID)
+	}
+	if want := []int{1001, 1004, 1003, 1005, 1002}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sorted %v, want %v", got, want)
+	}
+}
+
+// TestPolicyRankVars checks the processes stop and run throttle over a scan
+// of four compilers of 137, 174, 211 and 248 MiB, using the variables that
+// depend on the order.
+func TestPolicyRankVars(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range []struct {
+		script string
+		limit  uint64
+		want   []int
+	}{
+		{"stop = rank > 2", unlimited, []int{1003, 1004}},
+		// Used counts the process itself: 137, 311, 522 and 770 MiB.
+		{"stop = used > 400*M", unlimited, []int{1003, 1004}},
+		// Stopped counts those throttled ahead of it in this scan too.
+		{"stop = stopped == 0 && rank > 1", unlimited, []int{1002}},
+		// Run lets processes ahead of the limit run, and stop holds
+		// those within it.
+		{"run = rank <= 2", 200 << 20, []int{1003, 1004}},
+		{"run = rank == 3", 200 << 20, []int{1002, 1004}},
+		{"stop = rank == 1", unlimited, []int{1001}},
+	} {
+		m, clock := newTestMonitor(tt.limit, isCompiler, newTree(1000, unlimited))
+		var err error
+		if m.policy, err = readPolicy(writePolicy(t, tt.script)); err != nil {
+			t.Fatal(err)
+		}
+		stats := buildStats(4)
+		clock.Sleep(time.Second)
+		m.prune(stats)
+		m.scan(clock.Now(), stats)
+		var got []int
+		for pid := 1001; pid <= 1004; pid++ {
+			if m.thr.throttled(stats[pid]) {
+				got = append(got, pid)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s with a limit of %s: throttled %v, want %v", tt.script, formatSize(tt.limit), got, tt.want)
+		}
+	}
+}
+
+// writePolicy writes script to a file for readPolicy, returning its path.
+func writePolicy(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(path, []byte(script), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Capability bits from linux/capability.h.
+const (
+	capSysNice     = 23
+	capSysResource = 24
+)
+
+// Resource limit from asm-generic/resource.h; not exported by package syscall.
+const rlimitNice = 13
+
+// hasCapability reports whether cap is in our effective capability set.
+func hasCapability(cap uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return err == nil && caps&(1<<cap) != 0
+		}
+	}
+	return false
+}
+
+// preflight checks up front that we hold the privileges needed to throttle
+// the given trees in the given mode (and to protect unfiltered processes
+// from the OOM killer, or page out stopped ones, if asked to), so that
+// missing permissions show up as an actionable error rather than as
+// processes silently never being stopped.
+func preflight(trees []*tree, mode string, protectUnfiltered, pageOut bool) error {
+	for _, t := range trees {
+		err := syscall.Kill(t.pid, 0)
+		if err == syscall.EPERM {
+			return fmt.Errorf("not permitted to signal process %d (owned by uid %d); run memlimit as the same user, or as root or with CAP_KILL", t.pid, procUID(t.pid))
+		}
+		if err == syscall.ESRCH {
+			return fmt.Errorf("process %d not found", t.pid)
+		}
+	}
+
+	if mode == "nice" && !hasCapability(capSysNice) {
+		// Without CAP_SYS_NICE, RLIMIT_NICE is what allows lowering the
+		// nice value back once a process is released.
+		var lim syscall.Rlimit
+		if err := syscall.Getrlimit(rlimitNice, &lim); err != nil || lim.Cur < 20 {
+			return fmt.Errorf("nice mode cannot restore priorities without CAP_SYS_NICE or RLIMIT_NICE of at least 20 (ulimit -e 20); run memlimit as root or use another -mode")
+		}
+	}
+	if protectUnfiltered && !hasCapability(capSysResource) {
+		return fmt.Errorf("lowering oom_score_adj for -protect-unfiltered requires CAP_SYS_RESOURCE; run memlimit as root")
+	}
+	if pageOut && !hasCapability(capSysNice) {
+		return fmt.Errorf("paging out stopped processes for -page-out-stopped requires CAP_SYS_NICE; run memlimit as root")
+	}
+	return nil
+}
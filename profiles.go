@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"sort"
+
+	"github.com/prometheus/procfs"
+)
+
+// Per-toolchain lists of process names that are allowed to be stopped. The
+// "none" profile is useful together with -match-exe.
+var profiles = map[string]map[string]bool{
+	"none": {},
+	"gcc": {
+		"cc1plus": true,
+		"cc1":     true,
+		"lto1":    true,
+		"ar":      true,
+		"as":      true,
+		"ld":      true,
+		"ld.bfd":  true,
+		"ld.gold": true,
+		"mold":    true,
+	},
+	"clang": {
+		"clang":    true,
+		"clang++":  true,
+		"llvm-ar":  true,
+		"ar":       true,
+		"as":       true,
+		"ld":       true,
+		"ld.lld":   true,
+		"ld.gold":  true,
+		"lld":      true,
+		"mold":     true,
+		"llvm-lto": true,
+	},
+	"rustc": {
+		"rustc":   true,
+		"ld":      true,
+		"ld.bfd":  true,
+		"ld.gold": true,
+		"ld.lld":  true,
+		"mold":    true,
+	},
+	"go": {
+		"compile": true,
+		"link":    true,
+		"asm":     true,
+		"cgo":     true,
+	},
+	// Build daemons run as java too, but are left unmanaged unless
+	// -stop-jvm-daemons.
+	"jvm": {
+		"java":    true,
+		"javac":   true,
+		"kotlinc": true,
+	},
+}
+
+// charge is how processes of a name are charged to VSZ budgets under a
+// profile: weight times their VSZ, but no less than their RSS, and at least
+// estimate, which is what they come to use, from the start, as they take a
+// second or two to get there.
+type charge struct {
+	weight   float64
+	estimate uint64
+}
+
+// Per-toolchain charges, by process name, of processes whose VSZ is far from
+// what they use. The Go runtime reserves about 1.2G of address space up
+// front, rustc a few hundred megabytes of thread stacks and malloc arenas,
+// and the JVM its whole maximum heap and code cache, while the VSZ of gcc's
+// cc1 and cc1plus is close to their RSS. The estimates are about what
+// compiling a file that only includes the C++ standard library (cc1plus) or
+// a few libc headers (cc1), or a small crate using std collections (rustc),
+// peaks at. Processes not listed are charged their VSZ.
+var profileCharges = map[string]map[string]charge{
+	"gcc": {
+		"cc1plus": {weight: 1, estimate: 192 << 20},
+		"cc1":     {weight: 1, estimate: 64 << 20},
+	},
+	"clang": {
+		"clang":   {weight: 1, estimate: 128 << 20},
+		"clang++": {weight: 1, estimate: 192 << 20},
+	},
+	"rustc": {
+		"rustc": {weight: 0.5, estimate: 256 << 20},
+	},
+	"go": {
+		"compile": {weight: 0.25},
+		"link":    {weight: 0.25},
+		"asm":     {weight: 0.25},
+		"cgo":     {weight: 0.25},
+	},
+	"jvm": {
+		"java":    {weight: 0.5},
+		"javac":   {weight: 0.5},
+		"kotlinc": {weight: 0.5},
+	},
+}
+
+// Charges of the -profile in use.
+var processCharges map[string]charge
+
+func init() {
+	mixed := make(map[string]bool)
+	for _, p := range profiles {
+		for comm := range p {
+			mixed[comm] = true
+		}
+	}
+	profiles["mixed"] = mixed
+	mixedCharges := make(map[string]charge)
+	for _, p := range profileCharges {
+		for comm, c := range p {
+			mixedCharges[comm] = c
+		}
+	}
+	profileCharges["mixed"] = mixedCharges
+}
+
+// charged returns what stat is charged to VSZ budgets under the profile.
+func charged(stat procfs.ProcStat) uint64 {
+	vsz := stat.VirtualMemory()
+	c, ok := processCharges[stat.Comm]
+	if !ok || !whitelistedProcesses[stat.Comm] {
+		return vsz
+	}
+	if c.weight != 0 {
+		vsz = uint64(float64(vsz) * c.weight)
+		if rss := uint64(stat.ResidentMemory()); vsz < rss {
+			vsz = rss
+		}
+	}
+	if vsz < c.estimate {
+		vsz = c.estimate
+	}
+	return vsz
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestCharged checks what processes are charged under the mixed profile.
+func TestCharged(t *testing.T) {
+	defer func(procs map[string]bool, charges map[string]charge) {
+		whitelistedProcesses, processCharges = procs, charges
+	}(whitelistedProcesses, processCharges)
+	whitelistedProcesses, processCharges = profiles["mixed"], profileCharges["mixed"]
+	for _, tt := range []struct {
+		comm     string
+		vsz, rss uint64
+		want     uint64
+	}{
+		// Not charged differently.
+		{"ld", 20 << 20, 17 << 20, 20 << 20},
+		// Not in the profile.
+		{"python3", 2 << 30, 1 << 20, 2 << 30},
+		// Charged at least the estimate.
+		{"cc1plus", 30 << 20, 20 << 20, 192 << 20},
+		{"cc1plus", 900 << 20, 800 << 20, 900 << 20},
+		{"cc1", 10 << 20, 8 << 20, 64 << 20},
+		// Charged a share of the VSZ, but at least the RSS.
+		{"compile", 1280 << 20, 26 << 20, 320 << 20},
+		{"link", 2 << 30, 1800 << 20, 1800 << 20},
+		// Both.
+		{"rustc", 400 << 20, 205 << 20, 256 << 20},
+		{"rustc", 1200 << 20, 578 << 20, 600 << 20},
+	} {
+		stat := procfs.ProcStat{Comm: tt.comm, VSize: tt.vsz, RSS: tt.rss / uint64(os.Getpagesize())}
+		if got := charged(stat); got != tt.want {
+			t.Errorf("%s of VSZ %s and RSS %s: charged %s, want %s", tt.comm, formatSize(tt.vsz), formatSize(tt.rss), formatSize(got), formatSize(tt.want))
+		}
+	}
+}
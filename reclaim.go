@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/procfs"
+)
+
+// Advice from linux/mman.h.
+const (
+	madvPageout = 21
+	// Most ranges process_madvise(2) takes at once (UIO_MAXIOV).
+	maxIovecs = 1024
+)
+
+// pageOutStopped asks the kernel to reclaim the memory of processes that
+// have been held stopped for pageOutAfter, once per stretch, so that under
+// pressure their pages are evicted rather than those of running compilers.
+func (m *monitor) pageOutStopped(procs []tracked) {
+	if m.pageOutAfter == 0 {
+		return
+	}
+	for _, p := range procs {
+		stat := p.stat
+		if stat.State != "T" {
+			m.pagedOut.take(stat)
+			continue
+		}
+		since, ok := m.since.get(stat)
+		if !ok || m.now.Sub(since) < m.pageOutAfter || m.pagedOut.has(stat) {
+			continue
+		}
+		m.pagedOut.save(stat, struct{}{})
+		m.emit(m.newEvent("pageout", stat, 0, fmt.Sprintf("stopped for %v, paging out RSS %s", m.now.Sub(since).Round(time.Second), formatSize(stat.ResidentMemory()))))
+		if err := m.pageOut(stat); err != nil {
+			log.Printf("Error paging out %d %s: %v", stat.PID, stat.Comm, err)
+		}
+	}
+}
+
+// iovec is a memory range as passed to process_madvise(2). Unlike
+// syscall.Iovec it holds no Go pointer, as the ranges are in another process.
+type iovec struct {
+	base, len uintptr
+}
+
+// pageOut advises the kernel to page out the private writable mappings of
+// the process stat was read from with MADV_PAGEOUT, through its pidfd, so
+// that a PID reused since is never hit.
+func (m *monitor) pageOut(stat procfs.ProcStat) error {
+	pidfd, err := m.pidfds.get(stat)
+	if err != nil {
+		return fmt.Errorf("pidfd_open: %v", err)
+	}
+	ranges, err := privateMappings(stat.PID)
+	if err != nil {
+		return err
+	}
+
+	for len(ranges) > 0 {
+		batch := ranges
+		if len(batch) > maxIovecs {
+			batch = batch[:maxIovecs]
+		}
+		ranges = ranges[len(batch):]
+		if _, _, errno := syscall.Syscall6(sysProcessMadvise, uintptr(pidfd), uintptr(unsafe.Pointer(&batch[0])), uintptr(len(batch)), madvPageout, 0, 0); errno != 0 {
+			return fmt.Errorf("process_madvise: %v", errno)
+		}
+	}
+	return nil
+}
+
+// privateMappings returns the private writable mappings of pid, which hold
+// its heap, stacks and other anonymous memory, from /proc/<pid>/maps.
+func privateMappings(pid int) ([]iovec, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []iovec
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || len(fields[1]) < 4 || fields[1][1] != 'w' || fields[1][3] != 'p' {
+			continue
+		}
+		lo, hi, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			continue
+		}
+		start, err1 := strconv.ParseUint(lo, 16, 64)
+		end, err2 := strconv.ParseUint(hi, 16, 64)
+		if err1 != nil || err2 != nil || end <= start {
+			continue
+		}
+		ranges = append(ranges, iovec{base: uintptr(start), len: uintptr(end - start)})
+	}
+	return ranges, s.Err()
+}
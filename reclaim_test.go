@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestPageOutReusedPID checks that a process whose PID has been reused by
+// another since it was seen is not paged out.
+func TestPageOutReusedPID(t *testing.T) {
+	self, err := procfs.Self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := self.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := newTestMonitor(unlimited, isCompiler)
+	gone := procfs.ProcStat{PID: os.Getpid(), Starttime: stat.Starttime - 1}
+	if err := m.pageOut(gone); err == nil {
+		t.Errorf("paged out %d, whose PID has been reused", gone.PID)
+	}
+}
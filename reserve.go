@@ -0,0 +1,285 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/prometheus/procfs"
+)
+
+// reservation is memory a cooperating tool asked for through the control
+// API before starting a job, held until the tool gives it back or its
+// process exits. Reservations are granted in the order they are asked for,
+// as room frees up under the overall limit.
+type reservation struct {
+	token int
+	// The process that asked, whose descendants run the job.
+	holder procfs.ProcStat
+	size   uint64
+	// Closed once granted.
+	granted chan struct{}
+	// What of size the job doesn't use yet as of the last scan, which is
+	// charged to the overall budget ahead of every process.
+	charge uint64
+}
+
+func (r *reservation) isGranted() bool {
+	select {
+	case <-r.granted:
+		return true
+	default:
+		return false
+	}
+}
+
+type reservationStatus struct {
+	Token   int    `json:"token"`
+	PID     int    `json:"pid"`
+	Size    uint64 `json:"size"`
+	Granted bool   `json:"granted"`
+	// What of Size the job doesn't use yet.
+	Unused uint64 `json:"unused"`
+}
+
+// reserve queues a reservation of size for holder.
+func (m *monitor) reserve(holder procfs.ProcStat, size uint64) *reservation {
+	m.nextToken++
+	r := &reservation{token: m.nextToken, holder: holder, size: size, granted: make(chan struct{})}
+	m.reservations = append(m.reservations, r)
+	return r
+}
+
+// unreserve drops the reservation with token, reporting whether there was
+// one.
+func (m *monitor) unreserve(token int, reason string) bool {
+	for i, r := range m.reservations {
+		if r.token == token {
+			m.reservations = append(m.reservations[:i], m.reservations[i+1:]...)
+			if r.isGranted() {
+				m.emit(m.newEvent("unreserve", r.holder, 0, fmt.Sprintf("%s of token %d %s", formatSize(r.size), token, reason)))
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// chargeReservations drops the reservations of processes that exited, and
+// charges the overall budget with what granted ones don't use yet. The
+// memory of a job is that of the filtered processes below its holder.
+func (m *monitor) chargeReservations(pmap map[int][]int, procs []tracked) {
+	if len(m.reservations) == 0 {
+		return
+	}
+	vsz := make(map[int]uint64, len(procs))
+	for _, p := range procs {
+		vsz[p.stat.PID] = p.stat.VirtualMemory()
+	}
+	for _, r := range append([]*reservation(nil), m.reservations...) {
+		proc, err := procfs.NewProc(r.holder.PID)
+		if err == nil {
+			var stat procfs.ProcStat
+			if stat, err = proc.Stat(); err == nil && (stat.Starttime != r.holder.Starttime || stat.State == "Z") {
+				err = os.ErrNotExist
+			}
+		}
+		if err != nil {
+			m.unreserve(r.token, "returned as its holder exited")
+			continue
+		}
+		if !r.isGranted() {
+			continue
+		}
+		var used uint64
+		for _, pid := range treePids(pmap, r.holder.PID) {
+			used += vsz[pid]
+		}
+		r.charge = 0
+		if used < r.size {
+			r.charge = r.size - used
+		}
+		m.global.vsz += r.charge
+	}
+}
+
+// grantReservations grants waiting reservations in order, for as long as
+// they fit in the room left under the overall limit. Nothing is granted
+// while processes are held throttled for want of room.
+func (m *monitor) grantReservations() {
+	if m.global.stopped || m.global.vsz >= m.global.limit {
+		return
+	}
+	room := m.global.limit - m.global.vsz
+	for _, r := range m.reservations {
+		if r.isGranted() {
+			continue
+		}
+		if r.size > room {
+			return
+		}
+		room -= r.size
+		r.charge = r.size
+		m.global.vsz += r.size
+		close(r.granted)
+		m.emit(m.newEvent("reserve", r.holder, 0, fmt.Sprintf("%s granted as token %d", formatSize(r.size), r.token)))
+	}
+}
+
+// reservationStatuses returns the reservations, in order.
+func (m *monitor) reservationStatuses() (reserved uint64, rs []reservationStatus) {
+	for _, r := range m.reservations {
+		granted := r.isGranted()
+		if granted {
+			reserved += r.charge
+		}
+		rs = append(rs, reservationStatus{Token: r.token, PID: r.holder.PID, Size: r.size, Granted: granted, Unused: r.charge})
+	}
+	return reserved, rs
+}
+
+func (m *monitor) handleReserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	size, err := parseSize(r.FormValue("size"))
+	if err != nil {
+		http.Error(w, "invalid size: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		http.Error(w, "invalid pid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	proc, err := procfs.NewProc(pid)
+	if err != nil {
+		http.Error(w, "process not found", http.StatusNotFound)
+		return
+	}
+	holder, err := proc.Stat()
+	if err != nil {
+		http.Error(w, "process not found", http.StatusNotFound)
+		return
+	}
+	if reason := mayAttach(r, pid); reason != "" {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	m.mu.Lock()
+	if size > m.global.limit {
+		m.mu.Unlock()
+		http.Error(w, fmt.Sprintf("%s exceeds the %s overall limit", formatSize(size), formatSize(m.global.limit)), http.StatusBadRequest)
+		return
+	}
+	res := m.reserve(holder, size)
+	m.mu.Unlock()
+
+	select {
+	case <-res.granted:
+		writeJSON(w, reservationStatus{Token: res.token, PID: pid, Size: size, Granted: true})
+	case <-r.Context().Done():
+		m.mu.Lock()
+		m.unreserve(res.token, "returned as its client went away")
+		m.mu.Unlock()
+	}
+}
+
+func (m *monitor) handleUnreserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := strconv.Atoi(r.FormValue("token"))
+	if err != nil {
+		http.Error(w, "invalid token: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, res := range m.reservations {
+		if res.token != token {
+			continue
+		}
+		if reason := mayAttach(r, res.holder.PID); reason != "" {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+	}
+	if !m.unreserve(token, "returned") {
+		http.Error(w, "no such token", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reserveAndRun implements memlimit reserve: it reserves memory from the
+// instance serving the control API at listen, runs the command, and gives
+// the memory back once the command exits, returning its exit code.
+func reserveAndRun(args []string, listen, token string) (int, error) {
+	fs := flag.NewFlagSet("reserve", flag.ContinueOnError)
+	size := fs.String("size", "", "Memory to reserve for the command, e.g. 4G")
+	if err := fs.Parse(args); err != nil {
+		return 0, err
+	}
+	if fs.NArg() == 0 {
+		return 0, errors.New("no command to run")
+	}
+	if _, err := parseSize(*size); err != nil {
+		return 0, fmt.Errorf("invalid -size: %v", err)
+	}
+	if listen == "" {
+		return 0, errors.New("requires -listen of the memlimit instance to reserve from")
+	}
+
+	client, base := controlClient(listen, token)
+	// The command runs as our child, so its memory counts against the
+	// reservation.
+	var res reservationStatus
+	if err := post(client, base+"/reserve", url.Values{"size": {*size}, "pid": {strconv.Itoa(os.Getpid())}}, &res); err != nil {
+		return 0, fmt.Errorf("reserving %s: %v", *size, err)
+	}
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	// Exiting would return it too, but not before the next scan.
+	if err := post(client, base+"/unreserve", url.Values{"token": {strconv.Itoa(res.Token)}}, nil); err != nil {
+		fmt.Fprintln(os.Stderr, "Error returning reservation:", err)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// post posts form to addr, decoding the JSON response into v if not nil.
+func post(client *http.Client, addr string, form url.Values, v interface{}) error {
+	resp, err := client.PostForm(addr, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return httpError(resp)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
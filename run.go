@@ -0,0 +1,112 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/prometheus/procfs"
+)
+
+// run scans the tracked trees every interval, until none are left unless
+// running as a daemon, or until ctx is cancelled. Once cancelled, it
+// finishes the scan under way and releases every process it throttled.
+func (m *monitor) run(ctx context.Context) {
+	var stats map[int]procfs.ProcStat
+	var slowScans bool
+	for scans := 0; ctx.Err() == nil; scans++ {
+		scanStart := m.clock.Now()
+		full := false
+		var err error
+		if stats != nil && m.fullScanEvery > 1 && scans%m.fullScanEvery != 0 {
+			// New processes are only picked up by the next full scan.
+			stats = refreshMemory(stats, m.trackedPids())
+		} else if m.walk == "children" {
+			stats, err = getTreeStats(m.roots())
+		} else {
+			stats, err = getProcStats()
+			full = true
+		}
+		if err != nil {
+			log.Println("Error listing procs", err)
+			m.wait(ctx)
+			continue
+		}
+
+		if !m.prune(stats) && !m.daemon {
+			m.removeState()
+			m.finishJobs(stats)
+			m.saveMemoryDB(true)
+			m.hooks.wait()
+			m.closeHistoryDB()
+			log.Println("No tracked processes left. Exiting")
+			return
+		}
+
+		if full && len(m.attachRules) > 0 {
+			m.attach(stats)
+		}
+		m.scan(scanStart, stats)
+		scanDuration := m.clock.Now().Sub(scanStart)
+		m.setScanDuration(scanDuration)
+		if m.wd != nil {
+			if err := m.wd.ping(m.clock.Now()); err != nil {
+				log.Println("Error pinging the systemd watchdog:", err)
+			}
+		}
+		if m.oh != nil {
+			m.oh.record(scanDuration, len(stats))
+		}
+
+		// Once scans take most of the interval, decisions are made on
+		// memory numbers that are stale by the time they are acted upon.
+		if !slowScans && scanDuration > m.interval*3/4 {
+			log.Printf("Scan took %v, close to the %v check interval; memory numbers are stale by the time they are acted on", scanDuration, m.interval)
+			slowScans = true
+		} else if slowScans && scanDuration < m.interval/2 {
+			log.Printf("Scan took %v, back within the %v check interval", scanDuration, m.interval)
+			slowScans = false
+		}
+
+		if m.stateFile != "" {
+			m.mu.Lock()
+			st := persistedState{PID: os.Getpid(), Mode: m.mode, Updated: m.clock.Now(), status: m.status}
+			m.mu.Unlock()
+			if err := writeState(m.stateFile, st); err != nil {
+				log.Println("Error writing state file, disabling it:", err)
+				m.stateFile = ""
+			}
+		}
+		m.saveMemoryDB(false)
+		m.wait(ctx)
+	}
+
+	m.releaseAll("memlimit stopping")
+	m.closeHistoryDB()
+	m.saveMemoryDB(true)
+	m.removeState()
+	m.hooks.wait()
+}
+
+// wait waits for the next scan: one interval, or less if a top-level
+// process exits or ctx is cancelled in the meantime.
+func (m *monitor) wait(ctx context.Context) {
+	select {
+	case pid := <-m.topExited:
+		if m.verbose {
+			log.Printf("Process %d exited, scanning right away", pid)
+		}
+	case <-ctx.Done():
+	case <-m.clock.After(m.interval):
+	}
+}
+
+// removeState removes the state file once there is nothing left for another
+// instance to adopt.
+func (m *monitor) removeState() {
+	if m.stateFile != "" {
+		os.Remove(m.stateFile)
+	}
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock syscalls and ABI v1 constants from linux/landlock.h. The syscall
+// numbers are the same on every architecture.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessFSExecute   = 1 << 0
+	landlockAccessFSWriteFile = 1 << 1
+	landlockAccessFSReadFile  = 1 << 2
+	landlockAccessFSReadDir   = 1 << 3
+	// All access rights of ABI v1.
+	landlockAccessFSAll = 1<<13 - 1
+)
+
+// Seccomp constants from linux/seccomp.h, linux/filter.h and linux/audit.h.
+const (
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	bpfLdWAbs = 0x20
+	bpfJeqK   = 0x15
+	bpfJgeK   = 0x35
+	bpfRetK   = 0x06
+)
+
+// O_PATH from asm-generic/fcntl.h, shared by amd64 and arm64.
+const oPath = 0x200000
+
+// Audit architecture of each supported GOARCH, checked by the seccomp
+// filter so that syscall numbers are interpreted for the right ABI.
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// sandbox confines the whole process: filesystem access is limited to
+// reading readPaths and writing writePaths (via Landlock, unless the kernel
+// doesn't support it, which is logged), and syscalls other than
+// allowedSyscalls fail with EPERM (via seccomp). It has to be applied to
+// every thread, which Go only supports without cgo.
+func sandbox(readPaths, writePaths []string) error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("sandboxing requires a build with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", errno)
+	}
+	if err := landlock(readPaths, writePaths); errors.Is(err, errNoLandlock) {
+		log.Println("Landlock is not supported by this kernel, leaving filesystem access unconfined")
+	} else if err != nil {
+		return fmt.Errorf("landlock: %v", err)
+	}
+	if err := seccomp(); err != nil {
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	return nil
+}
+
+// errNoLandlock is returned by landlock when the kernel doesn't support it,
+// or has it disabled.
+var errNoLandlock = errors.New("not supported by this kernel")
+
+func landlock(readPaths, writePaths []string) error {
+	if _, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion); errno == syscall.ENOSYS || errno == syscall.EOPNOTSUPP {
+		return errNoLandlock
+	}
+
+	handled := uint64(landlockAccessFSAll)
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(fd))
+
+	const read = landlockAccessFSReadFile | landlockAccessFSReadDir
+	for _, p := range readPaths {
+		if err := landlockAllow(int(fd), p, read); err != nil {
+			return err
+		}
+	}
+	for _, p := range writePaths {
+		if err := landlockAllow(int(fd), p, landlockAccessFSAll&^landlockAccessFSExecute); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func landlockAllow(rulesetFd int, path string, access uint64) error {
+	f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		// Directory-only rights can't be granted on files.
+		access &= landlockAccessFSExecute | landlockAccessFSWriteFile | landlockAccessFSReadFile
+	}
+
+	// struct landlock_path_beneath_attr is packed.
+	var attr [12]byte
+	binary.LittleEndian.PutUint64(attr[:8], access)
+	binary.LittleEndian.PutUint32(attr[8:], uint32(f.Fd()))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("%s: %v", path, errno)
+	}
+	return nil
+}
+
+func seccomp() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", runtime.GOARCH)
+	}
+
+	// Offsets into struct seccomp_data.
+	const nrOffset, archOffset = 0, 4
+	n := len(allowedSyscalls)
+	if n > 250 {
+		// Beyond the reach of a conditional jump.
+		return fmt.Errorf("%d syscalls allowed, too many for the filter", n)
+	}
+	filter := []sockFilter{
+		{code: bpfLdWAbs, k: archOffset},
+		// Kill on a foreign architecture; jumps over the syscall checks.
+		{code: bpfJeqK, jt: 0, jf: uint8(n + 4), k: arch},
+		{code: bpfLdWAbs, k: nrOffset},
+		// Kill on x32 syscalls, which use numbers of their own.
+		{code: bpfJgeK, jt: uint8(n + 2), jf: 0, k: 0x40000000},
+	}
+	for i, nr := range allowedSyscalls {
+		filter = append(filter, sockFilter{code: bpfJeqK, jt: uint8(n - i), jf: 0, k: uint32(nr)})
+	}
+	filter = append(filter,
+		sockFilter{code: bpfRetK, k: seccompRetErrno | uint32(syscall.EPERM)},
+		sockFilter{code: bpfRetK, k: seccompRetAllow},
+		sockFilter{code: bpfRetK, k: seccompRetKillProcess},
+	)
+
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
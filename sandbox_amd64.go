@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// getrandom(2), which package syscall has no name for.
+const sysGetrandom = 318
+
+// Syscalls of allowedSyscalls that only amd64 has, or has under other names.
+var archSyscalls = []uintptr{
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_GETPGRP,
+	sysGetrandom,
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// getrandom(2), which package syscall has no name for.
+const sysGetrandom = 278
+
+// Syscalls of allowedSyscalls that only arm64 has, or has under other names.
+var archSyscalls = []uintptr{
+	syscall.SYS_FSTATAT,
+	syscall.SYS_GETRLIMIT,
+	sysGetrandom,
+}
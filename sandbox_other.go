@@ -0,0 +1,6 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+// seccomp fails on other architectures, for want of an auditArch.
+var allowedSyscalls []uintptr
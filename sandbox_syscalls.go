@@ -0,0 +1,113 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import "syscall"
+
+// epoll_pwait2(2), which package syscall has no name for, the same on every
+// architecture.
+const sysEpollPwait2 = 441
+
+// Syscalls memlimit may still make once sandboxed: those of the Go runtime
+// and of the parts of the standard library memlimit uses, and those it makes
+// itself to watch and throttle processes. Everything else fails with EPERM,
+// so a compromised monitor can't change its credentials, load code into the
+// kernel or write to other processes. New Go releases may need additions
+// here.
+var allowedSyscalls = append([]uintptr{
+	// Memory, threads, signals and time, for the runtime.
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MADVISE,
+	syscall.SYS_MINCORE,
+	syscall.SYS_BRK,
+	syscall.SYS_CLONE,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_GETRES,
+	syscall.SYS_GETTID,
+	syscall.SYS_GETPID,
+	// getpgrp(2) on arm64, which has no getpgrp.
+	syscall.SYS_GETPGID,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_TGKILL,
+	syscall.SYS_SETITIMER,
+	syscall.SYS_TIMER_CREATE,
+	syscall.SYS_TIMER_SETTIME,
+	syscall.SYS_TIMER_DELETE,
+	syscall.SYS_PRCTL,
+	syscall.SYS_UNAME,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+
+	// Files, /proc, the state directory and -config.
+	syscall.SYS_OPENAT,
+	syscall.SYS_CLOSE,
+	syscall.SYS_READ,
+	syscall.SYS_PREAD64,
+	syscall.SYS_WRITE,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_LSEEK,
+	syscall.SYS_FSTAT,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_FCNTL,
+	syscall.SYS_FLOCK,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_INOTIFY_ADD_WATCH,
+	syscall.SYS_INOTIFY_RM_WATCH,
+	syscall.SYS_IOCTL,
+
+	// The poller, sockets of the control API, D-Bus and sd_notify.
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	sysEpollPwait2,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_PIPE2,
+	syscall.SYS_PPOLL,
+	syscall.SYS_SOCKET,
+	syscall.SYS_CONNECT,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_SENDTO,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_SHUTDOWN,
+
+	// Watching and throttling processes, and waiting for the command run.
+	syscall.SYS_KILL,
+	syscall.SYS_WAIT4,
+	syscall.SYS_WAITID,
+	syscall.SYS_GETPRIORITY,
+	syscall.SYS_SETPRIORITY,
+	syscall.SYS_SCHED_GETSCHEDULER,
+	syscall.SYS_SCHED_GETPARAM,
+	syscall.SYS_SCHED_SETSCHEDULER,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_SCHED_SETAFFINITY,
+	syscall.SYS_MIGRATE_PAGES,
+	syscall.SYS_GETRUSAGE,
+	sysPidfdOpen,
+	sysPidfdSendSignal,
+	sysProcessMadvise,
+}, archSyscalls...)
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// attachSession implements memlimit attach: it has the tree of the calling
+// shell tracked, by the instance serving the control API at listen if set,
+// and otherwise by a new instance started in the background with flags.
+func attachSession(args []string, listen, token, stateDir string, flags []string) error {
+	fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+	limit := fs.String("limit", "", "VSZ limit of the session's tree, e.g. 16G; none of its own if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+	if *limit != "" {
+		if _, err := parseSize(*limit); err != nil {
+			return fmt.Errorf("invalid -limit: %v", err)
+		}
+	}
+	shell := os.Getppid()
+
+	if listen != "" {
+		if err := attachRemote(listen, token, shell, *limit); err != nil {
+			return err
+		}
+		fmt.Printf("Session %d attached to memlimit at %s\n", shell, listen)
+		return nil
+	}
+
+	if stateDir != "" {
+		f, err := lockFile(treeLockPath(stateDir, shell))
+		if err == errLocked {
+			return fmt.Errorf("session %d is already managed by another memlimit instance", shell)
+		} else if err == nil {
+			f.Close()
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	spec := strconv.Itoa(shell)
+	if *limit != "" {
+		spec += ":" + *limit
+	}
+	cmd := exec.Command(exe, append(flags, "-tree", spec)...)
+	// Out of the way of the session's job control, and of its hangup.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Printf("Started memlimit %d for session %d\n", cmd.Process.Pid, shell)
+	return cmd.Process.Release()
+}
+
+// controlClient returns a client for the control API at addr, a unix socket
+// path or a TCP host:port as for -listen, and the base URL to use with it.
+// Over TCP, it sends token, if set.
+func controlClient(addr, token string) (*http.Client, string) {
+	if !strings.Contains(addr, "/") {
+		if token == "" {
+			return http.DefaultClient, "http://" + addr
+		}
+		return &http.Client{Transport: bearerTransport{token, http.DefaultTransport}}, "http://" + addr
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		},
+	}}, "http://memlimit"
+}
+
+// bearerTransport sends requests with token, for authenticate.
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(r)
+}
+
+// httpError returns the error a control API response carries.
+func httpError(resp *http.Response) error {
+	msg, _ := io.ReadAll(resp.Body)
+	return errors.New(strings.TrimSpace(string(msg)))
+}
+
+// attachRemote asks the control API at addr to track the tree of pid.
+func attachRemote(addr, token string, pid int, limit string) error {
+	client, base := controlClient(addr, token)
+	resp, err := client.PostForm(base+"/attach", url.Values{"pid": {strconv.Itoa(pid)}, "vsz-limit-mb": {limit}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("attaching session %d: %v", pid, httpError(resp))
+	}
+	return nil
+}
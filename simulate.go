@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Victim orders simulate takes, as the -sort-by and -sort-desc they stand
+// for. Processes earlier in the order are let run first.
+var simulatePolicies = map[string]struct {
+	sortBy string
+	desc   bool
+}{
+	"oldest-first":   {"starttime", false},
+	"newest-first":   {"starttime", true},
+	"largest-first":  {"vsz", true},
+	"smallest-first": {"vsz", false},
+	"stable-first":   {"growth", false},
+}
+
+func simulatePolicyNames() []string {
+	names := make([]string, 0, len(simulatePolicies))
+	for name := range simulatePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseSimulate parses the flags of memlimit simulate into those of the
+// replay it runs, returning a description of the settings simulated. Flags
+// given before simulate apply as well.
+func parseSimulate(args []string) (string, error) {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	trace := fs.String("trace", "", "Trace recorded with -record-trace to replay")
+	limit := fs.String("vsz-limit", "", "Overall VSZ limit to simulate, e.g. 12G")
+	ltoLimit := fs.String("lto-vsz-limit", "", "VSZ limit of LTO links to simulate")
+	policy := fs.String("policy", "", "Order in which processes are let run: "+strings.Join(simulatePolicyNames(), ", "))
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if *trace == "" {
+		return "", errors.New("requires -trace")
+	}
+
+	settings := []string{"trace " + *trace}
+	set := map[string]string{"replay": *trace}
+	if *limit != "" {
+		set["vsz-limit-mb"] = *limit
+		settings = append(settings, "overall limit "+*limit)
+	}
+	if *ltoLimit != "" {
+		set["lto-vsz-limit-mb"] = *ltoLimit
+		settings = append(settings, "LTO limit "+*ltoLimit)
+	}
+	if *policy != "" {
+		p, ok := simulatePolicies[*policy]
+		if !ok {
+			return "", fmt.Errorf("unknown -policy %q", *policy)
+		}
+		set["sort-by"], set["sort-desc"] = p.sortBy, fmt.Sprint(p.desc)
+		settings = append(settings, "policy "+*policy)
+	}
+	for name, value := range set {
+		if err := flag.Set(name, value); err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	// The subcommand isn't a command to run.
+	flag.CommandLine.Parse(nil)
+	return strings.Join(settings, ", "), nil
+}
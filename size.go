@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Size units, all binary: 1G is 1024M, whether written G, GB or GiB.
+var sizeUnits = []struct {
+	suffix string
+	bytes  uint64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses a size such as 4GiB, 512M or 0.5T into bytes. A bare
+// number is in megabytes, as sizes were before units were accepted.
+func parseSize(s string) (uint64, error) {
+	num := strings.TrimSpace(s)
+	unit := uint64(1 << 20)
+	if i := strings.IndexFunc(num, unicode.IsLetter); i >= 0 {
+		var ok bool
+		if unit, ok = sizeUnit(strings.ToUpper(num[i:])); !ok {
+			return 0, fmt.Errorf("invalid size %q, want e.g. 512M or 4GiB", s)
+		}
+		num = strings.TrimSpace(num[:i])
+	}
+
+	if n, err := strconv.ParseUint(num, 10, 64); err == nil {
+		if n > math.MaxUint64/unit {
+			return 0, fmt.Errorf("size %q out of range", s)
+		}
+		return n * unit, nil
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid size %q, want e.g. 512M or 4GiB", s)
+	}
+	if f*float64(unit) >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q out of range", s)
+	}
+	return uint64(f * float64(unit)), nil
+}
+
+// sizeUnit returns the bytes in suffix, which is upper case: B, or one of
+// the units alone or followed by B or IB.
+func sizeUnit(suffix string) (uint64, bool) {
+	if suffix == "B" {
+		return 1, true
+	}
+	for _, u := range sizeUnits {
+		switch suffix {
+		case u.suffix, u.suffix + "B", u.suffix + "IB":
+			return u.bytes, true
+		}
+	}
+	return 0, false
+}
+
+// formatSize formats bytes in the largest unit it has at least one of, e.g.
+// 512M or 1.5G.
+func formatSize(bytes uint64) string {
+	for _, u := range sizeUnits {
+		if bytes < u.bytes {
+			continue
+		}
+		if bytes%u.bytes == 0 {
+			return fmt.Sprintf("%d%s", bytes/u.bytes, u.suffix)
+		}
+		return fmt.Sprintf("%.1f%s", float64(bytes)/float64(u.bytes), u.suffix)
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// sizeFlag is a size in bytes, set from a flag with parseSize.
+type sizeFlag uint64
+
+func (f *sizeFlag) String() string {
+	return formatSize(uint64(*f))
+}
+
+func (f *sizeFlag) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*f = sizeFlag(n)
+	return nil
+}
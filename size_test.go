@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import "testing"
+
+// TestParseSize checks sizes with each way of writing a unit, bare numbers
+// in megabytes, and that anything else is rejected.
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		size string
+		want uint64
+	}{
+		{"512", 512 << 20},
+		{"0", 0},
+		{"1.5", 3 << 19},
+		{"100B", 100},
+		{"100b", 100},
+		{"4K", 4 << 10},
+		{"4KB", 4 << 10},
+		{"4KiB", 4 << 10},
+		{"4kib", 4 << 10},
+		{"512M", 512 << 20},
+		{"512MB", 512 << 20},
+		{"512MiB", 512 << 20},
+		{"4G", 4 << 30},
+		{"4GB", 4 << 30},
+		{"4GiB", 4 << 30},
+		{"4g", 4 << 30},
+		{"0.5T", 1 << 39},
+		{"2TiB", 2 << 40},
+		{" 4 GiB ", 4 << 30},
+		{"16777215T", 16777215 << 40},
+	} {
+		got, err := parseSize(tt.size)
+		if err != nil {
+			t.Errorf("%q: %v", tt.size, err)
+		} else if got != tt.want {
+			t.Errorf("%q: got %d, want %d", tt.size, got, tt.want)
+		}
+	}
+
+	for _, size := range []string{
+		"",
+		"G",
+		"GiB",
+		"4iB",
+		"4IB",
+		"4BB",
+		"4GIBB",
+		"4GG",
+		"4Gi",
+		"4P",
+		"4PB",
+		"4 G B",
+		"4X",
+		"G4",
+		"-1",
+		"-1G",
+		"1e3",
+		"NaN",
+		"inf",
+		"0x10",
+		"16777216T",
+		"18446744073709551616",
+	} {
+		if got, err := parseSize(size); err == nil {
+			t.Errorf("%q: got %d, want an error", size, got)
+		}
+	}
+}
+
+// TestFormatSize checks that sizes are formatted in the largest unit they
+// have at least one of, and parse back to what they were if whole.
+func TestFormatSize(t *testing.T) {
+	for _, tt := range []struct {
+		bytes uint64
+		want  string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1 << 10, "1K"},
+		{1536, "1.5K"},
+		{512 << 20, "512M"},
+		{1 << 30, "1G"},
+		{3 << 29, "1.5G"},
+		{1<<30 + 1, "1.0G"},
+		{2 << 40, "2T"},
+		{2048 << 40, "2048T"},
+	} {
+		got := formatSize(tt.bytes)
+		if got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.bytes, got, tt.want)
+			continue
+		}
+		if back, err := parseSize(got); tt.bytes%(1<<10) == 0 && (err != nil || back != tt.bytes) {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", got, back, err, tt.bytes)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// ewma is the smoothed memory of a process, as of at.
+type ewma struct {
+	vsz, rss float64
+	at       time.Time
+}
+
+// smooth returns stat with its VSZ and RSS replaced by their exponentially
+// weighted moving averages over smoothWindow, so that a spike lasting a scan
+// or two barely moves them. Samples are weighted by the time since the last
+// one, as scans are not evenly spaced.
+func (m *monitor) smooth(stat procfs.ProcStat) procfs.ProcStat {
+	e, ok := m.smoothed.get(stat)
+	if !ok {
+		e = ewma{vsz: float64(stat.VSize), rss: float64(stat.RSS)}
+	} else if dt := m.now.Sub(e.at); dt > 0 {
+		alpha := 1 - math.Exp(-float64(dt)/float64(m.smoothWindow))
+		e.vsz += alpha * (float64(stat.VSize) - e.vsz)
+		e.rss += alpha * (float64(stat.RSS) - e.rss)
+	}
+	e.at = m.now
+	m.smoothed.save(stat, e)
+	stat.VSize = uint64(e.vsz)
+	stat.RSS = uint64(e.rss)
+	return stat
+}
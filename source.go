@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/procfs"
+)
+
+// Extensions of the source files compilers are run on.
+var sourceExts = map[string]bool{
+	".c": true, ".cc": true, ".cp": true, ".cpp": true, ".cxx": true, ".c++": true, ".C": true,
+	".i": true, ".ii": true, ".m": true, ".mm": true, ".cu": true, ".cppm": true, ".ixx": true,
+	".s": true, ".S": true, ".sx": true,
+	".f": true, ".F": true, ".f90": true, ".F90": true, ".f95": true,
+	".rs": true,
+}
+
+// Compiler options taking the next argument as their value, which can
+// look like a source file without being the one compiled, and tend to name
+// temporary files.
+var sourceLikeOptions = map[string]bool{
+	"-o":              true,
+	"-MF":             true,
+	"-MT":             true,
+	"-MQ":             true,
+	"-dumpbase":       true,
+	"-dumpdir":        true,
+	"-main-file-name": true,
+	"-include":        true,
+}
+
+// Options that take a value like sourceLikeOptions only when given to cc1
+// and cc1plus, to which the gcc driver passes the dependency file of its own
+// -MD and -MMD, which take none.
+var cc1SourceLikeOptions = map[string]bool{
+	"-MD":  true,
+	"-MMD": true,
+}
+
+// sourceLike reports whether args[i] is an option whose value, the next
+// argument, can look like a source file without being the one compiled.
+func sourceLike(args [][]byte, i int) bool {
+	arg := string(args[i])
+	if sourceLikeOptions[arg] {
+		return true
+	}
+	if !cc1SourceLikeOptions[arg] {
+		return false
+	}
+	name := filepath.Base(string(args[0]))
+	return name == "cc1" || name == "cc1plus"
+}
+
+// compileJob is what a filtered process is compiling, going by its command
+// line.
+type compileJob struct {
+	// The source file as given on the command line, and its absolute path.
+	source, path string
+	// Hash of the other arguments, except the values of sourceLike options.
+	flags string
+	// Output of the ninja edge the process is part of, if any.
+	target string
+}
+
+// String describes j for logs: its source file and the ninja target it is
+// built for, as far as known.
+func (j compileJob) String() string {
+	switch {
+	case j.target == "":
+		return j.source
+	case j.source == "":
+		return j.target
+	}
+	return j.source + " for " + j.target
+}
+
+// liveJob returns the compile job stat is running, which has no source if
+// its command line doesn't name a source file.
+func liveJob(stat procfs.ProcStat) compileJob {
+	job := compileJob{target: ninjaTarget(stat)}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", stat.PID))
+	if err != nil {
+		return job
+	}
+	args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+	src := sourceArg(args)
+	if src < 0 {
+		return job
+	}
+	job.source, job.path = string(args[src]), string(args[src])
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", stat.PID)); err == nil && !filepath.IsAbs(job.path) {
+		job.path = filepath.Join(cwd, job.path)
+	}
+	h := fnv.New64a()
+	for i := 1; i < len(args); i++ {
+		if sourceLike(args, i) {
+			i++
+			continue
+		}
+		if i != src {
+			h.Write(args[i])
+			h.Write([]byte{0})
+		}
+	}
+	job.flags = fmt.Sprintf("%016x", h.Sum64())
+	return job
+}
+
+// sourceArg returns the index of the first argument in args naming a source
+// file, or -1 if there is none.
+func sourceArg(args [][]byte) int {
+	for i := 1; i < len(args); i++ {
+		if sourceLike(args, i) {
+			i++
+			continue
+		}
+		arg := string(args[i])
+		if arg != "" && arg[0] != '-' && sourceExts[filepath.Ext(arg)] {
+			return i
+		}
+	}
+	return -1
+}
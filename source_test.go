@@ -0,0 +1,49 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSourceArg checks that the first source file on a command line is
+// found, and not values of options that take a file.
+func TestSourceArg(t *testing.T) {
+	for _, tt := range []struct {
+		cmdline string
+		want    int
+	}{
+		{"cc1plus -quiet -D NDEBUG src/foo.cc -o /tmp/ccX.s", 4},
+		{"cc1 -quiet -dumpbase foo.c -dumpdir obj/ foo.c", 6},
+		{"clang -cc1 -main-file-name foo.c -o foo.o -x c foo.c", 8},
+		{"gcc -MD -MF foo.d -c foo.c bar.c", 5},
+		{"gcc -include config.h -include pre.c main.c", 5},
+		{"as --64 -o foo.o foo.s", 4},
+		{"rustc --crate-name foo --edition=2021 src/lib.rs", 4},
+		{"gfortran -c solver.f90", 2},
+		{"cc1 foo.C", 1},
+		// -MD and -MMD take the dependency file only when given to cc1
+		// and cc1plus.
+		{"gcc -c -MD foo.c", 3},
+		{"clang++ -MMD foo.cc -o foo.o", 2},
+		{"/usr/lib/gcc/x86_64-linux-gnu/13/cc1plus -MD obj/foo.d foo.cc", 3},
+		{"cc1 -MMD foo.d foo.c", 3},
+		// No source file.
+		{"cc1plus", -1},
+		{"cc1plus -", -1},
+		{"ld -o foo.c foo.o", -1},
+		{"cc1plus -quiet -o foo.cc", -1},
+		{"cc1plus -fsomething=foo.c", -1},
+		{"cc1plus -MD foo.c", -1},
+		{"cc1plus foo.h foo.o", -1},
+	} {
+		var args [][]byte
+		for _, arg := range strings.Fields(tt.cmdline) {
+			args = append(args, []byte(arg))
+		}
+		if got := sourceArg(args); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.cmdline, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// persistedState is the document kept in the state file, for external tools
+// and for recovering after a crash.
+type persistedState struct {
+	// PID of the memlimit process that owns the file.
+	PID     int       `json:"memlimit_pid"`
+	Mode    string    `json:"mode"`
+	Updated time.Time `json:"updated"`
+	status
+}
+
+func statePath(dir string, pid int) string {
+	return filepath.Join(dir, strconv.Itoa(pid)+".json")
+}
+
+// lockState returns the state file in dir of an instance managing trees, or
+// of one waiting for trees to be attached if there are none, and the locks
+// held for as long as it runs. Two instances managing the same tree would
+// fight each other, so there is a lock per tree; the state file of an
+// instance without any is covered by a lock named after its own PID, so
+// that others never take it for orphaned. Lock files are left behind, as
+// removing them would race with a new instance locking.
+func lockState(dir string, trees []*tree) (string, []*os.File) {
+	var locks []*os.File
+	for _, t := range trees {
+		path := treeLockPath(dir, t.pid)
+		f, err := lockFile(path)
+		if err == errLocked {
+			fatalf("Process %d is already managed by another memlimit instance (%s)", t.pid, path)
+		} else if err != nil {
+			log.Printf("Error locking %s, continuing without it: %v", path, err)
+		} else {
+			locks = append(locks, f)
+		}
+	}
+	if len(trees) > 0 {
+		return statePath(dir, trees[0].pid), locks
+	}
+
+	// Attached trees come and go.
+	pid := os.Getpid()
+	path := treeLockPath(dir, pid)
+	if f, err := lockFile(path); err != nil {
+		log.Printf("Error locking %s, continuing without it: %v", path, err)
+	} else {
+		locks = append(locks, f)
+	}
+	return statePath(dir, pid), locks
+}
+
+// writeState atomically replaces the state file at path.
+func writeState(path string, st persistedState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, so that readers see
+// either the old or the new contents in full.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".memlimit-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// adoptOrphans goes through the state files in dir for ones left behind by
+// instances that died without resuming the processes they had stopped, as
+// told by nobody holding the lock of their file (see lockState). Processes still stopped in
+// our trees are adopted in stop mode, to be released by our policy in due
+// course; the rest are resumed rather than left frozen forever.
+func (m *monitor) adoptOrphans(dir string, mode string) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(paths) == 0 {
+		return
+	}
+	stats, err := getProcStats()
+	if err != nil {
+		log.Println("Error listing procs to adopt:", err)
+		return
+	}
+
+	ours := make(map[int]bool, len(m.trees))
+	for _, t := range m.trees {
+		ours[t.pid] = true
+	}
+	for _, path := range paths {
+		pid, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			continue
+		}
+		if !ours[pid] {
+			// We hold the locks of our own trees already.
+			f, err := lockFile(treeLockPath(dir, pid))
+			if err != nil {
+				continue
+			}
+			f.Close()
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var st persistedState
+		if err := json.Unmarshal(data, &st); err != nil {
+			log.Printf("Error reading state file %s: %v", path, err)
+			continue
+		}
+		if st.Mode == "stop" {
+			for _, p := range st.Throttled {
+				m.adopt(stats, p, st.PID, mode == "stop")
+			}
+		} else if len(st.Throttled) > 0 {
+			log.Printf("Leaving %d processes throttled by previous instance %d in %s mode as they are", len(st.Throttled), st.PID, st.Mode)
+		}
+		if !ours[pid] {
+			os.Remove(path)
+		}
+	}
+}
+
+// adopt takes over p, left stopped by the previous instance prev: it is
+// adopted if keep is set and it is in one of our trees, and resumed
+// otherwise.
+func (m *monitor) adopt(stats map[int]procfs.ProcStat, p procStatus, prev int, keep bool) {
+	stat, ok := stats[p.PID]
+	if !ok || stat.Starttime != p.Starttime || stat.State != "T" {
+		return
+	}
+	if keep && m.inTrees(stats, stat) {
+		log.Printf("Adopting %d %s, left stopped by previous instance %d", stat.PID, stat.Comm, prev)
+		m.lastReason.save(stat, fmt.Sprintf("left stopped by previous instance %d", prev))
+		// Stopping it again is a no-op, but has it count as stopped by
+		// us, to be released in due course.
+		if err := m.thr.throttle(stat); err != nil {
+			log.Printf("Error adopting %d %s: %v", stat.PID, stat.Comm, err)
+			return
+		}
+		m.since.save(stat, m.clock.Now())
+		return
+	}
+	log.Printf("Resuming %d %s, left stopped by previous instance %d", stat.PID, stat.Comm, prev)
+	m.lastReason.save(stat, fmt.Sprintf("left stopped by previous instance %d", prev))
+	if err := m.kill(stat, syscall.SIGCONT); err != nil {
+		log.Printf("Error resuming %d %s: %v", stat.PID, stat.Comm, err)
+	}
+}
+
+// inTrees reports whether stat is in one of the tracked trees.
+func (m *monitor) inTrees(stats map[int]procfs.ProcStat, stat procfs.ProcStat) bool {
+	for seen := 0; seen < len(stats); seen++ {
+		for _, t := range m.trees {
+			if stat.PID == t.pid {
+				return true
+			}
+		}
+		parent, ok := stats[stat.PPID]
+		if !ok {
+			return false
+		}
+		stat = parent
+	}
+	return false
+}
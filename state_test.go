@@ -0,0 +1,72 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestAdoptOrphansLocked checks that an instance only adopts the state file
+// of one waiting for trees to be attached once that one is gone.
+func TestAdoptOrphansLocked(t *testing.T) {
+	var stopped procfs.ProcStat
+	for _, stat := range startSleepers(t, 1) {
+		stopped = stat
+	}
+	if err := syscall.Kill(stopped.PID, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; stopped.State != "T"; i++ {
+		if i == 100 {
+			t.Fatalf("%d not stopped", stopped.PID)
+		}
+		time.Sleep(10 * time.Millisecond)
+		proc, err := procfs.NewProc(stopped.PID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stopped, err = proc.Stat(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	path, locks := lockState(dir, nil)
+	st := persistedState{PID: os.Getpid(), Mode: "stop"}
+	st.Throttled = []procStatus{{PID: stopped.PID, Starttime: stopped.Starttime, Comm: stopped.Comm}}
+	if err := writeState(path, st); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := newTestMonitor(unlimited, isCompiler)
+	var resumed []int
+	other.kill = func(stat procfs.ProcStat, sig syscall.Signal) error {
+		if sig == syscall.SIGCONT {
+			resumed = append(resumed, stat.PID)
+		}
+		return nil
+	}
+	other.adoptOrphans(dir, "stop")
+	if len(resumed) > 0 {
+		t.Errorf("resumed %v of a running instance", resumed)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("state file of a running instance: %v", err)
+	}
+
+	for _, f := range locks {
+		f.Close()
+	}
+	other.adoptOrphans(dir, "stop")
+	if len(resumed) != 1 || resumed[0] != stopped.PID {
+		t.Errorf("resumed %v once the instance was gone, want [%d]", resumed, stopped.PID)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file left behind once the instance was gone: %v", err)
+	}
+}
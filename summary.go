@@ -0,0 +1,193 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Number of processes listed in the exit report, most throttled first.
+const summaryTop = 10
+
+// summary accumulates what throttling cost over the whole run, for the
+// report printed at exit.
+type summary struct {
+	start time.Time
+	// Time of the last scan, and the processes it left throttled.
+	last      time.Time
+	throttled []procStatus
+	// Wall-clock time during which at least one process was throttled.
+	throttledWall time.Duration
+	procs         map[procStatus]*procSummary
+
+	// Peak memory of the tracked trees, filtered or not, and peak swapped
+	// out memory of filtered processes.
+	peakVsz, peakRss, peakSwap uint64
+	// Stretches of time during which at least one process was throttled.
+	episodes       int
+	episodeStart   time.Time
+	longestEpisode time.Duration
+	// Longest a single process was held throttled at a stretch.
+	longestFreeze time.Duration
+	// Number of times a top-level process was paused in pause-top mode.
+	pauses int
+	// Number of processes killed for exceeding the hard or per-process
+	// limit, or -max-stopped.
+	kills int
+	// Number of escalation steps taken.
+	escalations int
+}
+
+type procSummary struct {
+	procStatus
+	// Number of times the process was throttled and released.
+	throttles, releases int
+	throttledFor        time.Duration
+	// Most of the process seen swapped out, and the most it was seen to
+	// have read and written.
+	peakSwap    uint64
+	read, write uint64
+	// What the process was compiling, if known.
+	job compileJob
+}
+
+// proc returns the summary of p.
+func (s *summary) proc(p procStatus) *procSummary {
+	if s.procs == nil {
+		s.procs = make(map[procStatus]*procSummary)
+	}
+	ps := s.procs[p]
+	if ps == nil {
+		ps = &procSummary{procStatus: p}
+		s.procs[p] = ps
+	}
+	return ps
+}
+
+// scan accounts the time since the last scan to the processes the last
+// scan left throttled, and remembers the ones st left throttled now.
+func (s *summary) scan(now time.Time, st status) {
+	throttled := st.Throttled
+	if vsz := st.Vsz + st.UnfilterableVsz; vsz > s.peakVsz {
+		s.peakVsz = vsz
+	}
+	if rss := st.Rss + st.UnfilterableRss; rss > s.peakRss {
+		s.peakRss = rss
+	}
+	if st.Swap > s.peakSwap {
+		s.peakSwap = st.Swap
+	}
+	if len(s.throttled) == 0 && len(throttled) > 0 {
+		s.episodes++
+		s.episodeStart = now
+	} else if len(s.throttled) > 0 && len(throttled) == 0 && now.Sub(s.episodeStart) > s.longestEpisode {
+		s.longestEpisode = now.Sub(s.episodeStart)
+	}
+
+	if s.start.IsZero() {
+		s.start = now
+	} else if d := now.Sub(s.last); len(s.throttled) > 0 {
+		s.throttledWall += d
+		for _, p := range s.throttled {
+			s.proc(p).throttledFor += d
+		}
+	}
+	s.last = now
+	s.throttled = throttled
+}
+
+// sample records how much of p is swapped out and how much it has read and
+// written, and what it is compiling, for the processes that have been
+// throttled.
+func (s *summary) sample(p procStatus, swap uint64, pio procIO, job compileJob) {
+	ps := s.procs[p]
+	if ps == nil {
+		return
+	}
+	ps.job = job
+	if swap > ps.peakSwap {
+		ps.peakSwap = swap
+	}
+	if pio.read > ps.read {
+		ps.read = pio.read
+	}
+	if pio.write > ps.write {
+		ps.write = pio.write
+	}
+}
+
+// freeze accounts a process having been held throttled for d at a stretch.
+func (s *summary) freeze(d time.Duration) {
+	if d > s.longestFreeze {
+		s.longestFreeze = d
+	}
+}
+
+// report prints the summary as of end. Without knowing the build's critical
+// path, the delay throttling caused can only be bracketed: it is at least
+// the time the longest throttled process was held, if that one was on the
+// critical path, and at most the time anything was held at all.
+func (m *monitor) report(w io.Writer, end time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &m.summary
+	if s.start.IsZero() {
+		return
+	}
+	s.scan(end, status{})
+	for _, since := range m.since {
+		s.freeze(end.Sub(since.value))
+	}
+
+	var total time.Duration
+	var throttles, releases int
+	ranked := make([]*procSummary, 0, len(s.procs))
+	for _, ps := range s.procs {
+		total += ps.throttledFor
+		throttles += ps.throttles
+		releases += ps.releases
+		ranked = append(ranked, ps)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].throttledFor != ranked[j].throttledFor {
+			return ranked[i].throttledFor > ranked[j].throttledFor
+		}
+		return ranked[i].throttles > ranked[j].throttles
+	})
+	wall := end.Sub(s.start)
+	fmt.Fprintf(w, "Summary over %v:\n", wall.Round(time.Second))
+	fmt.Fprintf(w, "  Peak memory: VSZ %s RSS %s Swap %s\n", formatSize(s.peakVsz), formatSize(s.peakRss), formatSize(s.peakSwap))
+	if s.pauses > 0 {
+		fmt.Fprintf(w, "  Top-level pauses: %d\n", s.pauses)
+	}
+	if s.escalations > 0 {
+		fmt.Fprintf(w, "  Escalation steps taken: %d\n", s.escalations)
+	}
+	if s.kills > 0 {
+		fmt.Fprintf(w, "  Processes killed over the hard or per-process limit or -max-stopped: %d\n", s.kills)
+	}
+	if len(ranked) == 0 {
+		fmt.Fprintln(w, "  No processes were throttled")
+		return
+	}
+	longest := ranked[0].throttledFor
+	fmt.Fprintf(w, "  Processes throttled: %d, for %v in total\n", len(s.procs), total.Round(time.Millisecond))
+	fmt.Fprintf(w, "  Throttling episodes: %d, longest %v\n", s.episodes, s.longestEpisode.Round(time.Millisecond))
+	fmt.Fprintf(w, "  Longest freeze of a single process: %v\n", s.longestFreeze.Round(time.Millisecond))
+	fmt.Fprintf(w, "  Throttle actions: %d, release actions: %d\n", throttles, releases)
+	fmt.Fprintf(w, "  Estimated build delay: %v to %v (%.1f%% to %.1f%% of wall clock)\n",
+		longest.Round(time.Millisecond), s.throttledWall.Round(time.Millisecond),
+		100*longest.Seconds()/wall.Seconds(), 100*s.throttledWall.Seconds()/wall.Seconds())
+	fmt.Fprintf(w, "  %7s %-16s %9s %8s %12s %8s %8s %8s  %s\n", "PID", "COMMAND", "THROTTLED", "RELEASED", "TIME", "MAX SWAP", "READ", "WRITTEN", "JOB")
+	for i, ps := range ranked {
+		if i == summaryTop {
+			fmt.Fprintf(w, "  ... %d more\n", len(ranked)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %7d %-16s %9d %8d %12v %8s %8s %8s  %s\n", ps.PID, ps.Comm, ps.throttles, ps.releases, ps.throttledFor.Round(time.Millisecond), formatSize(ps.peakSwap), formatSize(ps.read), formatSize(ps.write), ps.job)
+	}
+}
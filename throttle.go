@@ -0,0 +1,436 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/prometheus/procfs"
+)
+
+// throttler applies (and lifts) the throttling action on over-limit processes.
+type throttler interface {
+	// throttled reports whether the process is currently throttled.
+	throttled(stat procfs.ProcStat) bool
+	throttle(stat procfs.ProcStat) error
+	release(stat procfs.ProcStat) error
+	// prune drops any bookkeeping for processes that are no longer present.
+	prune(stats map[int]procfs.ProcStat)
+}
+
+func newThrottler(mode string, squeezeCPUs string, fds *pidfds) (throttler, error) {
+	switch mode {
+	case "stop":
+		return newStopThrottler(fds), nil
+	case "nice":
+		return &niceThrottler{orig: make(originals[map[int]int])}, nil
+	case "idle":
+		return &idleThrottler{orig: make(originals[map[int]schedAttr])}, nil
+	case "affinity":
+		set, err := parseCPUList(squeezeCPUs)
+		if err != nil {
+			return nil, err
+		}
+		return &affinityThrottler{set: set, orig: make(originals[map[int]cpuSet])}, nil
+	default:
+		return nil, fmt.Errorf("unknown mode %q", mode)
+	}
+}
+
+// stopThrottler freezes processes with SIGSTOP and resumes them with SIGCONT.
+// Only processes it stopped count as throttled, so that processes stopped by
+// someone else, e.g. suspended with Ctrl-Z, are never continued.
+type stopThrottler struct {
+	fds *pidfds
+	// Processes stopped, until seen running again. A process continued
+	// by someone else no longer counts as stopped by us once it is.
+	stopped originals[struct{}]
+}
+
+func newStopThrottler(fds *pidfds) *stopThrottler {
+	return &stopThrottler{fds: fds, stopped: make(originals[struct{}])}
+}
+
+func (t *stopThrottler) throttled(stat procfs.ProcStat) bool {
+	return stat.State == "T" && t.stopped.has(stat)
+}
+
+func (t *stopThrottler) throttle(stat procfs.ProcStat) error {
+	if err := t.fds.signal(stat, syscall.SIGSTOP); err != nil {
+		return err
+	}
+	t.stopped.save(stat, struct{}{})
+	return nil
+}
+
+func (t *stopThrottler) release(stat procfs.ProcStat) error {
+	return t.fds.signal(stat, syscall.SIGCONT)
+}
+
+func (t *stopThrottler) prune(stats map[int]procfs.ProcStat) {
+	t.stopped.prune(stats)
+	for pid := range t.stopped {
+		// A stop only takes effect once out of uninterruptible sleep.
+		if state := stats[pid].State; state != "T" && state != "D" {
+			delete(t.stopped, pid)
+		}
+	}
+}
+
+// dryRunThrottler only keeps track of which processes it would have
+// throttled, without touching them.
+type dryRunThrottler struct {
+	set originals[struct{}]
+}
+
+func (t *dryRunThrottler) throttled(stat procfs.ProcStat) bool {
+	return t.set.has(stat)
+}
+
+func (t *dryRunThrottler) throttle(stat procfs.ProcStat) error {
+	t.set.save(stat, struct{}{})
+	return nil
+}
+
+func (t *dryRunThrottler) release(stat procfs.ProcStat) error {
+	t.set.take(stat)
+	return nil
+}
+
+func (t *dryRunThrottler) prune(stats map[int]procfs.ProcStat) {
+	t.set.prune(stats)
+}
+
+// originals remembers a per-process attribute as it was before we throttled
+// the process. Entries are keyed by PID and checked against starttime so a
+// reused PID is never mistaken for a process we throttled.
+type originals[T any] map[int]original[T]
+
+type original[T any] struct {
+	starttime uint64
+	value     T
+}
+
+func (o originals[T]) has(stat procfs.ProcStat) bool {
+	_, ok := o.get(stat)
+	return ok
+}
+
+func (o originals[T]) get(stat procfs.ProcStat) (T, bool) {
+	e, ok := o[stat.PID]
+	if !ok || e.starttime != stat.Starttime {
+		var zero T
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (o originals[T]) save(stat procfs.ProcStat, value T) {
+	o[stat.PID] = original[T]{starttime: stat.Starttime, value: value}
+}
+
+func (o originals[T]) take(stat procfs.ProcStat) T {
+	e := o[stat.PID]
+	delete(o, stat.PID)
+	return e.value
+}
+
+func (o originals[T]) prune(stats map[int]procfs.ProcStat) {
+	for pid, e := range o {
+		if s, ok := stats[pid]; !ok || s.Starttime != e.starttime {
+			delete(o, pid)
+		}
+	}
+}
+
+// threads returns the thread IDs of pid. Nice values, scheduling policies
+// and CPU affinity belong to threads rather than processes, so throttlers
+// other than stop mode have to set them on each.
+func threads(pid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc/" + strconv.Itoa(pid) + "/task")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, syscall.ESRCH
+	} else if err != nil {
+		return nil, err
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+// threadAttr is a per-thread attribute: how to read it for a thread, and how
+// to set it.
+type threadAttr[T any] struct {
+	get func(tid int) (T, error)
+	set func(tid int, v T) error
+}
+
+// apply sets every thread of pid to v, returning what each was before by
+// TID. Threads that exit meanwhile are skipped. If a thread can't be set,
+// those already set are put back.
+func (a threadAttr[T]) apply(pid int, v T) (map[int]T, error) {
+	tids, err := threads(pid)
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[int]T, len(tids))
+	for _, tid := range tids {
+		orig, err := a.get(tid)
+		if err == nil {
+			err = a.set(tid, v)
+		}
+		if errors.Is(err, syscall.ESRCH) {
+			continue
+		} else if err != nil {
+			for tid, orig := range saved {
+				a.set(tid, orig)
+			}
+			return nil, err
+		}
+		saved[tid] = orig
+	}
+	if len(saved) == 0 {
+		return nil, syscall.ESRCH
+	}
+	return saved, nil
+}
+
+// restore sets every thread of pid back to what apply saved for it. Threads
+// started since inherited the throttled value from the thread that started
+// them, so they get what the main thread had.
+func (a threadAttr[T]) restore(pid int, saved map[int]T) error {
+	tids, err := threads(pid)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, tid := range tids {
+		v, ok := saved[tid]
+		if !ok {
+			if v, ok = saved[pid]; !ok {
+				continue
+			}
+		}
+		if err := a.set(tid, v); err != nil && !errors.Is(err, syscall.ESRCH) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Nice value applied to throttled processes in nice mode.
+const throttledNice = 19
+
+// Nice values of threads.
+var niceAttr = threadAttr[int]{
+	get: func(tid int) (int, error) {
+		// The raw system call returns 20 minus the nice value.
+		prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+		return 20 - prio, err
+	},
+	set: func(tid int, nice int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	},
+}
+
+// niceThrottler renices processes to throttledNice instead of stopping them,
+// restoring the original nice value of each thread on release. Lowering the
+// nice value back requires CAP_SYS_NICE (or a suitable RLIMIT_NICE).
+type niceThrottler struct {
+	orig originals[map[int]int]
+}
+
+func (t *niceThrottler) throttled(stat procfs.ProcStat) bool {
+	return t.orig.has(stat)
+}
+
+func (t *niceThrottler) throttle(stat procfs.ProcStat) error {
+	saved, err := niceAttr.apply(stat.PID, throttledNice)
+	if err != nil {
+		return err
+	}
+	t.orig.save(stat, saved)
+	return nil
+}
+
+func (t *niceThrottler) release(stat procfs.ProcStat) error {
+	// What was saved is only dropped once restored, so that the
+	// process still counts as throttled, and is released again, if
+	// restoring fails.
+	saved, _ := t.orig.get(stat)
+	if err := niceAttr.restore(stat.PID, saved); err != nil {
+		return err
+	}
+	t.orig.take(stat)
+	return nil
+}
+
+func (t *niceThrottler) prune(stats map[int]procfs.ProcStat) {
+	t.orig.prune(stats)
+}
+
+// Scheduling policy from linux/sched.h; not exported by package syscall.
+const schedIdle = 5
+
+type schedAttr struct {
+	policy   int
+	priority int32
+}
+
+// Scheduling policies of threads.
+var schedulerAttr = threadAttr[schedAttr]{
+	get: func(tid int) (schedAttr, error) {
+		policy, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETSCHEDULER, uintptr(tid), 0, 0)
+		if errno != 0 {
+			return schedAttr{}, errno
+		}
+		var priority int32
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETPARAM, uintptr(tid), uintptr(unsafe.Pointer(&priority)), 0); errno != 0 {
+			return schedAttr{}, errno
+		}
+		return schedAttr{policy: int(policy), priority: priority}, nil
+	},
+	set: func(tid int, attr schedAttr) error {
+		return setScheduler(tid, attr.policy, attr.priority)
+	},
+}
+
+// idleThrottler moves processes to SCHED_IDLE so they only run when nothing
+// else wants the CPU, and restores the original policy of each thread on
+// release.
+type idleThrottler struct {
+	orig originals[map[int]schedAttr]
+}
+
+func (t *idleThrottler) throttled(stat procfs.ProcStat) bool {
+	return t.orig.has(stat)
+}
+
+func (t *idleThrottler) throttle(stat procfs.ProcStat) error {
+	saved, err := schedulerAttr.apply(stat.PID, schedAttr{policy: schedIdle})
+	if err != nil {
+		return err
+	}
+	t.orig.save(stat, saved)
+	return nil
+}
+
+func (t *idleThrottler) release(stat procfs.ProcStat) error {
+	saved, _ := t.orig.get(stat)
+	if err := schedulerAttr.restore(stat.PID, saved); err != nil {
+		return err
+	}
+	t.orig.take(stat)
+	return nil
+}
+
+func (t *idleThrottler) prune(stats map[int]procfs.ProcStat) {
+	t.orig.prune(stats)
+}
+
+func setScheduler(pid int, policy int, priority int32) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(pid), uintptr(policy), uintptr(unsafe.Pointer(&priority)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cpuSet is a CPU affinity mask as passed to sched_setaffinity(2).
+type cpuSet [1024 / 64]uint64
+
+func (s *cpuSet) set(cpu int) {
+	s[cpu/64] |= 1 << (uint(cpu) % 64)
+}
+
+// parseCPUList parses a CPU list in the kernel's cpuset format, e.g. "0,2-3".
+func parseCPUList(list string) (cpuSet, error) {
+	var s cpuSet
+	for _, r := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(r, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return s, fmt.Errorf("invalid CPU list %q: %v", list, err)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return s, fmt.Errorf("invalid CPU list %q: %v", list, err)
+			}
+		}
+		if first < 0 || last < first || last >= len(s)*64 {
+			return s, fmt.Errorf("invalid CPU list %q", list)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			s.set(cpu)
+		}
+	}
+	return s, nil
+}
+
+// CPU affinity of threads.
+var affinityAttr = threadAttr[cpuSet]{
+	get: func(tid int) (cpuSet, error) {
+		var set cpuSet
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, uintptr(tid), unsafe.Sizeof(set), uintptr(unsafe.Pointer(&set))); errno != 0 {
+			return set, errno
+		}
+		return set, nil
+	},
+	set: func(tid int, set cpuSet) error {
+		return setAffinity(tid, &set)
+	},
+}
+
+// affinityThrottler confines processes to a small set of CPUs to slow down
+// their allocation rate, restoring the original affinity of each thread on
+// release.
+type affinityThrottler struct {
+	set  cpuSet
+	orig originals[map[int]cpuSet]
+}
+
+func (t *affinityThrottler) throttled(stat procfs.ProcStat) bool {
+	return t.orig.has(stat)
+}
+
+func (t *affinityThrottler) throttle(stat procfs.ProcStat) error {
+	saved, err := affinityAttr.apply(stat.PID, t.set)
+	if err != nil {
+		return err
+	}
+	t.orig.save(stat, saved)
+	return nil
+}
+
+func (t *affinityThrottler) release(stat procfs.ProcStat) error {
+	saved, _ := t.orig.get(stat)
+	if err := affinityAttr.restore(stat.PID, saved); err != nil {
+		return err
+	}
+	t.orig.take(stat)
+	return nil
+}
+
+func (t *affinityThrottler) prune(stats map[int]procfs.ProcStat) {
+	t.orig.prune(stats)
+}
+
+func setAffinity(pid int, set *cpuSet) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(pid), unsafe.Sizeof(*set), uintptr(unsafe.Pointer(set)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/procfs"
+)
+
+// TestFailedReleaseKept checks that a process whose attributes could not be
+// restored still counts as throttled, so that it is released again.
+func TestFailedReleaseKept(t *testing.T) {
+	// A PID unlikely to be running, whose threads can't be listed.
+	stat := procfs.ProcStat{PID: 1 << 30, Starttime: 1}
+	nice := &niceThrottler{orig: make(originals[map[int]int])}
+	nice.orig.save(stat, map[int]int{stat.PID: 0})
+	idle := &idleThrottler{orig: make(originals[map[int]schedAttr])}
+	idle.orig.save(stat, map[int]schedAttr{stat.PID: {}})
+	affinity := &affinityThrottler{orig: make(originals[map[int]cpuSet])}
+	affinity.orig.save(stat, map[int]cpuSet{stat.PID: {}})
+	for name, thr := range map[string]throttler{"nice": nice, "idle": idle, "affinity": affinity} {
+		if err := thr.release(stat); err == nil {
+			t.Errorf("%s: released a process that doesn't exist", name)
+		}
+		if !thr.throttled(stat) {
+			t.Errorf("%s: no longer throttled after a failed release", name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/procfs"
+)
+
+// traceProc is the recorded state of one process of a tracked tree, along
+// with how it was classified, since that needs more of /proc than the
+// snapshot holds.
+type traceProc struct {
+	PID       int    `json:"pid"`
+	PPID      int    `json:"ppid"`
+	Comm      string `json:"comm"`
+	State     string `json:"state"`
+	Flags     uint   `json:"flags"`
+	Starttime uint64 `json:"starttime"`
+	Nice      int    `json:"nice"`
+	VSize     uint64 `json:"vsize"`
+	RSS       uint64 `json:"rss"`
+	// VmSwap in bytes, of filtered processes only.
+	Swap uint64 `json:"swap,omitempty"`
+	// Bytes read from and written to storage, of filtered processes only.
+	ReadBytes  uint64 `json:"read_bytes,omitempty"`
+	WriteBytes uint64 `json:"write_bytes,omitempty"`
+	// Source file being compiled, and the ninja target it is built for, of
+	// filtered processes only.
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target,omitempty"`
+	UTime    uint   `json:"utime"`
+	STime    uint   `json:"stime"`
+	Filtered bool   `json:"filtered"`
+	LTO      bool   `json:"lto"`
+}
+
+// traceSnapshot is one scan's worth of a trace, written as a JSON line.
+type traceSnapshot struct {
+	Time  time.Time   `json:"time"`
+	Roots []int       `json:"roots"`
+	Procs []traceProc `json:"procs"`
+}
+
+func newTraceProc(stat procfs.ProcStat, filtered, lto bool, swap uint64, pio procIO, job compileJob) traceProc {
+	return traceProc{
+		PID:        stat.PID,
+		PPID:       stat.PPID,
+		Comm:       stat.Comm,
+		State:      stat.State,
+		Flags:      stat.Flags,
+		Starttime:  stat.Starttime,
+		Nice:       stat.Nice,
+		VSize:      stat.VSize,
+		RSS:        stat.RSS,
+		UTime:      stat.UTime,
+		STime:      stat.STime,
+		Swap:       swap,
+		ReadBytes:  pio.read,
+		WriteBytes: pio.write,
+		Source:     job.source,
+		Target:     job.target,
+		Filtered:   filtered,
+		LTO:        lto,
+	}
+}
+
+func (p traceProc) stat() procfs.ProcStat {
+	return procfs.ProcStat{
+		PID:       p.PID,
+		PPID:      p.PPID,
+		Comm:      p.Comm,
+		State:     p.State,
+		Flags:     p.Flags,
+		Starttime: p.Starttime,
+		Nice:      p.Nice,
+		VSize:     p.VSize,
+		RSS:       p.RSS,
+		UTime:     p.UTime,
+		STime:     p.STime,
+	}
+}
+
+// replay runs m over the trace recorded at path, one scan per snapshot. m
+// must not send any signals, i.e. use a dryRunThrottler. If m tracks no trees
+// yet, the trees recorded in the trace are used.
+func replay(m *monitor, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var procs map[int]traceProc
+	clock := &fakeClock{}
+	m.clock = clock
+	if m.hooks != nil {
+		m.hooks.clock = clock
+	}
+	m.classify = func(stat procfs.ProcStat) (bool, bool) {
+		p := procs[stat.PID]
+		return p.Filtered, p.LTO
+	}
+	m.swapOf = func(stat procfs.ProcStat) uint64 {
+		return procs[stat.PID].Swap
+	}
+	m.ioOf = func(stat procfs.ProcStat) procIO {
+		p := procs[stat.PID]
+		return procIO{read: p.ReadBytes, write: p.WriteBytes}
+	}
+	m.jobOf = func(stat procfs.ProcStat) compileJob {
+		p := procs[stat.PID]
+		return compileJob{source: p.Source, target: p.Target}
+	}
+
+	dec := json.NewDecoder(f)
+	for {
+		var snap traceSnapshot
+		if err := dec.Decode(&snap); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if len(m.trees) == 0 {
+			for _, root := range snap.Roots {
+				m.trees = append(m.trees, newTree(root, unlimited))
+			}
+		}
+
+		procs = make(map[int]traceProc, len(snap.Procs))
+		stats := make(map[int]procfs.ProcStat, len(snap.Procs))
+		for _, p := range snap.Procs {
+			procs[p.PID] = p
+			stats[p.PID] = p.stat()
+		}
+
+		if !m.prune(stats) {
+			return nil
+		}
+		clock.set(snap.Time)
+		m.scan(snap.Time, stats)
+	}
+}
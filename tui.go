@@ -0,0 +1,237 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Number of recent events shown below the process list, room permitting.
+const tuiEvents = 5
+
+// tui redraws a top-like view of the tracked trees on a terminal after each
+// scan.
+type tui struct {
+	out  *os.File
+	mode string
+
+	// Terminal keys are read from, if any, and its settings to restore.
+	in      *os.File
+	termios syscall.Termios
+	// PID of the selected process, 0 if none.
+	selected int
+}
+
+// newTUI switches out to the alternate screen. It fails unless out is a
+// terminal. If in is a terminal too, it is switched to unbuffered input for
+// handleKeys.
+func newTUI(in, out *os.File, mode string) (*tui, error) {
+	if _, _, err := winsize(out); err != nil {
+		return nil, fmt.Errorf("%s is not a terminal", out.Name())
+	}
+	t := &tui{out: out, mode: mode}
+	if ioctl(in, syscall.TCGETS, unsafe.Pointer(&t.termios)) == nil {
+		raw := t.termios
+		raw.Lflag &^= syscall.ICANON | syscall.ECHO
+		raw.Cc[syscall.VMIN] = 1
+		raw.Cc[syscall.VTIME] = 0
+		if ioctl(in, syscall.TCSETS, unsafe.Pointer(&raw)) == nil {
+			t.in = in
+		}
+	}
+	fmt.Fprint(out, "\033[?1049h\033[?25l")
+	return t, nil
+}
+
+// close restores the terminal to how it was before newTUI.
+func (t *tui) close() {
+	fmt.Fprint(t.out, "\033[?25h\033[?1049l")
+	if t.in != nil {
+		ioctl(t.in, syscall.TCSETS, unsafe.Pointer(&t.termios))
+	}
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func winsize(f *os.File) (rows, cols int, err error) {
+	var ws struct{ row, col, xpixel, ypixel uint16 }
+	if err := ioctl(f, syscall.TIOCGWINSZ, unsafe.Pointer(&ws)); err != nil {
+		return 0, 0, err
+	}
+	if ws.row == 0 || ws.col == 0 {
+		// Not known, e.g. on a serial console.
+		return 24, 80, nil
+	}
+	return int(ws.row), int(ws.col), nil
+}
+
+// gauge renders a bar of width cells showing how much of its limit b uses.
+func gauge(b *budget, width int) string {
+	filled := width
+	if b.vsz < b.limit {
+		filled = int(uint64(width) * b.vsz / b.limit)
+	}
+	return fmt.Sprintf("%-9s [%s%s] %7s / %s", b.name, strings.Repeat("#", filled), strings.Repeat("-", width-filled), formatSize(b.vsz), formatSize(b.limit))
+}
+
+// draw redraws the screen from the processes and status of the scan that
+// just finished.
+func (m *monitor) draw(procs []tracked, st status) {
+	rows, cols, err := winsize(m.tui.out)
+	if err != nil {
+		return
+	}
+
+	var lines []string
+	lines = append(lines,
+		fmt.Sprintf("memlimit  mode: %s  scan: %.1fms  %s", m.tui.mode, st.ScanMillis, m.now.Format("15:04:05")),
+		"",
+	)
+	if m.tui.in != nil {
+		lines[1] = "j/k: select  n: never stop  s: stop  c: clear override"
+	}
+	lines = append(lines, gauge(&m.global, 40))
+	if m.lto.procs > 0 {
+		lines = append(lines, gauge(&m.lto, 40))
+	}
+	for _, t := range m.trees {
+		if t.budget.limit != unlimited {
+			lines = append(lines, gauge(&t.budget, 40))
+		}
+	}
+	for _, node := range m.nodeIDs() {
+		lines = append(lines, gauge(m.nodes[node], 40))
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("Running: %d  Stopped: %d  Unfiltered: %d (VSZ %s RSS %s)  Total RSS: %s  Swap: %s", st.Running, st.Stopped, st.Unfiltered, formatSize(st.UnfilterableVsz), formatSize(st.UnfilterableRss), formatSize(st.Rss), formatSize(st.Swap)),
+		"",
+		fmt.Sprintf("%7s %-5s %-4s %9s %8s %8s %8s  %s", "PID", "STATE", "OVR", "STOPPED", "VSZ", "RSS", "SWAP", "COMMAND"),
+	)
+
+	events := m.events
+	if len(events) > tuiEvents {
+		events = events[len(events)-tuiEvents:]
+	}
+	room := rows - len(lines) - len(events) - 2
+	selectedLine := -1
+	for i, p := range procs {
+		if i == room-1 && len(procs) > room {
+			lines = append(lines, fmt.Sprintf("... %d more", len(procs)-i))
+			break
+		}
+		stat := p.stat
+		state, stopped := stat.State, ""
+		if m.thr.throttled(stat) {
+			state += "*"
+			if m.since.has(stat) {
+				stopped = m.now.Sub(m.since[stat.PID].value).Truncate(time.Second).String()
+			}
+		}
+		if m.unmanaged.has(stat) {
+			state += "!"
+		}
+		comm := stat.Comm
+		if p.isLTO {
+			comm += " (LTO)"
+		}
+		override, _ := m.overrides.get(stat)
+		if stat.PID == m.tui.selected {
+			selectedLine = len(lines)
+		}
+		lines = append(lines, fmt.Sprintf("%7d %-5s %-4s %9s %8s %8s %8s  %s", stat.PID, state, override, stopped, formatSize(stat.VirtualMemory()), formatSize(stat.ResidentMemory()), formatSize(p.swap), comm))
+	}
+
+	if len(events) > 0 {
+		lines = append(lines, "")
+		for _, e := range events {
+			lines = append(lines, fmt.Sprintf("%s %s %d %s: %s", e.Time.Format("15:04:05"), e.Type, e.PID, e.Comm, e.Reason))
+		}
+	}
+
+	writeScreen(m.tui.out, lines, rows, cols, selectedLine)
+}
+
+// writeScreen replaces what the screen shows with lines, cut to fit rows and
+// cols, showing line selected in reverse video.
+func writeScreen(out *os.File, lines []string, rows, cols, selected int) {
+	var buf bytes.Buffer
+	buf.WriteString("\033[H")
+	for i, line := range lines {
+		if i == rows {
+			break
+		}
+		if len(line) > cols {
+			line = line[:cols]
+		}
+		if i == selected {
+			line = "\033[7m" + line + "\033[m"
+		}
+		buf.WriteString(line)
+		buf.WriteString("\033[K")
+		if i < rows-1 && i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	buf.WriteString("\033[J")
+	out.Write(buf.Bytes())
+}
+
+// handleKeys lets the user select a process and override the policy for it
+// until the terminal is closed.
+func (m *monitor) handleKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := m.tui.in.Read(buf)
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		switch string(buf[:n]) {
+		case "j", "\033[B":
+			m.moveSelection(1)
+		case "k", "\033[A":
+			m.moveSelection(-1)
+		case "n":
+			m.setOverride(m.tui.selected, overrideRun)
+		case "s":
+			m.setOverride(m.tui.selected, overrideStop)
+		case "c":
+			m.setOverride(m.tui.selected, "")
+		}
+		m.draw(m.procs, m.status)
+		m.mu.Unlock()
+	}
+}
+
+// moveSelection selects the process delta rows below the selected one.
+func (m *monitor) moveSelection(delta int) {
+	if len(m.procs) == 0 {
+		return
+	}
+	i := -1
+	for j, p := range m.procs {
+		if p.stat.PID == m.tui.selected {
+			i = j
+		}
+	}
+	i += delta
+	if i < 0 {
+		i = 0
+	} else if i >= len(m.procs) {
+		i = len(m.procs) - 1
+	}
+	m.tui.selected = m.procs[i].stat.PID
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// watchdog pings the systemd service watchdog, so that systemd restarts us
+// if scans stop completing, e.g. stuck on a /proc read that never returns.
+type watchdog struct {
+	conn *net.UnixConn
+	// systemd's timeout, and when it was last pinged.
+	timeout time.Duration
+	last    time.Time
+}
+
+// newWatchdog returns the watchdog systemd enabled for us through
+// WATCHDOG_USEC and NOTIFY_SOCKET, or nil if it did not.
+func newWatchdog() (*watchdog, error) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return nil, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil, fmt.Errorf("WATCHDOG_USEC is set but NOTIFY_SOCKET is not")
+	}
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &watchdog{conn: conn, timeout: time.Duration(usec) * time.Microsecond}, nil
+}
+
+// ping tells systemd we are alive, at most every quarter of its timeout.
+func (w *watchdog) ping(now time.Time) error {
+	if now.Sub(w.last) < w.timeout/4 {
+		return nil
+	}
+	w.last = now
+	_, err := w.conn.Write([]byte("WATCHDOG=1"))
+	return err
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// abandonCommand is set once wrap has started a command, to kill it and take
+// the terminal back should we die before tracking it.
+var abandonCommand func()
+
+// fatalln is log.Fatalln, for errors that may happen after the command is
+// started: rather than leave it running untracked, with the terminal, it is
+// killed first.
+func fatalln(v ...any) {
+	if abandonCommand != nil {
+		abandonCommand()
+	}
+	log.Output(2, fmt.Sprintln(v...))
+	os.Exit(1)
+}
+
+// fatalf is log.Fatalf as fatalln is log.Fatalln.
+func fatalf(format string, v ...any) {
+	if abandonCommand != nil {
+		abandonCommand()
+	}
+	log.Output(2, fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// wrap starts args in a process group of its own, as the process tree to
+// track. Its exit code is sent on the returned channel once it has been
+// reaped, which has to happen for its PID to disappear from /proc.
+//
+// If interactive is set and we are in the foreground of a terminal, the
+// command is given the terminal, and job control stops (Ctrl-Z) of the
+// command are passed on to whoever started us, so shells see the wrapper
+// stop and continue along with it.
+//
+// If cgroup is not nil, the command is started right in that cgroup v2
+// directory with clone3(CLONE_INTO_CGROUP), so that neither it nor anything
+// it spawns ever runs outside of it.
+//
+// If js is not nil, the command is given it as the jobserver to run its
+// jobs through.
+func wrap(args []string, interactive bool, cgroup *os.File, js *jobserver) (*exec.Cmd, <-chan int, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if cgroup != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	if js != nil {
+		js.share(cmd)
+	}
+
+	tty := os.Stdin
+	foreground := interactive && foregroundPgrp(tty) == syscall.Getpgrp()
+	if foreground {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(tty.Fd())
+		// Once the command has the terminal we are in the background, and
+		// would be stopped for writing to or taking back the terminal.
+		signal.Ignore(syscall.SIGTTOU)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	pid := cmd.Process.Pid
+	abandonCommand = func() {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		if foreground {
+			setForegroundPgrp(tty, syscall.Getpgrp())
+		}
+	}
+	exited := make(chan int, 1)
+	go func() {
+		for {
+			var ws syscall.WaitStatus
+			if _, err := syscall.Wait4(pid, &ws, syscall.WUNTRACED, nil); err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				log.Println("Error waiting for command:", err)
+				exited <- 1
+				return
+			}
+
+			if !ws.Exited() && !ws.Signaled() {
+				// SIGSTOP is how pause-top throttles the command, so
+				// only job control stops are passed on.
+				switch ws.StopSignal() {
+				case syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+					if foreground {
+						suspend(pid, tty)
+					}
+				}
+				continue
+			}
+
+			if foreground {
+				setForegroundPgrp(tty, syscall.Getpgrp())
+			}
+			exited <- exitCode(ws)
+			return
+		}
+	}()
+	return cmd, exited, nil
+}
+
+// suspend takes the terminal back and stops us, as the command in process
+// group pgid was, then hands the terminal over again and continues the
+// command once we are continued.
+func suspend(pgid int, tty *os.File) {
+	setForegroundPgrp(tty, syscall.Getpgrp())
+
+	cont := make(chan os.Signal, 1)
+	signal.Notify(cont, syscall.SIGCONT)
+	defer signal.Stop(cont)
+	syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+	<-cont
+
+	setForegroundPgrp(tty, pgid)
+	syscall.Kill(-pgid, syscall.SIGCONT)
+}
+
+// foregroundPgrp returns the foreground process group of tty, or -1 if it
+// is not a terminal.
+func foregroundPgrp(tty *os.File) int {
+	var pgrp int32
+	if ioctl(tty, syscall.TIOCGPGRP, unsafe.Pointer(&pgrp)) != nil {
+		return -1
+	}
+	return int(pgrp)
+}
+
+func setForegroundPgrp(tty *os.File, pgrp int) {
+	p := int32(pgrp)
+	if err := ioctl(tty, syscall.TIOCSPGRP, unsafe.Pointer(&p)); err != nil {
+		log.Println("Error handing over the terminal:", err)
+	}
+}
+
+// exitCode returns the exit code a shell would report for a command that
+// finished with ws, e.g. 130 for one killed by SIGINT.
+func exitCode(ws syscall.WaitStatus) int {
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+// forward passes sig on to the process group pgid of a wrapped command, and
+// continues the group so that processes we stopped get to act on it too.
+func forward(pgid int, sig syscall.Signal) {
+	log.Printf("Forwarding %v to process group %d", sig, pgid)
+	syscall.Kill(-pgid, sig)
+	syscall.Kill(-pgid, syscall.SIGCONT)
+}